@@ -2,6 +2,7 @@ import numpy as np
 from sklearn.ensemble import RandomForestRegressor
 import requests
 import argparse
+import os
 
 
 def train_model():
@@ -25,9 +26,10 @@ def predict_delay(model, node_id, load):
     return model.predict([[node_id, load]])[0]
 
 
-def update_traffic_data(model, start_node, end_node, middleware_url):
+def update_traffic_data(model, start_node, end_node, middleware_url, token=None):
     """
-    Generate traffic data and send it to the Go middleware.
+    Generate traffic data and send it to the Go middleware, authenticated with
+    the node's traffic token if it has one.
     """
     traffic_data = {}
     for node_id in range(start_node, end_node + 1):
@@ -36,7 +38,8 @@ def update_traffic_data(model, start_node, end_node, middleware_url):
         traffic_data[node_id] = delay
 
     # Send traffic data to middleware
-    response = requests.post(middleware_url, json=traffic_data)
+    headers = {"Authorization": f"Bearer {token}"} if token else {}
+    response = requests.post(middleware_url, json=traffic_data, headers=headers)
     print(
         f"Response from middleware: {response.status_code} - {response.text}")
 
@@ -50,6 +53,8 @@ if __name__ == "__main__":
                         required=True, help="End node ID")
     parser.add_argument("--middleware_url", type=str, required=True,
                         help="Middleware URL to send traffic data")
+    parser.add_argument("--token", type=str, default=os.environ.get("TRAFFIC_TOKEN"),
+                        help="The node's traffic_token, if it sets one (default: $TRAFFIC_TOKEN)")
 
     args = parser.parse_args()
 
@@ -58,4 +63,4 @@ if __name__ == "__main__":
 
     # Update traffic data
     update_traffic_data(model, args.start_node,
-                        args.end_node, args.middleware_url)
+                        args.end_node, args.middleware_url, args.token)
@@ -0,0 +1,58 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "guards.json")
+	for _, data := range []string{"first", "second, longer than the first"} {
+		if err := WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Fatalf("read %q, want %q", got, data)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("mode %v, want 0600", perm)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files left in the directory, want only the file written", len(entries))
+	}
+}
+
+// TestWriteFileFailureKeepsOld checks that a write that cannot complete
+// leaves the old file as it was and no temporary file behind.
+func TestWriteFileFailureKeepsOld(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys.json")
+	if err := WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Renaming a file over a directory fails after the data is written.
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(sub, []byte("new"), 0600); err == nil {
+		t.Fatal("replaced a directory")
+	}
+	if got, _ := os.ReadFile(path); string(got) != "old" {
+		t.Errorf("old file now holds %q", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("%d entries in the directory, want the file and sub", len(entries))
+	}
+}
@@ -0,0 +1,150 @@
+// Package circuit keeps the multi-hop circuits of the tor-protocol network.
+// An entry node builds a circuit once and reuses it for later requests to the
+// same destination until it expires; every relay on the circuit keeps an entry
+// mapping its circuit ID to the previous hop, the next hop and the layer key.
+package circuit
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"tor-protocol/onion"
+	"tor-protocol/protocol"
+)
+
+// ErrUnrecognized is returned when no hop of a circuit recognizes a cell.
+var ErrUnrecognized = errors.New("circuit: cell not recognized by any hop")
+
+// Circuit is the entry node's view of a circuit: its hops in route order.
+// The onion layers count cells, so the cells of one exchange must reach the
+// hops before those of the next: callers hold Lock from sealing a request to
+// opening its reply.
+type Circuit struct {
+	Hops    []onion.Hop
+	Created time.Time
+	Expires time.Time
+
+	mu sync.Mutex
+}
+
+// Lock reserves the circuit for one exchange.
+func (c *Circuit) Lock() { c.mu.Lock() }
+
+// Unlock releases the circuit after an exchange.
+func (c *Circuit) Unlock() { c.mu.Unlock() }
+
+// New returns a circuit starting at first that expires after lifetime. The
+// remaining hops are added with AddHop as the circuit is extended.
+func New(first onion.Hop, lifetime time.Duration) *Circuit {
+	now := time.Now()
+	return &Circuit{Hops: []onion.Hop{first}, Created: now, Expires: now.Add(lifetime)}
+}
+
+// AddHop appends a hop the circuit has been extended to.
+func (c *Circuit) AddHop(h onion.Hop) {
+	c.Hops = append(c.Hops, h)
+}
+
+// Expired reports whether the circuit must no longer be used.
+func (c *Circuit) Expired(now time.Time) bool {
+	return !now.Before(c.Expires)
+}
+
+// ID returns the circuit ID on the entry node's link to the first hop.
+func (c *Circuit) ID() protocol.CircID {
+	return c.Hops[0].CircID
+}
+
+// Route returns the hop addresses in route order.
+func (c *Circuit) Route() []string {
+	route := make([]string, len(c.Hops))
+	for i, h := range c.Hops {
+		route[i] = h.Addr
+	}
+	return route
+}
+
+// Seal builds a RELAY cell addressed to hop target: the cell is stamped with
+// the target's digest and encrypted with one layer per hop from the target
+// back to the first hop.
+func (c *Circuit) Seal(target int, rc *protocol.RelayCell) (*protocol.Cell, error) {
+	payload, err := rc.Encode()
+	if err != nil {
+		return nil, err
+	}
+	for i := target; i >= 0; i-- {
+		c.Hops[i].Layer.Seal(&payload, onion.Forward, i == target)
+	}
+	return &protocol.Cell{CircID: c.ID(), Command: protocol.CmdRelay, Payload: payload}, nil
+}
+
+// Open removes the layers of a RELAY cell coming back along the circuit until
+// a hop recognizes it, and returns that hop's index and the relay cell.
+func (c *Circuit) Open(cell *protocol.Cell) (int, *protocol.RelayCell, error) {
+	payload := cell.Payload
+	for i, h := range c.Hops {
+		if h.Layer.Open(&payload, onion.Backward) {
+			rc, err := protocol.DecodeRelayCell(&payload)
+			return i, rc, err
+		}
+	}
+	return 0, nil, ErrUnrecognized
+}
+
+// Pool holds the entry node's circuits, one per destination.
+type Pool struct {
+	mu       sync.Mutex
+	circuits map[string]*Circuit
+}
+
+// NewPool returns an empty Pool.
+func NewPool() *Pool {
+	return &Pool{circuits: make(map[string]*Circuit)}
+}
+
+// Get returns the live circuit to dest, dropping it if it has expired.
+func (p *Pool) Get(dest string) (*Circuit, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.circuits[dest]
+	if !ok {
+		return nil, false
+	}
+	if c.Expired(time.Now()) {
+		delete(p.circuits, dest)
+		return nil, false
+	}
+	return c, true
+}
+
+// Put stores c as the circuit to dest.
+func (p *Pool) Put(dest string, c *Circuit) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.circuits[dest] = c
+}
+
+// Remove drops the circuit to dest if it is still c.
+func (p *Pool) Remove(dest string, c *Circuit) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.circuits[dest] == c {
+		delete(p.circuits, dest)
+	}
+}
+
+// NewID returns a random non-zero circuit ID.
+func NewID() (protocol.CircID, error) {
+	var b [protocol.CircIDSize]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		if id := protocol.CircID(binary.BigEndian.Uint32(b[:])); id != 0 {
+			return id, nil
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package circuit
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"tor-protocol/onion"
+	"tor-protocol/protocol"
+	"tor-protocol/qkd"
+)
+
+// ErrUnknownCircuit is returned for circuit IDs the relay does not know,
+// including circuits that have expired.
+var ErrUnknownCircuit = errors.New("circuit: unknown circuit")
+
+// ErrCircuitExists is returned when a CREATE reuses a live circuit ID.
+var ErrCircuitExists = errors.New("circuit: circuit ID already in use")
+
+// ErrAlreadyExtended is returned when a circuit's next hop is set twice.
+var ErrAlreadyExtended = errors.New("circuit: circuit already extended")
+
+// Entry is a relay's record of one circuit passing through it.
+type Entry struct {
+	Prev    string // address of the previous hop
+	Next    string // address of the next hop; empty at the last hop
+	NextID  protocol.CircID
+	Key     qkd.Key
+	Layer   *onion.Layer
+	Created time.Time
+}
+
+// Exit reports whether this relay is the last hop of the circuit.
+func (e *Entry) Exit() bool {
+	return e.Next == ""
+}
+
+// Table maps circuit IDs to the relay's circuit entries. Entries are created
+// by CREATE cells, extended by EXTEND relay cells and dropped on DESTROY or
+// once they outlive the table's TTL.
+type Table struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[protocol.CircID]*Entry
+}
+
+// NewTable returns an empty Table whose entries live for ttl.
+func NewTable(ttl time.Duration) *Table {
+	return &Table{ttl: ttl, entries: make(map[protocol.CircID]*Entry)}
+}
+
+// Create records circuit id, created by prev with the negotiated key, and
+// drops expired entries.
+func (t *Table) Create(id protocol.CircID, prev string, key qkd.Key) error {
+	layer, err := onion.NewLayer(key)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, e := range t.entries {
+		if now.Sub(e.Created) > t.ttl {
+			delete(t.entries, k)
+		}
+	}
+	if _, ok := t.entries[id]; ok {
+		return ErrCircuitExists
+	}
+	t.entries[id] = &Entry{Prev: prev, Key: key, Layer: layer, Created: now}
+	return nil
+}
+
+// Extend sets the next hop of circuit id. It can be called only once per
+// circuit.
+func (t *Table) Extend(id protocol.CircID, next string, nextID protocol.CircID) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, err := t.lookup(id)
+	if err != nil {
+		return err
+	}
+	if !e.Exit() {
+		return ErrAlreadyExtended
+	}
+	e.Next, e.NextID = next, nextID
+	return nil
+}
+
+// Lookup returns a copy of the entry for circuit id.
+func (t *Table) Lookup(id protocol.CircID) (Entry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, err := t.lookup(id)
+	if err != nil {
+		return Entry{}, err
+	}
+	return *e, nil
+}
+
+// Remove drops circuit id.
+func (t *Table) Remove(id protocol.CircID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, id)
+}
+
+// Len returns the number of circuits in the table.
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
+
+func (t *Table) lookup(id protocol.CircID) (*Entry, error) {
+	e, ok := t.entries[id]
+	if !ok {
+		return nil, ErrUnknownCircuit
+	}
+	if time.Since(e.Created) > t.ttl {
+		delete(t.entries, id)
+		return nil, ErrUnknownCircuit
+	}
+	return e, nil
+}
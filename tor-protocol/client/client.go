@@ -1,43 +1,99 @@
 package client
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"tor-protocol/config"
 	"tor-protocol/protocol"
+	"tor-protocol/qkd"
 )
 
-func SendRequest() error {
-	// Create a custom header
+// SendRequest sends a request carrying an authenticated custom protocol
+// header to the node at nodeURL (e.g. "http://127.0.0.1:8801"). The header is
+// sent at the highest version this node speaks; if the node rejects it and
+// advertises a lower version, the request is repeated at that version.
+func SendRequest(nodeURL string) error {
+	var routeID [2]byte
+	if _, err := rand.Read(routeID[:]); err != nil {
+		return err
+	}
+
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+
+	fileKey, err := qkd.NewFileKey(config.KeystorePassphrase, config.KeystoreKey)
+	if err != nil {
+		return err
+	}
+	store := qkd.NewStore(config.QKDKeyFile)
+	store.FileKey = fileKey
+	epoch, err := store.Current()
+	if err != nil {
+		return err
+	}
+	key := epoch.Key
+
+	// Create a custom header, naming the epoch of the key it is sealed under
 	header := &protocol.CustomHeader{
-		Version:     1,
-		RouteID:     12345,
-		Timestamp:   1672531200,
+		Version:     protocol.Version,
+		RouteID:     binary.BigEndian.Uint16(routeID[:]),
+		Timestamp:   time.Now().Unix(),
 		Encrypted:   true,
-		PayloadSize: 1024,
+		PayloadSize: 0,
+		Extensions:  protocol.Extensions{Nonce: binary.BigEndian.Uint64(nonce[:]), KeyEpoch: epoch.ID},
 	}
 
-	// Serialize the header
-	data, err := header.Serialize()
+	resp, err := sendHeader(nodeURL, header, key)
 	if err != nil {
 		return err
 	}
-
-	fmt.Printf("Sending request with header: %x\n", data)
+	if resp.StatusCode == http.StatusBadRequest {
+		peer, _ := strconv.Atoi(resp.Header.Get(config.ProtocolVersionKey))
+		if version := protocol.NegotiateVersion(uint8(peer)); version < header.Version {
+			log.Printf("Node %s speaks protocol v%d; downgrading the header from v%d, without its nonce and key epoch", nodeURL, version, header.Version)
+			header.Version = version
+			header.Extensions = protocol.Extensions{}
+			if resp, err = sendHeader(nodeURL, header, key); err != nil {
+				return err
+			}
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("node rejected custom protocol header: %s", resp.Status)
+	}
 	return nil
+}
+
+// sendHeader encodes header under the node's QKD key and sends it to nodeURL.
+func sendHeader(nodeURL string, header *protocol.CustomHeader, key qkd.Key) (*http.Response, error) {
+	encoded, err := protocol.EncodeHeader(header, key.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// Create an HTTP request
+	req, err := http.NewRequest(http.MethodGet, nodeURL+"/home/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(config.ProtocolHeaderKey, encoded)
+
+	// Send the request
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
 
-	// // Create an HTTP request
-	// req, err := http.NewRequest("POST", "http://localhost:8080/secure-route", bytes.NewBuffer([]byte("Test Payload")))
-	// if err != nil {
-	// 	return err
-	// }
-	// req.Header.Set("X-Custom-Protocol", string(data))
-
-	// // Send the request
-	// resp, err := http.DefaultClient.Do(req)
-	// if err != nil {
-	// 	return err
-	// }
-	// defer resp.Body.Close()
-
-	// fmt.Printf("Response: %s\n", resp.Status)
-	// return nil
+	log.Printf("Sent v%d header (%d bytes) to %s: %s", header.Version, len(encoded), nodeURL, resp.Status)
+	return resp, nil
 }
@@ -4,8 +4,11 @@ package config
 import (
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -14,6 +17,149 @@ var (
     DefaultLink = "http://127.0.0.1"
     RandomDelayUpperLimit = 5000
     CustomHeaderKey = "X-Tor-Route"
+    ProtocolHeaderKey = "X-QUAITOR-Protocol"
+    // ProtocolVersionKey advertises the highest header version a node speaks.
+    ProtocolVersionKey = "X-QUAITOR-Version"
+    HopFromHeader = "X-Hop-From"
+    CircuitLifetime = 10 * time.Minute
+    // HandshakeMode is the mode of the circuit handshakes this node starts:
+    // "hybrid" (QKD and ML-KEM) or "qkd". With RequireHybrid it also refuses
+    // CREATEs in "qkd" mode, so relays cannot downgrade a handshake.
+    HandshakeMode = "hybrid"
+    RequireHybrid = true
+    // DebugRoute sends the remaining route in plaintext in CustomHeaderKey.
+    // Routing never depends on it; it only makes hops traceable in the logs.
+    DebugRoute = false
+    QKDKeyFile = "quantum_key.json"
+    // Key files (QKDKeyFile, KeystoreFile, OTPPoolFile) are encrypted at rest
+    // under a key derived from KeystorePassphrase or, without one, the
+    // hex-encoded 32-byte KeystoreKey. Both are only read from the
+    // environment; with neither, the files are plain JSON.
+    KeystorePassphrase = ""
+    KeystoreKey = ""
+    // The QKD key is rotated into a new epoch once it is KeyLifetime old, or
+    // once this node has authenticated KeyMaxBytes of headers or
+    // KeyMaxMessages headers under it (0 disables a limit); payloads are
+    // sealed under link and circuit keys and do not count. Previous epochs
+    // stay acceptable for KeyGrace, and the limits are checked every
+    // KeyRotationInterval.
+    KeyLifetime = 24 * time.Hour
+    KeyMaxBytes = 64 << 20
+    KeyMaxMessages = 100000
+    KeyGrace = 10 * time.Minute
+    KeyRotationInterval = 30 * time.Second
+    // AEADCipher seals circuit messages: "aes-gcm" or "chacha20-poly1305".
+    AEADCipher = "aes-gcm"
+    // CipherMode is the default cipher mode for circuit messages, "aead" or
+    // "otp"; a request can choose its own with CipherModeHeader.
+    CipherMode = "aead"
+    CipherModeHeader = "X-QUAITOR-Cipher-Mode"
+    // KeystoreFile persists the pairwise link keys; each node inserts its port.
+    KeystoreFile = "keystore.json"
+    // LinkAuthHeader carries the tag that authenticates the messages of a
+    // link exchange.
+    LinkAuthHeader = "X-QUAITOR-Link-Auth"
+    // LinkKeySource is where link keys come from: "exchange", a simulated
+    // BB84 or E91 exchange with the peer, or "etsi014", the ETSI GS QKD 014
+    // API of the KME at KMEURL (this node's simulated KME if empty).
+    LinkKeySource = "exchange"
+    KMEURL = ""
+    // SAEAuthHeader carries the signature with which a node authenticates
+    // itself, as SAE, to its simulated KME.
+    SAEAuthHeader = "X-QUAITOR-SAE-Auth"
+    // The simulated KME delivers keys of KMEKeySize bits by default, at most
+    // KMEMaxKeyPerRequest per request, and holds at most KMEMaxKeyCount keys
+    // for its SAE's peers to collect, each for KMEKeyTTL.
+    KMEKeySize = 256
+    KMEMinKeySize = 64
+    KMEMaxKeySize = 8192
+    KMEMaxKeyPerRequest = 128
+    KMEMaxKeyCount = 1024
+    KMEKeyTTL = 5 * time.Minute
+    // LinkKeyQubits is the number of qubits sent in a link key exchange
+    // (E91 sends twice as many pairs).
+    LinkKeyQubits = 1024
+    // LinkProtocol is the protocol, "bb84" or "e91", of the link key
+    // exchanges this node starts; LinkProtocols overrides it per peer.
+    LinkProtocol = "bb84"
+    LinkProtocols = map[string]string{}
+    // CHSHThreshold is the |S| below which an E91 link exchange aborts,
+    // halfway between the classical bound 2 and the quantum bound 2√2.
+    CHSHThreshold = 1 + math.Sqrt2
+    // QBERSample is the fraction of sifted bits sacrificed to estimate the
+    // QBER of a link key exchange, which aborts above QBERThreshold.
+    QBERSample = 0.25
+    QBERThreshold = 0.11
+    // EveRate simulates an intercept-resend eavesdropper on the links into
+    // this node, intercepting that fraction of qubits; EveLinks limits her to
+    // the links from the listed peers (all links if empty).
+    EveRate = 0.0
+    EveLinks []string
+    // ChannelNoise flips that fraction of the qubits on the links into this
+    // node, to exercise reconciliation.
+    ChannelNoise = 0.0
+    // LinkRetry is how long a link whose key exchange was aborted is avoided.
+    LinkRetry = 5 * time.Minute
+    // OTPPoolFile persists one-time-pad material; each node inserts its port.
+    OTPPoolFile = "otp_pool.json"
+    // OTPResponseBits is the pad kept ready for a response in OTP mode.
+    OTPResponseBits = 1 << 16
+    // OTPMaxQubits bounds a single BB84 top-up of the OTP pool.
+    OTPMaxQubits = 1 << 20
+    // RouteSelection names the routing.PathSelector that picks circuit
+    // hops: "uniform" (or "random"), "latency" (weighted by the measured
+    // link latency), "bandwidth" (weighted by NodeBandwidths), "ai" (or
+    // "optimized", weighted by the inverse of the delays ai/main.py posts
+    // to /traffic, ignoring predictions older than TrafficMaxAge), "fixed"
+    // (FixedRoute), or any
+    // other registered selector. RouteSelections overrides it per node.
+    RouteSelection = "random"
+    RouteSelections = map[string]string{}
+    TrafficMaxAge = 5 * time.Minute
+    // TrafficToken, if set, is the bearer token ai/main.py must present to
+    // post to /traffic; without one, only clients on the node's own host
+    // may post. It is only read from the environment.
+    TrafficToken = ""
+    // NodeBandwidths overrides the bandwidth, in KB/s, the nodes advertise,
+    // by port. A node advertises the bandwidth it observes relaying,
+    // capped at BandwidthRate (0 for no cap), along with RelayFlags, the
+    // positions it is fit for ("guard", "exit"); nodes fetch each other's
+    // advertisements every DescriptorInterval.
+    NodeBandwidths = map[string]float64{}
+    BandwidthRate = 0.0
+    RelayFlags = []string{"guard", "exit"}
+    DescriptorInterval = time.Minute
+    // PositionWeights overrides the weights ("Wgg", "Wmg", ...) of the
+    // bandwidth path selector, see routing.PositionWeights.
+    PositionWeights = map[string]float64{}
+    // FixedRoute is the intermediate hops of every circuit with "fixed".
+    FixedRoute []string
+    // Every circuit starts at one of GuardCount entry guards (0 disables
+    // them), persisted in GuardsFile, where each node inserts its port. A
+    // guard is kept for GuardLifetime to 1.5 GuardLifetime, passed over for
+    // GuardRetry after a circuit failed at it and dropped after
+    // GuardMaxFailures failures in a row.
+    GuardCount = 3
+    GuardsFile = "guards.json"
+    GuardLifetime = 30 * 24 * time.Hour
+    GuardRetry = time.Minute
+    GuardMaxFailures = 3
+    // Every route has PathMinHops to PathMaxHops intermediate hops (0 for
+    // no maximum), the guard included, no two of them, or the
+    // destination, in the same family or run by the same operator, as
+    // declared by port in NodeFamilies and NodeOperators. With
+    // DistinctSubnets no two share a /24 (/48 for IPv6) either, by the
+    // addresses in NodeAddrs, or the host of DefaultLink.
+    PathMinHops = 1
+    PathMaxHops = 3
+    NodeFamilies = map[string]string{}
+    NodeOperators = map[string]string{}
+    NodeAddrs = map[string]string{}
+    DistinctSubnets = false
+    // ReplayWindow is how far a header timestamp may be from the node's clock.
+    ReplayWindow = 5 * time.Minute
+    // ReplayCacheSize bounds the number of headers remembered for replay checks.
+    ReplayCacheSize = 10000
 )
 
 
@@ -40,6 +186,309 @@ func LoadConfig() {
 
 	PortEnd = PortEndEnv 
 
+	QKDKeyFile = getEnv("qkd_key_file", QKDKeyFile)
+	AEADCipher = getEnv("aead_cipher", AEADCipher)
+	CipherMode = getEnv("cipher_mode", CipherMode)
+	OTPPoolFile = getEnv("otp_pool_file", OTPPoolFile)
+	KeystoreFile = getEnv("keystore_file", KeystoreFile)
+
+	linkQubits, err := getEnvAsInt("link_key_qubits", LinkKeyQubits)
+	if err != nil {
+		log.Printf("Error parsing link_key_qubits, using default %d: %v\n", LinkKeyQubits, err)
+	} else {
+		LinkKeyQubits = linkQubits
+	}
+
+	sample, err := getEnvAsFloat("qber_sample", QBERSample)
+	if err != nil {
+		log.Printf("Error parsing qber_sample, using default %g: %v\n", QBERSample, err)
+	} else {
+		QBERSample = sample
+	}
+
+	threshold, err := getEnvAsFloat("qber_threshold", QBERThreshold)
+	if err != nil {
+		log.Printf("Error parsing qber_threshold, using default %g: %v\n", QBERThreshold, err)
+	} else {
+		QBERThreshold = threshold
+	}
+
+	eveRate, err := getEnvAsFloat("eve_rate", EveRate)
+	if err != nil {
+		log.Printf("Error parsing eve_rate, using default %g: %v\n", EveRate, err)
+	} else {
+		EveRate = eveRate
+	}
+	if links := getEnv("eve_links", ""); links != "" {
+		EveLinks = strings.Split(links, ",")
+	}
+
+	LinkProtocol = getEnv("link_protocol", LinkProtocol)
+	// link_protocols is a comma-separated list of peer=protocol pairs.
+	if protocols := getEnv("link_protocols", ""); protocols != "" {
+		for _, pair := range strings.Split(protocols, ",") {
+			peer, protocol, ok := strings.Cut(pair, "=")
+			if !ok {
+				log.Printf("Error parsing link_protocols entry %q, ignoring it\n", pair)
+				continue
+			}
+			LinkProtocols[peer] = protocol
+		}
+	}
+
+	chsh, err := getEnvAsFloat("chsh_threshold", CHSHThreshold)
+	if err != nil {
+		log.Printf("Error parsing chsh_threshold, using default %g: %v\n", CHSHThreshold, err)
+	} else {
+		CHSHThreshold = chsh
+	}
+
+	noise, err := getEnvAsFloat("channel_noise", ChannelNoise)
+	if err != nil {
+		log.Printf("Error parsing channel_noise, using default %g: %v\n", ChannelNoise, err)
+	} else {
+		ChannelNoise = noise
+	}
+
+	retrySeconds, err := getEnvAsInt("link_retry", int(LinkRetry/time.Second))
+	if err != nil {
+		log.Printf("Error parsing link_retry, using default %s: %v\n", LinkRetry, err)
+	} else {
+		LinkRetry = time.Duration(retrySeconds) * time.Second
+	}
+
+	responseBits, err := getEnvAsInt("otp_response_bits", OTPResponseBits)
+	if err != nil {
+		log.Printf("Error parsing otp_response_bits, using default %d: %v\n", OTPResponseBits, err)
+	} else {
+		OTPResponseBits = responseBits
+	}
+
+	maxQubits, err := getEnvAsInt("otp_max_qubits", OTPMaxQubits)
+	if err != nil {
+		log.Printf("Error parsing otp_max_qubits, using default %d: %v\n", OTPMaxQubits, err)
+	} else {
+		OTPMaxQubits = maxQubits
+	}
+
+	lifetimeSeconds, err := getEnvAsInt("circuit_lifetime", int(CircuitLifetime/time.Second))
+	if err != nil {
+		log.Printf("Error parsing circuit_lifetime, using default %s: %v\n", CircuitLifetime, err)
+	} else {
+		CircuitLifetime = time.Duration(lifetimeSeconds) * time.Second
+	}
+
+	windowSeconds, err := getEnvAsInt("replay_window", int(ReplayWindow/time.Second))
+	if err != nil {
+		log.Printf("Error parsing replay_window, using default %s: %v\n", ReplayWindow, err)
+	} else {
+		ReplayWindow = time.Duration(windowSeconds) * time.Second
+	}
+
+	cacheSize, err := getEnvAsInt("replay_cache_size", ReplayCacheSize)
+	if err != nil {
+		log.Printf("Error parsing replay_cache_size, using default %d: %v\n", ReplayCacheSize, err)
+	} else {
+		ReplayCacheSize = cacheSize
+	}
+
+	keyLifetimeSeconds, err := getEnvAsInt("key_lifetime", int(KeyLifetime/time.Second))
+	if err != nil {
+		log.Printf("Error parsing key_lifetime, using default %s: %v\n", KeyLifetime, err)
+	} else {
+		KeyLifetime = time.Duration(keyLifetimeSeconds) * time.Second
+	}
+
+	keyMaxBytes, err := getEnvAsInt("key_max_bytes", KeyMaxBytes)
+	if err != nil {
+		log.Printf("Error parsing key_max_bytes, using default %d: %v\n", KeyMaxBytes, err)
+	} else {
+		KeyMaxBytes = keyMaxBytes
+	}
+
+	keyMaxMessages, err := getEnvAsInt("key_max_messages", KeyMaxMessages)
+	if err != nil {
+		log.Printf("Error parsing key_max_messages, using default %d: %v\n", KeyMaxMessages, err)
+	} else {
+		KeyMaxMessages = keyMaxMessages
+	}
+
+	keyGraceSeconds, err := getEnvAsInt("key_grace", int(KeyGrace/time.Second))
+	if err != nil {
+		log.Printf("Error parsing key_grace, using default %s: %v\n", KeyGrace, err)
+	} else {
+		KeyGrace = time.Duration(keyGraceSeconds) * time.Second
+	}
+
+	rotationSeconds, err := getEnvAsInt("key_rotation_interval", int(KeyRotationInterval/time.Second))
+	if err != nil {
+		log.Printf("Error parsing key_rotation_interval, using default %s: %v\n", KeyRotationInterval, err)
+	} else {
+		KeyRotationInterval = time.Duration(rotationSeconds) * time.Second
+	}
+
+	KeystorePassphrase = getEnv("keystore_passphrase", KeystorePassphrase)
+	KeystoreKey = getEnv("keystore_key", KeystoreKey)
+
+	LinkKeySource = getEnv("link_key_source", LinkKeySource)
+	KMEURL = getEnv("kme_url", KMEURL)
+	kmeKeySize, err := getEnvAsInt("kme_key_size", KMEKeySize)
+	if err != nil {
+		log.Printf("Error parsing kme_key_size, using default %d: %v\n", KMEKeySize, err)
+	} else {
+		KMEKeySize = kmeKeySize
+	}
+
+	kmeKeyTTLSeconds, err := getEnvAsInt("kme_key_ttl", int(KMEKeyTTL/time.Second))
+	if err != nil {
+		log.Printf("Error parsing kme_key_ttl, using default %s: %v\n", KMEKeyTTL, err)
+	} else {
+		KMEKeyTTL = time.Duration(kmeKeyTTLSeconds) * time.Second
+	}
+
+	RouteSelection = getEnv("route_selection", RouteSelection)
+	// route_selections is a comma-separated list of port=selection pairs.
+	if selections := getEnv("route_selections", ""); selections != "" {
+		for _, pair := range strings.Split(selections, ",") {
+			port, selection, ok := strings.Cut(pair, "=")
+			if !ok {
+				log.Printf("Error parsing route_selections entry %q, ignoring it\n", pair)
+				continue
+			}
+			RouteSelections[port] = selection
+		}
+	}
+
+	// node_bandwidths is a comma-separated list of port=KB/s pairs.
+	if bandwidths := getEnv("node_bandwidths", ""); bandwidths != "" {
+		for _, pair := range strings.Split(bandwidths, ",") {
+			port, value, ok := strings.Cut(pair, "=")
+			bw, err := strconv.ParseFloat(value, 64)
+			if !ok || err != nil {
+				log.Printf("Error parsing node_bandwidths entry %q, ignoring it\n", pair)
+				continue
+			}
+			NodeBandwidths[port] = bw
+		}
+	}
+	bandwidthRate, err := getEnvAsFloat("bandwidth_rate", BandwidthRate)
+	if err != nil {
+		log.Printf("Error parsing bandwidth_rate, using default %g: %v\n", BandwidthRate, err)
+	} else {
+		BandwidthRate = bandwidthRate
+	}
+	if flags, ok := os.LookupEnv("relay_flags"); ok {
+		RelayFlags = strings.Split(flags, ",")
+	}
+	descriptorSeconds, err := getEnvAsInt("descriptor_interval", int(DescriptorInterval/time.Second))
+	if err != nil {
+		log.Printf("Error parsing descriptor_interval, using default %s: %v\n", DescriptorInterval, err)
+	} else {
+		DescriptorInterval = time.Duration(descriptorSeconds) * time.Second
+	}
+	// position_weights is a comma-separated list of name=weight pairs.
+	if weights := getEnv("position_weights", ""); weights != "" {
+		for _, pair := range strings.Split(weights, ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			w, err := strconv.ParseFloat(value, 64)
+			if !ok || err != nil {
+				log.Printf("Error parsing position_weights entry %q, ignoring it\n", pair)
+				continue
+			}
+			PositionWeights[name] = w
+		}
+	}
+	if route := getEnv("fixed_route", ""); route != "" {
+		FixedRoute = strings.Split(route, ",")
+	}
+
+	trafficMaxAgeSeconds, err := getEnvAsInt("traffic_max_age", int(TrafficMaxAge/time.Second))
+	if err != nil {
+		log.Printf("Error parsing traffic_max_age, using default %s: %v\n", TrafficMaxAge, err)
+	} else {
+		TrafficMaxAge = time.Duration(trafficMaxAgeSeconds) * time.Second
+	}
+	TrafficToken = getEnv("traffic_token", TrafficToken)
+
+	GuardsFile = getEnv("guards_file", GuardsFile)
+	guardCount, err := getEnvAsInt("guard_count", GuardCount)
+	if err != nil {
+		log.Printf("Error parsing guard_count, using default %d: %v\n", GuardCount, err)
+	} else {
+		GuardCount = guardCount
+	}
+
+	guardLifetimeSeconds, err := getEnvAsInt("guard_lifetime", int(GuardLifetime/time.Second))
+	if err != nil {
+		log.Printf("Error parsing guard_lifetime, using default %s: %v\n", GuardLifetime, err)
+	} else {
+		GuardLifetime = time.Duration(guardLifetimeSeconds) * time.Second
+	}
+
+	guardRetrySeconds, err := getEnvAsInt("guard_retry", int(GuardRetry/time.Second))
+	if err != nil {
+		log.Printf("Error parsing guard_retry, using default %s: %v\n", GuardRetry, err)
+	} else {
+		GuardRetry = time.Duration(guardRetrySeconds) * time.Second
+	}
+
+	guardMaxFailures, err := getEnvAsInt("guard_max_failures", GuardMaxFailures)
+	if err != nil {
+		log.Printf("Error parsing guard_max_failures, using default %d: %v\n", GuardMaxFailures, err)
+	} else {
+		GuardMaxFailures = guardMaxFailures
+	}
+
+	pathMinHops, err := getEnvAsInt("path_min_hops", PathMinHops)
+	if err != nil {
+		log.Printf("Error parsing path_min_hops, using default %d: %v\n", PathMinHops, err)
+	} else {
+		PathMinHops = pathMinHops
+	}
+	pathMaxHops, err := getEnvAsInt("path_max_hops", PathMaxHops)
+	if err != nil {
+		log.Printf("Error parsing path_max_hops, using default %d: %v\n", PathMaxHops, err)
+	} else {
+		PathMaxHops = pathMaxHops
+	}
+	// node_families, node_operators and node_addrs are comma-separated
+	// lists of port=value pairs.
+	for env, values := range map[string]map[string]string{
+		"node_families":  NodeFamilies,
+		"node_operators": NodeOperators,
+		"node_addrs":     NodeAddrs,
+	} {
+		if pairs := getEnv(env, ""); pairs != "" {
+			for _, pair := range strings.Split(pairs, ",") {
+				port, value, ok := strings.Cut(pair, "=")
+				if !ok {
+					log.Printf("Error parsing %s entry %q, ignoring it\n", env, pair)
+					continue
+				}
+				values[port] = value
+			}
+		}
+	}
+	distinctSubnets, err := getEnvAsBool("distinct_subnets", DistinctSubnets)
+	if err != nil {
+		log.Printf("Error parsing distinct_subnets, using default %t: %v\n", DistinctSubnets, err)
+	} else {
+		DistinctSubnets = distinctSubnets
+	}
+
+	DebugRoute, err = getEnvAsBool("debug_route", false)
+	if err != nil {
+		log.Printf("Error parsing debug_route, using default false: %v\n", err)
+	}
+
+	HandshakeMode = getEnv("handshake_mode", HandshakeMode)
+	requireHybrid, err := getEnvAsBool("require_hybrid", RequireHybrid)
+	if err != nil {
+		log.Printf("Error parsing require_hybrid, using default %t: %v\n", RequireHybrid, err)
+	} else {
+		RequireHybrid = requireHybrid
+	}
+
     fmt.Printf("At Config: PortStart: %d, PortEnd: %d\n", PortStart, PortEnd)
     log.Printf("At Config: PortStart: %d, PortEnd: %d\n", PortStart, PortEnd)
 
@@ -73,6 +522,24 @@ func getEnvAsInt(key string, defaultValue int) (int, error) {
 	return strconv.Atoi(valueStr)
 }
 
+// getEnvAsBool retrieves the value of the environment variable as a bool or returns a default value.
+func getEnvAsBool(key string, defaultValue bool) (bool, error) {
+	valueStr := getEnv(key, "")
+	if valueStr == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseBool(valueStr)
+}
+
+// getEnvAsFloat retrieves the value of the environment variable as a float or returns a default value.
+func getEnvAsFloat(key string, defaultValue float64) (float64, error) {
+	valueStr := getEnv(key, "")
+	if valueStr == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseFloat(valueStr, 64)
+}
+
 func getEnv(key string, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -17,7 +17,8 @@ func ReturnHome(c *fiber.Ctx) error {
 	}
 
 	// Process the request using the custom header
-	fmt.Printf("Received request with RouteID: %d, PayloadSize: %d\n", customHeader.RouteID, customHeader.PayloadSize)
+	fmt.Printf("Received v%d request with RouteID: %d, PayloadSize: %d, Extensions: %+v\n",
+		customHeader.Version, customHeader.RouteID, customHeader.PayloadSize, customHeader.Extensions)
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "tor-protocol API",
@@ -0,0 +1,113 @@
+package etsi014
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client calls the QKD 014 API of a KME, which may be a node's simulated KME
+// or a vendor's: only BaseURL differs. Authentication of the SAE, which the
+// standard leaves to TLS client certificates, is configured on HTTP.
+type Client struct {
+	BaseURL string // e.g. "https://kme.example:443", without BasePath
+	HTTP    *http.Client
+}
+
+// NewClient returns a Client for the KME at baseURL.
+func NewClient(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTP: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Status returns the status of the keys the KME holds for delivery to slave.
+func (c *Client) Status(ctx context.Context, slave string) (*Status, error) {
+	var status Status
+	if err := c.do(ctx, http.MethodGet, slave, StatusEndpoint, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// GetKey asks for number keys of size bits shared with slave (0 for the
+// KME's defaults) and returns them by key ID.
+func (c *Client) GetKey(ctx context.Context, slave string, number, size int) ([]string, map[string][]byte, error) {
+	return c.keys(ctx, slave, EncKeysEndpoint, &KeyRequest{Number: number, Size: size})
+}
+
+// GetKeyWithKeyIDs returns the keys with the given IDs that master got for
+// this SAE.
+func (c *Client) GetKeyWithKeyIDs(ctx context.Context, master string, ids ...string) (map[string][]byte, error) {
+	req := &KeyIDs{}
+	for _, id := range ids {
+		req.KeyIDs = append(req.KeyIDs, KeyID{KeyID: id})
+	}
+	_, keys, err := c.keys(ctx, master, DecKeysEndpoint, req)
+	return keys, err
+}
+
+// keys posts req to the enc_keys or dec_keys endpoint and decodes the keys,
+// returning their IDs in the order delivered.
+func (c *Client) keys(ctx context.Context, sae, endpoint string, req any) ([]string, map[string][]byte, error) {
+	var container KeyContainer
+	if err := c.do(ctx, http.MethodPost, sae, endpoint, req, &container); err != nil {
+		return nil, nil, err
+	}
+	ids := make([]string, 0, len(container.Keys))
+	keys := make(map[string][]byte, len(container.Keys))
+	for _, k := range container.Keys {
+		key, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("etsi014: key %s: %w", k.KeyID, err)
+		}
+		ids = append(ids, k.KeyID)
+		keys[k.KeyID] = key
+	}
+	return ids, keys, nil
+}
+
+func (c *Client) do(ctx context.Context, method, sae, endpoint string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	u := fmt.Sprintf("%s%s/%s/%s", c.BaseURL, BasePath, url.PathEscape(sae), endpoint)
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		var e Error
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			apiErr.Message, apiErr.Details = e.Message, e.Details
+		}
+		return apiErr
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("etsi014: %s %s: %w", method, u, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Package etsi014 implements the key delivery interface of ETSI GS QKD 014
+// (V1.1.1), through which a key management entity (KME) hands QKD keys to
+// the secure application entities (SAEs) it serves: a master SAE gets keys
+// for a slave SAE, and the slave gets the same keys by their IDs from its
+// own KME.
+package etsi014
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// BasePath is the path prefix of the API; the endpoints are
+//
+//	GET           BasePath/{slave_SAE_ID}/status
+//	GET or POST   BasePath/{slave_SAE_ID}/enc_keys
+//	GET or POST   BasePath/{master_SAE_ID}/dec_keys
+const BasePath = "/api/v1/keys"
+
+// Endpoint names.
+const (
+	StatusEndpoint  = "status"
+	EncKeysEndpoint = "enc_keys"
+	DecKeysEndpoint = "dec_keys"
+)
+
+// Status is the status of the keys a KME holds for a master and slave SAE.
+type Status struct {
+	SourceKMEID      string `json:"source_KME_ID"`
+	TargetKMEID      string `json:"target_KME_ID"`
+	MasterSAEID      string `json:"master_SAE_ID"`
+	SlaveSAEID       string `json:"slave_SAE_ID"`
+	KeySize          int    `json:"key_size"`
+	StoredKeyCount   int    `json:"stored_key_count"`
+	MaxKeyCount      int    `json:"max_key_count"`
+	MaxKeyPerRequest int    `json:"max_key_per_request"`
+	MaxKeySize       int    `json:"max_key_size"`
+	MinKeySize       int    `json:"min_key_size"`
+	MaxSAEIDCount    int    `json:"max_SAE_ID_count"`
+}
+
+// KeyRequest is the body of a POST to enc_keys. Zero Number and Size select
+// the defaults of 1 key of the status's key_size.
+type KeyRequest struct {
+	Number                int              `json:"number,omitempty"`
+	Size                  int              `json:"size,omitempty"`
+	AdditionalSlaveSAEIDs []string         `json:"additional_slave_SAE_IDs,omitempty"`
+	ExtensionMandatory    []map[string]any `json:"extension_mandatory,omitempty"`
+	ExtensionOptional     []map[string]any `json:"extension_optional,omitempty"`
+}
+
+// KeyIDs is the body of a POST to dec_keys.
+type KeyIDs struct {
+	KeyIDs []KeyID `json:"key_IDs"`
+}
+
+// KeyID names one key.
+type KeyID struct {
+	KeyID string `json:"key_ID"`
+}
+
+// KeyContainer is the response of enc_keys and dec_keys.
+type KeyContainer struct {
+	Keys []Key `json:"keys"`
+}
+
+// Key is one delivered key, base64-encoded.
+type Key struct {
+	KeyID string `json:"key_ID"`
+	Key   string `json:"key"`
+}
+
+// Error is the body of an error response.
+type Error struct {
+	Message string           `json:"message"`
+	Details []map[string]any `json:"details,omitempty"`
+}
+
+// APIError is returned by a Client for an error response.
+type APIError struct {
+	StatusCode int
+	Message    string
+	Details    []map[string]any
+}
+
+func (e *APIError) Error() string {
+	var details []string
+	for _, d := range e.Details {
+		for k, v := range d {
+			details = append(details, fmt.Sprintf("%s: %v", k, v))
+		}
+	}
+	if len(details) == 0 {
+		return fmt.Sprintf("etsi014: %d %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("etsi014: %d %s (%s)", e.StatusCode, e.Message, strings.Join(details, "; "))
+}
+
+// NewKeyID returns a random (version 4) UUID to identify a key.
+func NewKeyID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
@@ -1,12 +1,11 @@
 module tor-protocol
 
-go 1.21
-
-toolchain go1.23.4
+go 1.24
 
 require (
 	github.com/gofiber/fiber/v2 v2.49.0
-	// github.com/joho/godotenv v1.5.1
+	golang.org/x/crypto v0.31.0
+// github.com/joho/godotenv v1.5.1
 )
 
 require (
@@ -20,5 +19,5 @@ require (
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasthttp v1.48.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
-	golang.org/x/sys v0.11.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"tor-protocol/config"
+	"tor-protocol/routing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Each node measures the bandwidth it relays and advertises it, with the
+// positions it is fit for, in a descriptor served at DescriptorPath:
+//
+//	{"port": "8802", "bandwidth": 812.5, "observed": 812.5, "flags": ["guard", "exit"], "published": "..."}
+//
+// Bandwidths are in KB/s. The observed bandwidth is the busiest
+// bandwidthBucket of the last bandwidthHistory, as Tor relays measure it, and
+// the advertised one is capped at config.BandwidthRate. Nodes fetch each
+// other's descriptors every config.DescriptorInterval, and the bandwidth
+// path selector weighs hops by them.
+const DescriptorPath = "/descriptor"
+
+const (
+	bandwidthBucket  = 10 * time.Second
+	bandwidthHistory = 24 * time.Hour
+)
+
+// descriptor is a node's advertisement of its bandwidth and flags.
+type descriptor struct {
+	Port      string    `json:"port"`
+	Bandwidth float64   `json:"bandwidth"`
+	Observed  float64   `json:"observed"`
+	Flags     []string  `json:"flags"`
+	Published time.Time `json:"published"`
+}
+
+// bandwidthMeter counts the bytes relayed per bandwidthBucket over the last
+// bandwidthHistory.
+type bandwidthMeter struct {
+	mu      sync.Mutex
+	buckets []int64 // ring indexed by bucket number
+	last    int64   // number of the latest bucket
+}
+
+var relayed = &bandwidthMeter{buckets: make([]int64, bandwidthHistory/bandwidthBucket)}
+
+// Add counts n bytes relayed now.
+func (m *bandwidthMeter) Add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.advance()
+	m.buckets[b%int64(len(m.buckets))] += int64(n)
+}
+
+// Observed returns the bandwidth of the busiest bucket, in KB/s.
+func (m *bandwidthMeter) Observed() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance()
+	var peak int64
+	for _, n := range m.buckets {
+		peak = max(peak, n)
+	}
+	return float64(peak) / 1024 / bandwidthBucket.Seconds()
+}
+
+// advance clears the buckets that went by since the last call, and returns
+// the number of the current one. m.mu must be held.
+func (m *bandwidthMeter) advance() int64 {
+	b := time.Now().UnixNano() / int64(bandwidthBucket)
+	size := int64(len(m.buckets))
+	for i := max(m.last+1, b-size+1); i <= b; i++ {
+		m.buckets[i%size] = 0
+	}
+	m.last = max(m.last, b)
+	return b
+}
+
+// ownDescriptor returns this node's descriptor.
+func ownDescriptor() descriptor {
+	observed := relayed.Observed()
+	advertised := observed
+	if config.BandwidthRate > 0 {
+		advertised = min(advertised, config.BandwidthRate)
+	}
+	return descriptor{
+		Port:      config.GetPort(),
+		Bandwidth: advertised,
+		Observed:  observed,
+		Flags:     config.RelayFlags,
+		Published: time.Now().UTC(),
+	}
+}
+
+// DescriptorHandler serves this node's descriptor.
+func DescriptorHandler(c *fiber.Ctx) error {
+	return c.JSON(ownDescriptor())
+}
+
+// fetchedDescriptor is a peer's descriptor and when it was fetched.
+type fetchedDescriptor struct {
+	descriptor
+	at time.Time
+}
+
+var (
+	descriptorsMu sync.Mutex
+	descriptors   = make(map[string]fetchedDescriptor) // by port
+
+	descriptorClient = &http.Client{Timeout: 2 * time.Second}
+)
+
+// StartDescriptorPolling fetches the descriptors of the other nodes now and
+// every config.DescriptorInterval.
+func StartDescriptorPolling() {
+	go func() {
+		for {
+			fetchDescriptors()
+			time.Sleep(config.DescriptorInterval)
+		}
+	}()
+}
+
+// fetchDescriptors fetches the descriptor of every other node in the port
+// range. A node that does not answer keeps its last descriptor until it is
+// too old to use (see peerDescriptor).
+func fetchDescriptors() {
+	self := config.GetPort()
+	for p := config.PortStart; p <= config.PortEnd; p++ {
+		port := strconv.Itoa(p)
+		if port == self {
+			continue
+		}
+		d, err := fetchDescriptor(port)
+		if err != nil {
+			continue
+		}
+		descriptorsMu.Lock()
+		descriptors[port] = fetchedDescriptor{d, time.Now()}
+		descriptorsMu.Unlock()
+	}
+}
+
+func fetchDescriptor(port string) (descriptor, error) {
+	resp, err := descriptorClient.Get(fmt.Sprintf("%s:%s%s", config.DefaultLink, port, DescriptorPath))
+	if err != nil {
+		return descriptor{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return descriptor{}, fmt.Errorf("descriptor of %s: %s", port, resp.Status)
+	}
+	var d descriptor
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return descriptor{}, err
+	}
+	if d.Port != port || d.Bandwidth < 0 {
+		return descriptor{}, fmt.Errorf("descriptor of %s: invalid", port)
+	}
+	if _, err := routing.ParseFlags(d.Flags); err != nil {
+		return descriptor{}, err
+	}
+	return d, nil
+}
+
+// peerDescriptor returns the descriptor last fetched from port, unless it
+// was fetched more than three polls ago.
+func peerDescriptor(port string) (descriptor, bool) {
+	descriptorsMu.Lock()
+	defer descriptorsMu.Unlock()
+	d, ok := descriptors[port]
+	if !ok || time.Since(d.at) > 3*config.DescriptorInterval {
+		return descriptor{}, false
+	}
+	return d.descriptor, true
+}
+
+// nodeBandwidth returns the bandwidth of the node on port: the one set in
+// config.NodeBandwidths, or else the one it advertises.
+func nodeBandwidth(port string) (float64, bool) {
+	if bw, ok := config.NodeBandwidths[port]; ok {
+		return bw, true
+	}
+	d, ok := peerDescriptor(port)
+	return d.Bandwidth, ok
+}
+
+// nodeFlags returns the flags the node on port advertises.
+func nodeFlags(port string) (routing.Flags, bool) {
+	d, ok := peerDescriptor(port)
+	if !ok {
+		return 0, false
+	}
+	f, err := routing.ParseFlags(d.Flags)
+	return f, err == nil
+}
+
+// positionWeights returns the configured position weights.
+func positionWeights() (routing.PositionWeights, error) {
+	w := routing.DefaultPositionWeights
+	for name, v := range config.PositionWeights {
+		if err := w.Set(name, v); err != nil {
+			return w, err
+		}
+	}
+	return w, nil
+}
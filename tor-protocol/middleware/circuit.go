@@ -0,0 +1,218 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"tor-protocol/circuit"
+	"tor-protocol/config"
+	"tor-protocol/onion"
+	"tor-protocol/protocol"
+	"tor-protocol/qkd"
+)
+
+var (
+	// entryCircuits holds the circuits this node built as an entry node.
+	entryCircuits = circuit.NewPool()
+
+	relayTableOnce sync.Once
+	relayTable     *circuit.Table
+)
+
+// errCircuitDestroyed is returned when a hop answers with a DESTROY cell.
+var errCircuitDestroyed = errors.New("circuit destroyed")
+
+// relayCircuits returns the table of circuits passing through this node. It
+// is created lazily so that config.CircuitLifetime has been loaded; relays
+// keep entries a little longer than entry nodes use them.
+func relayCircuits() *circuit.Table {
+	relayTableOnce.Do(func() {
+		relayTable = circuit.NewTable(config.CircuitLifetime + time.Minute)
+	})
+	return relayTable
+}
+
+// entryCircuit returns the live circuit to finalPort, building a new one if
+// there is none.
+func entryCircuit(ctx context.Context, currentPort, finalPort string) (*circuit.Circuit, error) {
+	if circ, ok := entryCircuits.Get(finalPort); ok {
+		return circ, nil
+	}
+
+	route, err := buildRoute(ctx, currentPort, finalPort)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[Port %s] [ProxyMiddleware] Generated new route: %v\n", currentPort, route)
+
+	circ, err := buildCircuit(route)
+	// Only a failure to create the circuit counts against the entry guard;
+	// one further along the route is no fault of the guard's.
+	if create := (*createError)(nil); errors.As(err, &create) {
+		guardResult(route[0], err)
+	} else {
+		guardResult(route[0], nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entryCircuits.Put(finalPort, circ)
+	log.Printf("[Port %s] Built circuit %d with %d hops, expires %s",
+		currentPort, circ.ID(), len(circ.Hops), circ.Expires.Format(time.RFC3339))
+	return circ, nil
+}
+
+// createError is returned by buildCircuit when the circuit could not be
+// created at its first hop.
+type createError struct {
+	hop string
+	err error
+}
+
+func (e *createError) Error() string { return fmt.Sprintf("create with %s: %v", e.hop, e.err) }
+func (e *createError) Unwrap() error { return e.err }
+
+// buildCircuit creates a circuit with the first hop of route and extends it
+// one hop at a time through the hops already built (telescoping), so that each
+// relay learns only its predecessor and successor.
+func buildCircuit(route []string) (*circuit.Circuit, error) {
+	id, err := circuit.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	create, finish, err := newHandshake(route[0])
+	if err != nil {
+		return nil, &createError{route[0], err}
+	}
+	cells, err := handshakeCells(id, protocol.CmdCreate, create)
+	if err != nil {
+		return nil, err
+	}
+	back, err := sendCells(route[0], cells, nil)
+	if err != nil {
+		return nil, &createError{route[0], err}
+	}
+	if len(back) == 0 || back[0].Command != protocol.CmdCreated {
+		return nil, &createError{route[0], errCircuitDestroyed}
+	}
+	created, err := joinHandshakeCells(back, protocol.CmdCreated)
+	if err != nil {
+		return nil, &createError{route[0], err}
+	}
+	key, err := finish(created)
+	if err != nil {
+		return nil, &createError{route[0], err}
+	}
+	layer, err := onion.NewLayer(key)
+	if err != nil {
+		return nil, &createError{route[0], err}
+	}
+	circ := circuit.New(onion.Hop{Addr: route[0], CircID: id, Key: key, Layer: layer}, config.CircuitLifetime)
+
+	for _, port := range route[1:] {
+		key, err := extendTo(circ, port)
+		if err == nil {
+			layer, err = onion.NewLayer(key)
+		}
+		if err != nil {
+			destroyCircuit(circ)
+			return nil, fmt.Errorf("extend to %s: %w", port, err)
+		}
+		circ.AddHop(onion.Hop{Addr: port, Key: key, Layer: layer})
+	}
+	return circ, nil
+}
+
+// extendTo asks the current last hop of circ to extend it to port and returns
+// the layer key negotiated with port.
+func extendTo(circ *circuit.Circuit, port string) (qkd.Key, error) {
+	create, finish, err := newHandshake(port)
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte{byte(len(port))}, port...)
+	data = append(data, create...)
+
+	last := len(circ.Hops) - 1
+	var cells []*protocol.Cell
+	for _, f := range protocol.SplitHandshake(data, protocol.RelayDataSize) {
+		cell, err := circ.Seal(last, &protocol.RelayCell{Command: protocol.RelayExtend, Data: f})
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, cell)
+	}
+	back, err := sendCells(circ.Hops[0].Addr, cells, circ.Route()[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	var fragments [][]byte
+	for _, cell := range back {
+		if cell.Command != protocol.CmdRelay {
+			return nil, errCircuitDestroyed
+		}
+		hop, rc, err := circ.Open(cell)
+		if err != nil {
+			return nil, err
+		}
+		if hop != last || rc.Command != protocol.RelayExtended {
+			return nil, fmt.Errorf("unexpected relay %s from hop %d", rc.Command, hop)
+		}
+		fragments = append(fragments, rc.Data)
+	}
+	created, err := protocol.JoinHandshake(fragments)
+	if err != nil {
+		return nil, err
+	}
+	return finish(created)
+}
+
+// exchange sends msg to the last hop of circ and returns its reply.
+func exchange(circ *circuit.Circuit, msg []byte) ([]byte, error) {
+	circ.Lock()
+	defer circ.Unlock()
+	last := len(circ.Hops) - 1
+	var cells []*protocol.Cell
+	for _, rc := range protocol.SplitMessage(msg) {
+		cell, err := circ.Seal(last, rc)
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, cell)
+	}
+
+	simulateDelay()
+	back, err := sendCells(circ.Hops[0].Addr, cells, circ.Route()[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	var replies []*protocol.RelayCell
+	for _, cell := range back {
+		if cell.Command == protocol.CmdDestroy {
+			return nil, errCircuitDestroyed
+		}
+		hop, rc, err := circ.Open(cell)
+		if err != nil {
+			return nil, err
+		}
+		if hop != last {
+			return nil, fmt.Errorf("reply from hop %d, expected %d", hop, last)
+		}
+		replies = append(replies, rc)
+	}
+	return protocol.JoinMessage(replies)
+}
+
+// destroyCircuit tears down circ along its route.
+func destroyCircuit(circ *circuit.Circuit) {
+	if _, err := sendCells(circ.Hops[0].Addr, []*protocol.Cell{destroyCell(circ.ID())}, nil); err != nil {
+		log.Printf("[Port %s] Destroying circuit %d failed: %v", config.GetPort(), circ.ID(), err)
+	}
+}
@@ -0,0 +1,362 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"tor-protocol/circuit"
+	"tor-protocol/config"
+	"tor-protocol/onion"
+	"tor-protocol/qkd"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The messages carried over a circuit are a request from the entry node to the
+// final node and the final node's response. Each starts with a type byte:
+//
+//	msgSealed:    a request or response sealed with an AEAD
+//	msgOTP:       a request or response sealed with a one-time pad (otp.go)
+//	msgTopUp:     a BB84 exchange adding one-time-pad material (otp.go)
+//	msgExhausted: the final node has no pad bits left for its response
+//	msgPadShort:  the final node holds a response longer than its pad (otp.go)
+//	msgFetch:     a held response is asked for after a top-up (otp.go)
+//
+// Once opened, the messages are
+//
+//	request:  method len (1) | method | target len (2) | target | headers | body
+//	response: status (2) | headers | body
+//
+// where target is the path and query of the request at the final node, and
+// headers is a count (2) followed by that many
+//
+//	name len (2) | name | value len (2) | value
+//
+// in order, repeated names included. The entry node seals the whole inner
+// request, so that nothing of it crosses the network in the clear, and the
+// final node rebuilds it. Hop-by-hop headers and the nodes' own control
+// headers are not carried (see forwardedHeader).
+//
+// AEAD messages are sealed end to end under keys derived from the final hop's
+// layer key, so the final node and the entry node detect any change in transit.
+const (
+	msgSealed byte = iota + 1
+	msgOTP
+	msgTopUp
+	msgExhausted
+	msgPadShort
+	msgFetch
+)
+
+const (
+	requestInfo  = "quaitor exit request"
+	responseInfo = "quaitor exit response"
+)
+
+// Cipher modes for circuit messages, chosen per request.
+const (
+	modeAEAD = "aead"
+	modeOTP  = "otp"
+)
+
+// errUnexpectedMessage is returned for circuit messages of an unknown type.
+var errUnexpectedMessage = errors.New("unexpected circuit message")
+
+// headerField is one HTTP header line.
+type headerField struct {
+	Name, Value string
+}
+
+// exitRequest is the inner HTTP request relayed to the final node.
+type exitRequest struct {
+	Method string
+	Target string
+	Header []headerField
+	Body   []byte
+}
+
+// exitResponse is the response relayed back from the final node.
+type exitResponse struct {
+	Status int
+	Header []headerField
+	Body   []byte
+}
+
+// errMessageField is returned for request or response fields too long for
+// their length prefixes.
+var errMessageField = errors.New("circuit message field too long")
+
+// hopByHopHeaders are the headers that describe a single connection and are
+// not relayed, along with those a relayed message recomputes.
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Host":                true,
+	"Content-Length":      true,
+}
+
+// forwardedHeader reports whether the header name (in canonical form) is
+// relayed over a circuit: hop-by-hop headers and the headers the nodes use to
+// control the circuit are not.
+func forwardedHeader(name string) bool {
+	if hopByHopHeaders[name] {
+		return false
+	}
+	for _, own := range []string{config.CipherModeHeader, config.HopFromHeader, config.CustomHeaderKey} {
+		if http.CanonicalHeaderKey(own) == name {
+			return false
+		}
+	}
+	return true
+}
+
+// appendHeaders appends the header block of a request or response message.
+func appendHeaders(msg []byte, header []headerField) ([]byte, error) {
+	if len(header) > 0xffff {
+		return nil, errMessageField
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(header)))
+	for _, h := range header {
+		if len(h.Name) > 0xffff || len(h.Value) > 0xffff {
+			return nil, errMessageField
+		}
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(h.Name)))
+		msg = append(msg, h.Name...)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(h.Value)))
+		msg = append(msg, h.Value...)
+	}
+	return msg, nil
+}
+
+// readHeaders parses a header block and returns the rest of the message.
+func readHeaders(msg []byte) ([]headerField, []byte, error) {
+	if len(msg) < 2 {
+		return nil, nil, errUnexpectedMessage
+	}
+	n := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	header := make([]headerField, 0, n)
+	for i := 0; i < n; i++ {
+		name, rest, err := readString16(msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		value, rest, err := readString16(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		header = append(header, headerField{Name: name, Value: value})
+		msg = rest
+	}
+	return header, msg, nil
+}
+
+// readString16 reads a string with a 2-byte length prefix.
+func readString16(b []byte) (string, []byte, error) {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return "", nil, errUnexpectedMessage
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// encodeExitRequest serializes r as a request message.
+func encodeExitRequest(r exitRequest) ([]byte, error) {
+	if len(r.Method) > 0xff || len(r.Target) > 0xffff {
+		return nil, errMessageField
+	}
+	msg := appendString(nil, r.Method)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(r.Target)))
+	msg = append(msg, r.Target...)
+	msg, err := appendHeaders(msg, r.Header)
+	if err != nil {
+		return nil, err
+	}
+	return append(msg, r.Body...), nil
+}
+
+// decodeExitRequest parses a request message.
+func decodeExitRequest(msg []byte) (exitRequest, error) {
+	method, rest, err := readString(msg)
+	if err != nil || method == "" {
+		return exitRequest{}, errUnexpectedMessage
+	}
+	target, rest, err := readString16(rest)
+	if err != nil {
+		return exitRequest{}, err
+	}
+	header, body, err := readHeaders(rest)
+	if err != nil {
+		return exitRequest{}, err
+	}
+	return exitRequest{Method: method, Target: target, Header: header, Body: body}, nil
+}
+
+// encodeExitResponse serializes r as a response message.
+func encodeExitResponse(r exitResponse) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, uint16(r.Status))
+	msg, err := appendHeaders(msg, r.Header)
+	if err != nil {
+		// Headers that cannot be relayed are dropped rather than the
+		// response.
+		msg, _ = appendHeaders(msg[:2], nil)
+	}
+	return append(msg, r.Body...)
+}
+
+// decodeExitResponse parses a response message.
+func decodeExitResponse(msg []byte) (exitResponse, error) {
+	if len(msg) < 2 {
+		return exitResponse{}, errors.New("short response message")
+	}
+	header, body, err := readHeaders(msg[2:])
+	if err != nil {
+		return exitResponse{}, errors.New("truncated response message")
+	}
+	return exitResponse{Status: int(binary.BigEndian.Uint16(msg)), Header: header, Body: body}, nil
+}
+
+// errorResponse is a plain-text response from the final node itself.
+func errorResponse(status int, text string) []byte {
+	return encodeExitResponse(exitResponse{
+		Status: status,
+		Header: []headerField{{Name: fiber.HeaderContentType, Value: fiber.MIMETextPlain}},
+		Body:   []byte(text),
+	})
+}
+
+// sealMessage seals a circuit message under key with the configured cipher.
+func sealMessage(key qkd.Key, info string, msg []byte) ([]byte, error) {
+	sealed, err := qkd.Seal(qkd.Cipher(config.AEADCipher), key, info, msg, nil)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{msgSealed}, sealed...), nil
+}
+
+// openMessage opens a message produced by sealMessage.
+func openMessage(key qkd.Key, info string, msg []byte) ([]byte, error) {
+	if len(msg) == 0 || msg[0] != msgSealed {
+		return nil, errUnexpectedMessage
+	}
+	return qkd.Open(key, info, msg[1:], nil)
+}
+
+// requestAEAD sends a request message through circ sealed with the AEAD and
+// returns the response message. A response that fails authentication is
+// reported as qkd.ErrAuthFailed.
+func requestAEAD(circ *circuit.Circuit, request []byte) ([]byte, error) {
+	exitKey, err := onion.EndToEndKey(circ.Hops[len(circ.Hops)-1].Key)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := sealMessage(exitKey, requestInfo, request)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := exchange(circ, msg)
+	if err != nil {
+		return nil, err
+	}
+	return openMessage(exitKey, responseInfo, reply)
+}
+
+// serveExitMessage runs on the final node: it opens a request message sealed
+// under the end-to-end key of the circuit, serves it and returns the response
+// message.
+func serveExitMessage(key qkd.Key, msg []byte) ([]byte, error) {
+	if len(msg) == 0 {
+		return nil, errUnexpectedMessage
+	}
+	switch msg[0] {
+	case msgSealed:
+		request, err := openMessage(key, requestInfo, msg)
+		if err != nil {
+			return nil, fmt.Errorf("exit request: %w", err)
+		}
+		return sealMessage(key, responseInfo, serveExitRequest(request))
+	case msgOTP:
+		return serveOTPRequest(msg)
+	case msgTopUp:
+		return answerTopUp(msg)
+	case msgFetch:
+		return serveOTPFetch(msg)
+	}
+	return nil, errUnexpectedMessage
+}
+
+// exitClient makes the final node's requests to its own handlers. Redirects
+// are relayed to the client rather than followed.
+var exitClient = &http.Client{
+	Timeout: 60 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// serveExitRequest runs on the final node: it rebuilds the request from the
+// request message, serves it against this node's own handlers, as a normal
+// (non-proxied) request, and returns the response message.
+func serveExitRequest(msg []byte) []byte {
+	currentPort := config.GetPort()
+	r, err := decodeExitRequest(msg)
+	if err != nil {
+		log.Printf("[Port %s] Malformed exit request: %v", currentPort, err)
+		return errorResponse(fiber.StatusBadRequest, "Malformed exit request")
+	}
+	if r.Target == "" || r.Target[0] != '/' {
+		r.Target = "/" + r.Target
+	}
+	log.Printf("[Port %s] This is the FINAL node. Serving %s %s locally.\n", currentPort, r.Method, r.Target)
+
+	req, err := http.NewRequest(r.Method, fmt.Sprintf("%s:%s%s", config.DefaultLink, currentPort, r.Target), bytes.NewReader(r.Body))
+	if err != nil {
+		log.Printf("[Port %s] Rebuilding exit request failed: %v", currentPort, err)
+		return errorResponse(fiber.StatusBadRequest, "Malformed exit request")
+	}
+	for _, h := range r.Header {
+		if forwardedHeader(http.CanonicalHeaderKey(h.Name)) {
+			req.Header.Add(h.Name, h.Value)
+		}
+	}
+
+	resp, err := exitClient.Do(req)
+	if err != nil {
+		log.Printf("[Port %s] Local request failed: %v", currentPort, err)
+		return errorResponse(fiber.StatusBadGateway, "Exit request failed")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errorResponse(fiber.StatusBadGateway, "Exit request failed")
+	}
+	names := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		if forwardedHeader(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var header []headerField
+	for _, name := range names {
+		for _, v := range resp.Header[name] {
+			header = append(header, headerField{Name: name, Value: v})
+		}
+	}
+	return encodeExitResponse(exitResponse{Status: resp.StatusCode, Header: header, Body: body})
+}
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"tor-protocol/circuit"
+	"tor-protocol/config"
+	"tor-protocol/onion"
+	"tor-protocol/protocol"
+	"tor-protocol/qkd"
+	"tor-protocol/query"
+)
+
+// testCircuit returns an entry node's circuit of n hops and the hops' own
+// copies of its layers.
+func testCircuit(t *testing.T, n int) (*circuit.Circuit, []*onion.Layer) {
+	t.Helper()
+	var circ *circuit.Circuit
+	var relays []*onion.Layer
+	for i := 0; i < n; i++ {
+		raw := make([]byte, 32)
+		rand.Read(raw)
+		key, err := qkd.UnpackKey(raw, 8*len(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := onion.NewLayer(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relay, _ := onion.NewLayer(key)
+		hop := onion.Hop{Addr: fmt.Sprint(8801 + i), CircID: 1, Key: key, Layer: entry}
+		if circ == nil {
+			circ = circuit.New(hop, config.CircuitLifetime)
+		} else {
+			circ.AddHop(hop)
+		}
+		relays = append(relays, relay)
+	}
+	return circ, relays
+}
+
+// sendThrough seals msg as the entry node does for the last hop of circ, and
+// has every hop remove its layer in turn. It returns the message the last hop
+// reassembles.
+func sendThrough(t *testing.T, circ *circuit.Circuit, relays []*onion.Layer, msg []byte) []byte {
+	t.Helper()
+	last := len(relays) - 1
+	var received []*protocol.RelayCell
+	for _, rc := range protocol.SplitMessage(msg) {
+		cell, err := circ.Seal(last, rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, l := range relays {
+			if !l.Open(&cell.Payload, onion.Forward) {
+				continue
+			}
+			if i != last {
+				t.Fatalf("hop %d recognized a cell for hop %d", i, last)
+			}
+			rc, err := protocol.DecodeRelayCell(&cell.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			received = append(received, rc)
+		}
+	}
+	joined, err := protocol.JoinMessage(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return joined
+}
+
+// FuzzQueryThroughCircuit checks that a query string reaches the final node
+// intact: the entry node encodes the query, seals the request end to end and
+// sends it through the onion layers of a circuit, and the final node opens
+// it and rebuilds the request.
+func FuzzQueryThroughCircuit(f *testing.F) {
+	f.Add("a=1&b=2", "data", "q+/x==")
+	f.Add("data=a%2Bb&data=c+d", "data", "a b&c=d")
+	f.Add("", "", "\x00\xff%")
+	f.Fuzz(func(t *testing.T, raw, key, value string) {
+		q, err := query.Parse(raw)
+		if err != nil {
+			return
+		}
+		q = append(q, query.Param{Key: key, Value: value})
+		request, err := encodeExitRequest(exitRequest{Method: http.MethodGet, Target: "/echo?" + q.Encode()})
+		if err != nil {
+			return
+		}
+
+		circ, relays := testCircuit(t, 3)
+		exitKey, err := onion.EndToEndKey(circ.Hops[2].Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := sealMessage(exitKey, requestInfo, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened, err := openMessage(exitKey, requestInfo, sendThrough(t, circ, relays, sealed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := decodeExitRequest(opened)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The final node rebuilds the request as serveExitRequest does.
+		req, err := http.NewRequest(r.Method, fmt.Sprintf("%s:%s%s", config.DefaultLink, "8803", r.Target), nil)
+		if err != nil {
+			t.Fatalf("rebuilding %q: %v", r.Target, err)
+		}
+		if req.URL.Path != "/echo" {
+			t.Fatalf("path %q, want /echo", req.URL.Path)
+		}
+		got, err := query.Parse(req.URL.RawQuery)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", req.URL.RawQuery, err)
+		}
+		if !reflect.DeepEqual(got, q) {
+			t.Fatalf("got %q, want %q", got, q)
+		}
+	})
+}
+
+func TestExitMessageTamperedInTransit(t *testing.T) {
+	circ, relays := testCircuit(t, 3)
+	exitKey, _ := onion.EndToEndKey(circ.Hops[2].Key)
+	request, _ := encodeExitRequest(exitRequest{Method: http.MethodPost, Target: "/pay?to=alice", Body: []byte("10")})
+	sealed, _ := sealMessage(exitKey, requestInfo, request)
+	sealed[len(sealed)-1] ^= 1
+	if _, err := openMessage(exitKey, requestInfo, sendThrough(t, circ, relays, sealed)); err == nil {
+		t.Fatal("tampered request opened")
+	}
+}
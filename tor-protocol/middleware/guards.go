@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"log"
+	"sync"
+
+	"tor-protocol/config"
+	"tor-protocol/routing"
+)
+
+var (
+	entryGuardsOnce sync.Once
+	entryGuardSet   *routing.GuardSet
+)
+
+// entryGuards returns this node's entry guards, kept in its own guards file,
+// or nil if config.GuardCount is 0.
+func entryGuards() *routing.GuardSet {
+	if config.GuardCount <= 0 {
+		return nil
+	}
+	entryGuardsOnce.Do(func() {
+		entryGuardSet = &routing.GuardSet{
+			Path:        nodeFile(config.GuardsFile),
+			Size:        config.GuardCount,
+			Lifetime:    config.GuardLifetime,
+			MaxFailures: config.GuardMaxFailures,
+			Retry:       config.GuardRetry,
+			Logf: func(format string, args ...any) {
+				log.Printf("[Port %s] "+format, append([]any{config.GetPort()}, args...)...)
+			},
+		}
+	})
+	return entryGuardSet
+}
+
+// chooseGuard picks a new entry guard out of candidates, weighted by
+// bandwidth for the guard position.
+func chooseGuard(candidates []string) (string, error) {
+	weights, _ := positionWeights()
+	s := routing.BandwidthWeighted{Bandwidth: nodeBandwidth, Flags: nodeFlags, Weights: weights}
+	return s.Choose(candidates, routing.PositionGuard)
+}
+
+// guardResult records the outcome of creating a circuit at its first hop,
+// which counts against the hop if it is an entry guard.
+func guardResult(first string, err error) {
+	guards := entryGuards()
+	if guards == nil {
+		return
+	}
+	if err != nil {
+		err = guards.Failed(first)
+	} else {
+		err = guards.Succeeded(first)
+	}
+	if err != nil {
+		log.Printf("[Port %s] Updating entry guard %s failed: %v", config.GetPort(), first, err)
+	}
+}
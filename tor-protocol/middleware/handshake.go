@@ -0,0 +1,250 @@
+package middleware
+
+import (
+	"crypto/mlkem"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"tor-protocol/config"
+	"tor-protocol/protocol"
+	"tor-protocol/qkd"
+)
+
+// qkdEngine simulates the BB84 exchanges run during circuit handshakes.
+var qkdEngine = qkd.NewEngine(nil)
+
+// errBadHandshake is returned for CREATE/CREATED payloads that cannot be parsed.
+var errBadHandshake = errors.New("malformed handshake")
+
+// A circuit handshake is a simulated BB84 exchange, combined in hybrid mode
+// with an ML-KEM-768 encapsulation, carried in CREATE and CREATED cells
+// (split over several when it does not fit in one, see
+// protocol.SplitHandshake):
+//
+//	CREATE:  mode (1) | n (2) | qubits | ML-KEM encapsulation key (hybrid only)
+//	CREATED: mode (1) | n (2) | Bob's bases, packed | ML-KEM ciphertext (hybrid only) | confirmation tag (32)
+//
+// where qubits, as built by sendQubits, is
+//
+//	link key ID (8) | Alice's bases, packed | Alice's qubit values, sealed
+//
+// The qubit values stand in for the quantum channel between the entry node
+// and the hop, so they are sealed under the link key the two share; the bases
+// are announced in the clear as in BB84. The key ID tells the hop which of its
+// link keys to use, without naming the entry node to the hops in between.
+//
+// Both sides derive the layer key with qkd.CombineKeys from the sifted key,
+// the ML-KEM shared secret and the transcript (CREATE, then CREATED up to the
+// tag), and the hop proves it derived the same with the confirmation tag.
+// The mode cannot be downgraded by the relays that carry the handshake: it
+// is authenticated with the sealed qubit values, along with the encapsulation
+// key, and bound into the layer key. A hop with config.RequireHybrid refuses
+// CREATEs in QKD mode, and the entry node refuses a CREATED in a different
+// mode from its CREATE.
+const qubitsInfo = "quaitor handshake qubits"
+
+// handshakeMode returns the mode of the handshakes this node starts.
+func handshakeMode() (qkd.HandshakeMode, error) {
+	return qkd.ParseHandshakeMode(config.HandshakeMode)
+}
+
+// newHandshake is Alice's side of a handshake with the node on port: it
+// prepares the CREATE payload and returns a function that derives the layer
+// key from the CREATED payload.
+func newHandshake(port string) ([]byte, func(created []byte) (qkd.Key, error), error) {
+	mode, err := handshakeMode()
+	if err != nil {
+		return nil, nil, err
+	}
+	var dk *mlkem.DecapsulationKey768
+	var ek []byte
+	if mode == qkd.ModeHybrid {
+		if dk, err = mlkem.GenerateKey768(); err != nil {
+			return nil, nil, err
+		}
+		ek = dk.EncapsulationKey().Bytes()
+	}
+
+	n := qkd.DefaultKeyLength
+	qubits, aliceBits, aliceBases, err := sendQubits(port, n, append([]byte{byte(mode)}, ek...))
+	if err != nil {
+		return nil, nil, err
+	}
+	create := binary.BigEndian.AppendUint16([]byte{byte(mode)}, uint16(n))
+	create = append(create, qubits...)
+	create = append(create, ek...)
+
+	finish := func(created []byte) (qkd.Key, error) {
+		if len(created) < 1 || qkd.HandshakeMode(created[0]) != mode {
+			return nil, fmt.Errorf("%w: %s CREATE answered in another mode", qkd.ErrDowngrade, mode)
+		}
+		_, ctSize := mode.KEMSizes()
+		packed := (n + 7) / 8
+		if len(created) != 3+packed+ctSize+qkd.ConfirmTagSize || int(binary.BigEndian.Uint16(created[1:])) != n {
+			return nil, fmt.Errorf("%w: unexpected CREATED payload", errBadHandshake)
+		}
+		bobBases, err := qkd.UnpackBases(created[3:3+packed], n)
+		if err != nil {
+			return nil, err
+		}
+		sifted, err := qkd.Sift(aliceBits, aliceBases, bobBases)
+		if err != nil {
+			return nil, err
+		}
+		var shared []byte
+		if mode == qkd.ModeHybrid {
+			if shared, err = dk.Decapsulate(created[3+packed : 3+packed+ctSize]); err != nil {
+				return nil, err
+			}
+		}
+
+		tagAt := len(created) - qkd.ConfirmTagSize
+		transcript := append(append([]byte{}, create...), created[:tagAt]...)
+		key, confirm, err := qkd.CombineKeys(mode, sifted, shared, transcript)
+		if err != nil {
+			return nil, err
+		}
+		if err := qkd.CheckConfirmTag(confirm, transcript, created[tagAt:]); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	return create, finish, nil
+}
+
+// answerHandshake is Bob's side: it measures the received qubits, sifts the
+// key, encapsulates to the ML-KEM key in hybrid mode and returns the CREATED
+// payload, the layer key and the mode.
+func answerHandshake(create []byte) ([]byte, qkd.Key, qkd.HandshakeMode, error) {
+	if len(create) < 3 {
+		return nil, nil, 0, errBadHandshake
+	}
+	mode := qkd.HandshakeMode(create[0])
+	if mode != qkd.ModeQKD && mode != qkd.ModeHybrid {
+		return nil, nil, mode, fmt.Errorf("%w %d", qkd.ErrUnknownMode, mode)
+	}
+	if mode != qkd.ModeHybrid && config.RequireHybrid {
+		return nil, nil, mode, fmt.Errorf("%w: %s CREATE, hybrid required", qkd.ErrDowngrade, mode)
+	}
+	n := int(binary.BigEndian.Uint16(create[1:]))
+	if n == 0 {
+		return nil, nil, mode, errBadHandshake
+	}
+	ekSize, _ := mode.KEMSizes()
+	size := qubitsSize(n)
+	if len(create) != 3+size+ekSize {
+		return nil, nil, mode, errBadHandshake
+	}
+	ek := create[3+size:]
+
+	sifted, bobBases, _, err := measureQubits(n, create[3:3+size], append([]byte{byte(mode)}, ek...))
+	if err != nil {
+		return nil, nil, mode, err
+	}
+	var shared, ct []byte
+	if mode == qkd.ModeHybrid {
+		encapsulationKey, err := mlkem.NewEncapsulationKey768(ek)
+		if err != nil {
+			return nil, nil, mode, err
+		}
+		shared, ct = encapsulationKey.Encapsulate()
+	}
+
+	created := binary.BigEndian.AppendUint16([]byte{byte(mode)}, uint16(n))
+	created = append(created, bobBases...)
+	created = append(created, ct...)
+	transcript := append(append([]byte{}, create...), created...)
+	key, confirm, err := qkd.CombineKeys(mode, sifted, shared, transcript)
+	if err != nil {
+		return nil, nil, mode, err
+	}
+	return append(created, qkd.ConfirmTag(confirm, transcript)...), key, mode, nil
+}
+
+// sendQubits prepares n qubits for a BB84 exchange with the node on port. It
+// returns them in wire form, along with Alice's bits and bases. ad is
+// authenticated along with the sealed values.
+func sendQubits(port string, n int, ad []byte) ([]byte, qkd.Key, []qkd.Basis, error) {
+	link, err := linkKey(port)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, bits, bases := qkdEngine.Prepare(n)
+	values, err := qkd.Seal(qkd.Cipher(config.AEADCipher), link, qubitsInfo, bits.Bytes(), ad)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	qubits := append([]byte{}, qkd.KeyID(link)...)
+	qubits = append(qubits, qkd.PackBases(bases)...)
+	return append(qubits, values...), bits, bases, nil
+}
+
+// measureQubits is Bob's side of sendQubits: it measures the n qubits in
+// random bases and returns the sifted key, Bob's packed bases and the peer
+// whose link key sealed the qubits.
+func measureQubits(n int, qubits, ad []byte) (qkd.Key, []byte, string, error) {
+	packed := (n + 7) / 8
+	if len(qubits) < qkd.KeyIDSize+packed {
+		return nil, nil, "", errBadHandshake
+	}
+	peer, link, err := linkKeys().Find(qubits[:qkd.KeyIDSize])
+	if err != nil {
+		return nil, nil, "", err
+	}
+	aliceBases, err := qkd.UnpackBases(qubits[qkd.KeyIDSize:qkd.KeyIDSize+packed], n)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	values, err := qkd.Open(link, qubitsInfo, qubits[qkd.KeyIDSize+packed:], ad)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	aliceBits, err := qkd.UnpackKey(values, n)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	qubitStates := make([]qkd.Qubit, n)
+	for i := range qubitStates {
+		qubitStates[i] = qkd.Qubit{Bit: aliceBits[i], Basis: aliceBases[i]}
+	}
+	bobBits, bobBases := qkdEngine.Receive(qubitStates)
+	key, err := qkd.Sift(bobBits, aliceBases, bobBases)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return key, qkd.PackBases(bobBases), peer, nil
+}
+
+// qubitsSize returns the size of n qubits in wire form.
+func qubitsSize(n int) int {
+	packed := (n + 7) / 8
+	return qkd.KeyIDSize + packed + qkd.SealOverhead + packed
+}
+
+// handshakeCells splits a handshake into cells of command cmd on circuit id.
+func handshakeCells(id protocol.CircID, cmd protocol.Command, data []byte) ([]*protocol.Cell, error) {
+	var cells []*protocol.Cell
+	for _, f := range protocol.SplitHandshake(data, protocol.CellPayloadSize) {
+		cell, err := protocol.NewCell(id, cmd, f)
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, cell)
+	}
+	return cells, nil
+}
+
+// joinHandshakeCells reassembles a handshake from cells of command cmd.
+func joinHandshakeCells(cells []*protocol.Cell, cmd protocol.Command) ([]byte, error) {
+	fragments := make([][]byte, len(cells))
+	for i, cell := range cells {
+		if cell.Command != cmd || cell.CircID != cells[0].CircID {
+			return nil, fmt.Errorf("%w: unexpected %s cell", errBadHandshake, cell.Command)
+		}
+		fragments[i] = cell.Payload[:]
+	}
+	return protocol.JoinHandshake(fragments)
+}
@@ -1,12 +1,34 @@
 package middleware
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"time"
+	"tor-protocol/config"
 	"tor-protocol/protocol"
+	"tor-protocol/replay"
 
 	"github.com/gofiber/fiber/v2"
 )
 
+var (
+	replayOnce  sync.Once
+	headerCache *replay.Cache
+)
+
+// replayCache returns the node's replay cache, created lazily so that the
+// replay settings have been loaded.
+func replayCache() *replay.Cache {
+	replayOnce.Do(func() {
+		headerCache = replay.NewCache(config.ReplayWindow, config.ReplayCacheSize)
+	})
+	return headerCache
+}
+
 // CustomHeaderMiddleware processes custom headers in incoming requests
 func CustomHeaderMiddleware() fiber.Handler {
 	//log current route with time stamp in format time stamp: route
@@ -14,18 +36,53 @@ func CustomHeaderMiddleware() fiber.Handler {
 
 	return func(c *fiber.Ctx) error {
 		log.Printf("Current route: %s", c.Route().Path)
-		header := c.Get("X-QUAITOR-Protocol")
+		c.Set(config.ProtocolVersionKey, strconv.Itoa(int(protocol.Version)))
+		header := c.Get(config.ProtocolHeaderKey)
 		if header == "" {
 			return c.Status(fiber.StatusBadRequest).SendString("Missing custom protocol header")
 		}
 
-		// Decode header
-		data := []byte(header)
-		customHeader, err := protocol.Deserialize(data)
+		current, err := keyStore().Current()
 		if err != nil {
+			log.Printf("Loading QKD key failed: %v", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("QKD key unavailable")
+		}
+
+		// Verify and decode header under the key of the epoch it names
+		customHeader, err := protocol.DecodeHeaderEpoch(header, func(epoch uint32) ([]byte, error) {
+			key, err := keyStore().EpochKey(epoch)
+			if err != nil {
+				return nil, err
+			}
+			return key.Bytes(), nil
+		})
+		if err != nil {
+			log.Printf("Rejected custom protocol header: %v", err)
+			if errors.Is(err, protocol.ErrHeaderAuth) {
+				return c.Status(fiber.StatusUnauthorized).SendString("Custom protocol header failed authentication")
+			}
+			if errors.Is(err, protocol.ErrHeaderEpoch) {
+				return c.Status(fiber.StatusUnauthorized).SendString(fmt.Sprintf("Custom protocol header key epoch is not accepted (current epoch %d)", current.ID))
+			}
 			return c.Status(fiber.StatusBadRequest).SendString("Invalid custom protocol header")
 		}
 
+		// Reject stale and replayed headers. This runs after authentication so
+		// that forged headers cannot fill the replay cache.
+		id := replay.ID{RouteID: customHeader.RouteID, Nonce: customHeader.Extensions.Nonce, Timestamp: customHeader.Timestamp}
+		if err := replayCache().Check(id, time.Now()); err != nil {
+			log.Printf("Rejected custom protocol header %+v: %v", id, err)
+			if errors.Is(err, replay.ErrReplayed) {
+				return c.Status(fiber.StatusConflict).SendString("Custom protocol header has already been used")
+			}
+			return c.Status(fiber.StatusUnauthorized).SendString("Custom protocol header is stale")
+		}
+		// Count what the epoch's key authenticated, the serialized header,
+		// once the header is accepted. The payload is sealed under link and
+		// circuit keys and does not count towards the epoch's limits.
+		sealed := base64.RawURLEncoding.DecodedLen(len(header)-len(protocol.HeaderMagic)) - protocol.HeaderTagSize
+		keyStore().Use(customHeader.Extensions.KeyEpoch, sealed)
+
 		// Add header to context for downstream handlers
 		c.Locals("customHeader", customHeader)
 
@@ -0,0 +1,417 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"tor-protocol/config"
+	"tor-protocol/etsi014"
+	"tor-protocol/qkd"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Each node runs a simulated KME serving the ETSI GS QKD 014 API (see package
+// etsi014) to itself as SAE, where nodes are known by their ports as SAE IDs.
+// When the node, as master SAE, gets keys for a slave, its KME generates them
+// and delivers them to the slave's KME right away, sealed under the link key
+// the two nodes share, as a real KME would over its own QKD link:
+//
+//	KMEDeliverPath request: master len (1) | master | link key ID (8) | keys, sealed
+//
+// where keys is a sequence of key ID len (1) | key ID | key len (2) | key.
+// The slave's KME holds them for config.KMEKeyTTL until the slave collects
+// them by ID, once.
+//
+// With config.LinkKeySource "etsi014", link keys are taken from a KME, this
+// one or a vendor's at config.KMEURL, instead of being exchanged:
+//
+//	LinkKMEPath request:  master len (1) | master | key ID len (1) | key ID
+//	LinkKMEPath response: link key ID (8)
+//
+// The master gets a key for the peer from its KME and names it to the peer,
+// which collects it from its own KME and answers with the key's ID so that
+// the master can check they hold the same key. Both messages are
+// authenticated like those of a link exchange (see linkTag), so a peer only
+// takes a key named by the master, and only replaces a link key when the
+// master holds it.
+//
+// The QKD 014 endpoints only serve this node's SAE (see kmeauth.go).
+const (
+	KMEStatusPath  = etsi014.BasePath + "/:sae/" + etsi014.StatusEndpoint
+	KMEEncKeysPath = etsi014.BasePath + "/:sae/" + etsi014.EncKeysEndpoint
+	KMEDecKeysPath = etsi014.BasePath + "/:sae/" + etsi014.DecKeysEndpoint
+	KMEDeliverPath = "/qkd/kme/deliver"
+	LinkKMEPath    = "/qkd/link/kme"
+)
+
+// kmeKeysInfo is the AEAD info of keys delivered between KMEs.
+const kmeKeysInfo = "quaitor kme keys"
+
+var (
+	// kmeLinkMu serializes the link keys this node takes from its KME.
+	kmeLinkMu sync.Mutex
+
+	kmeMu   sync.Mutex
+	kmeKeys = make(map[string]*kmeKey) // by key ID
+)
+
+// kmeKey is a key delivered by a master's KME, held until this node collects
+// it.
+type kmeKey struct {
+	master  string
+	key     []byte
+	created time.Time
+}
+
+// kmeID returns the ID of the KME serving the node on port.
+func kmeID(port string) string {
+	return "KME-" + port
+}
+
+// knownSAE reports whether id is the SAE ID of another node.
+func knownSAE(id string) bool {
+	port, err := strconv.Atoi(id)
+	return err == nil && port >= config.PortStart && port <= config.PortEnd && id != config.GetPort()
+}
+
+// kmeError sends an ETSI GS QKD 014 error response.
+func kmeError(c *fiber.Ctx, status int, message string, details ...map[string]any) error {
+	return c.Status(status).JSON(etsi014.Error{Message: message, Details: details})
+}
+
+// pruneKMEKeys drops the keys that were not collected in time. kmeMu must be
+// held.
+func pruneKMEKeys() {
+	for id, k := range kmeKeys {
+		if time.Since(k.created) > config.KMEKeyTTL {
+			delete(kmeKeys, id)
+		}
+	}
+}
+
+// KMEStatusHandler serves the status of the keys between this node and a
+// slave. stored_key_count is the number of keys the slave's KME has
+// delivered here and this node has not collected; keys for the slave are
+// generated on request.
+func KMEStatusHandler(c *fiber.Ctx) error {
+	if !checkSAE(c) {
+		return kmeError(c, fiber.StatusUnauthorized, "SAE authentication failed")
+	}
+	slave := utils.CopyString(c.Params("sae"))
+	if !knownSAE(slave) {
+		return kmeError(c, fiber.StatusBadRequest, "slave_SAE_ID is not known to this KME")
+	}
+	kmeMu.Lock()
+	pruneKMEKeys()
+	stored := 0
+	for _, k := range kmeKeys {
+		if k.master == slave {
+			stored++
+		}
+	}
+	kmeMu.Unlock()
+
+	port := config.GetPort()
+	return c.JSON(etsi014.Status{
+		SourceKMEID:      kmeID(port),
+		TargetKMEID:      kmeID(slave),
+		MasterSAEID:      port,
+		SlaveSAEID:       slave,
+		KeySize:          config.KMEKeySize,
+		StoredKeyCount:   stored,
+		MaxKeyCount:      config.KMEMaxKeyCount,
+		MaxKeyPerRequest: config.KMEMaxKeyPerRequest,
+		MaxKeySize:       config.KMEMaxKeySize,
+		MinKeySize:       config.KMEMinKeySize,
+		MaxSAEIDCount:    0,
+	})
+}
+
+// KMEEncKeysHandler serves Get key: it generates keys for the slave, delivers
+// them to the slave's KME and returns them.
+func KMEEncKeysHandler(c *fiber.Ctx) error {
+	if !checkSAE(c) {
+		return kmeError(c, fiber.StatusUnauthorized, "SAE authentication failed")
+	}
+	slave := utils.CopyString(c.Params("sae"))
+	if !knownSAE(slave) {
+		return kmeError(c, fiber.StatusBadRequest, "slave_SAE_ID is not known to this KME")
+	}
+	req := etsi014.KeyRequest{Number: 1, Size: config.KMEKeySize}
+	if c.Method() == fiber.MethodPost {
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return kmeError(c, fiber.StatusBadRequest, "malformed request body")
+		}
+	} else {
+		q, err := requestQuery(c)
+		if err != nil {
+			return kmeError(c, fiber.StatusBadRequest, "malformed query string")
+		}
+		for name, v := range map[string]*int{"number": &req.Number, "size": &req.Size} {
+			if value, ok := q.Get(name); ok {
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return kmeError(c, fiber.StatusBadRequest, fmt.Sprintf("%s is not an integer", name))
+				}
+				*v = n
+			}
+		}
+	}
+	if req.Number == 0 {
+		req.Number = 1
+	}
+	if req.Size == 0 {
+		req.Size = config.KMEKeySize
+	}
+	switch {
+	case req.Number < 0 || req.Number > config.KMEMaxKeyPerRequest:
+		return kmeError(c, fiber.StatusBadRequest, "requested parameters do not adhere to KME rules",
+			map[string]any{"number_unsupported": fmt.Sprintf("number must be between 1 and %d", config.KMEMaxKeyPerRequest)})
+	case req.Size%8 != 0 || req.Size < config.KMEMinKeySize || req.Size > config.KMEMaxKeySize:
+		return kmeError(c, fiber.StatusBadRequest, "requested parameters do not adhere to KME rules",
+			map[string]any{"size_not_supported": fmt.Sprintf("size must be a multiple of 8 between %d and %d", config.KMEMinKeySize, config.KMEMaxKeySize)})
+	case len(req.AdditionalSlaveSAEIDs) > 0:
+		return kmeError(c, fiber.StatusBadRequest, "requested parameters do not adhere to KME rules",
+			map[string]any{"additional_slave_SAE_IDs": "not supported"})
+	case len(req.ExtensionMandatory) > 0:
+		return kmeError(c, fiber.StatusBadRequest, "not all extension_mandatory parameters are supported",
+			map[string]any{"extension_mandatory_unsupported": req.ExtensionMandatory})
+	}
+
+	container := etsi014.KeyContainer{Keys: make([]etsi014.Key, req.Number)}
+	var keys []byte
+	for i := range container.Keys {
+		id, err := etsi014.NewKeyID()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, req.Size/8)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		container.Keys[i] = etsi014.Key{KeyID: id, Key: base64.StdEncoding.EncodeToString(key)}
+		keys = appendString(keys, id)
+		keys = binary.BigEndian.AppendUint16(keys, uint16(len(key)))
+		keys = append(keys, key...)
+	}
+	if err := deliverKMEKeys(slave, keys); err != nil {
+		log.Printf("[Port %s] Delivering keys to %s failed: %v", config.GetPort(), kmeID(slave), err)
+		return kmeError(c, fiber.StatusServiceUnavailable, "keys could not be delivered to the slave's KME")
+	}
+	return c.JSON(container)
+}
+
+// deliverKMEKeys sends keys to the slave's KME, sealed under the link key
+// this node shares with the slave. The link key is always an exchanged one,
+// so that a KME never depends on itself for keys.
+func deliverKMEKeys(slave string, keys []byte) error {
+	link, err := exchangedLinkKey(slave)
+	if err != nil {
+		return err
+	}
+	master := config.GetPort()
+	ad := appendString(appendString(nil, master), slave)
+	sealed, err := qkd.Seal(qkd.Cipher(config.AEADCipher), link, kmeKeysInfo, keys, ad)
+	if err != nil {
+		return err
+	}
+	body := appendString(nil, master)
+	body = append(body, qkd.KeyID(link)...)
+	_, err = postLink(slave, KMEDeliverPath, append(body, sealed...), nil)
+	return err
+}
+
+// KMEDeliverHandler stores the keys a master's KME delivers for this node.
+func KMEDeliverHandler(c *fiber.Ctx) error {
+	master, rest, err := readString(c.Body())
+	if err != nil || len(rest) < qkd.KeyIDSize {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed key delivery")
+	}
+	peer, link, err := linkKeys().Find(rest[:qkd.KeyIDSize])
+	if err != nil || peer != master {
+		return c.Status(fiber.StatusUnauthorized).SendString("Unknown link key")
+	}
+	ad := appendString(appendString(nil, master), config.GetPort())
+	keys, err := qkd.Open(link, kmeKeysInfo, rest[qkd.KeyIDSize:], ad)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).SendString("Key delivery failed authentication")
+	}
+
+	delivered := make(map[string]*kmeKey)
+	for len(keys) > 0 {
+		var id string
+		if id, keys, err = readString(keys); err != nil || len(keys) < 2 {
+			return c.Status(fiber.StatusBadRequest).SendString("Malformed key delivery")
+		}
+		n := int(binary.BigEndian.Uint16(keys))
+		if len(keys) < 2+n {
+			return c.Status(fiber.StatusBadRequest).SendString("Malformed key delivery")
+		}
+		delivered[id] = &kmeKey{master: master, key: keys[2 : 2+n], created: time.Now()}
+		keys = keys[2+n:]
+	}
+
+	kmeMu.Lock()
+	defer kmeMu.Unlock()
+	pruneKMEKeys()
+	if len(kmeKeys)+len(delivered) > config.KMEMaxKeyCount {
+		return c.Status(fiber.StatusServiceUnavailable).SendString("Key store full")
+	}
+	for id, k := range delivered {
+		if _, ok := kmeKeys[id]; ok {
+			return c.Status(fiber.StatusConflict).SendString("Duplicate key ID")
+		}
+		kmeKeys[id] = k
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// KMEDecKeysHandler serves Get key with key IDs: it hands over, once, the
+// keys the master got for this node.
+func KMEDecKeysHandler(c *fiber.Ctx) error {
+	if !checkSAE(c) {
+		return kmeError(c, fiber.StatusUnauthorized, "SAE authentication failed")
+	}
+	master := utils.CopyString(c.Params("sae"))
+	if !knownSAE(master) {
+		return kmeError(c, fiber.StatusBadRequest, "master_SAE_ID is not known to this KME")
+	}
+	var ids []string
+	if c.Method() == fiber.MethodPost {
+		var req etsi014.KeyIDs
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return kmeError(c, fiber.StatusBadRequest, "malformed request body")
+		}
+		for _, id := range req.KeyIDs {
+			ids = append(ids, id.KeyID)
+		}
+	} else {
+		q, err := requestQuery(c)
+		if err != nil {
+			return kmeError(c, fiber.StatusBadRequest, "malformed query string")
+		}
+		ids = q.All("key_ID")
+	}
+	if len(ids) == 0 || len(ids) > config.KMEMaxKeyPerRequest {
+		return kmeError(c, fiber.StatusBadRequest, "requested parameters do not adhere to KME rules",
+			map[string]any{"key_IDs": fmt.Sprintf("between 1 and %d key IDs are required", config.KMEMaxKeyPerRequest)})
+	}
+
+	kmeMu.Lock()
+	defer kmeMu.Unlock()
+	pruneKMEKeys()
+	container := etsi014.KeyContainer{Keys: make([]etsi014.Key, len(ids))}
+	for i, id := range ids {
+		k, ok := kmeKeys[id]
+		if !ok || k.master != master {
+			return kmeError(c, fiber.StatusBadRequest, "key not found",
+				map[string]any{"key_ID_not_found": id})
+		}
+		container.Keys[i] = etsi014.Key{KeyID: id, Key: base64.StdEncoding.EncodeToString(k.key)}
+	}
+	for _, id := range ids {
+		delete(kmeKeys, id)
+	}
+	return c.JSON(container)
+}
+
+// kmeClient returns a client for the KME this node takes link keys from. The
+// calls to its own KME are signed (see saeTransport).
+func kmeClient() *etsi014.Client {
+	if config.KMEURL != "" {
+		return etsi014.NewClient(config.KMEURL)
+	}
+	client := etsi014.NewClient(fmt.Sprintf("%s:%s", config.DefaultLink, config.GetPort()))
+	client.HTTP.Transport = saeTransport{}
+	return client
+}
+
+// kmeLinkKey takes a link key shared with peer from the KME and has the peer
+// collect it from its own.
+func kmeLinkKey(peer string) (qkd.Key, error) {
+	kmeLinkMu.Lock()
+	defer kmeLinkMu.Unlock()
+	// Another request may have taken a key in the meantime.
+	if key, err := linkKeys().Get(peer); !errors.Is(err, qkd.ErrNoLinkKey) {
+		return key, err
+	}
+
+	ids, keys, err := kmeClient().GetKey(context.Background(), peer, 1, config.KMEKeySize)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) != 1 {
+		return nil, fmt.Errorf("KME returned %d keys for %s", len(ids), peer)
+	}
+	key, err := qkd.UnpackKey(keys[ids[0]], 8*len(keys[ids[0]]))
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := linkAuthKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	body := appendString(nil, config.GetPort())
+	answer, err := postLink(peer, LinkKMEPath, appendString(body, ids[0]), auth)
+	if err != nil {
+		return nil, err
+	}
+	if string(answer) != string(qkd.KeyID(key)) {
+		return nil, errLinkKeyMismatch
+	}
+	if err := linkKeys().Put(peer, key); err != nil {
+		return nil, err
+	}
+	log.Printf("[Port %s] Took %d-bit link key with %s from %s (key ID %s)", config.GetPort(), len(key), peer, kmeClient().BaseURL, ids[0])
+	return key, nil
+}
+
+// LinkKMEHandler is the peer's side of kmeLinkKey: it collects the key the
+// master named from this node's KME and stores it as their link key.
+func LinkKMEHandler(c *fiber.Ctx) error {
+	master, rest, err := readString(c.Body())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed link key request")
+	}
+	id, _, err := readString(rest)
+	if err != nil || !knownSAE(master) {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed link key request")
+	}
+	auth, err := linkAuthKey(master)
+	if err != nil {
+		return err
+	}
+	if !checkLinkAuth(c, auth, master) {
+		log.Printf("[Port %s] Refused link key request from %s: %v", config.GetPort(), master, errLinkAuth)
+		return c.Status(fiber.StatusUnauthorized).SendString("Link key request failed authentication")
+	}
+	keys, err := kmeClient().GetKeyWithKeyIDs(context.Background(), master, id)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).SendString(err.Error())
+	}
+	raw, ok := keys[id]
+	if !ok {
+		return c.Status(fiber.StatusBadGateway).SendString("KME did not return the key")
+	}
+	key, err := qkd.UnpackKey(raw, 8*len(raw))
+	if err != nil {
+		return err
+	}
+	if err := linkKeys().Put(master, key); err != nil {
+		return err
+	}
+	log.Printf("[Port %s] Took %d-bit link key with %s from %s (key ID %s)", config.GetPort(), len(key), master, kmeClient().BaseURL, id)
+	return sendLinkAuth(c, auth, qkd.KeyID(key))
+}
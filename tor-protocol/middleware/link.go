@@ -0,0 +1,392 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"tor-protocol/circuit"
+	"tor-protocol/config"
+	"tor-protocol/onion"
+	"tor-protocol/protocol"
+	"tor-protocol/qkd"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CellPath is the node-to-node link endpoint. A request body is a sequence of
+// fixed-size cells for one circuit; the response body carries the cells sent
+// back along that circuit. Both are sealed under the link key of the two
+// nodes:
+//
+//	request:  link key ID (8) | sealed cells
+//	response: sealed cells
+const CellPath = "/cell"
+
+const (
+	linkRequestInfo  = "quaitor link cells"
+	linkResponseInfo = "quaitor link cells back"
+)
+
+var linkClient = &http.Client{Timeout: 60 * time.Second}
+
+// CellHandler receives cells from the previous hop on a link.
+func CellHandler(c *fiber.Ctx) error {
+	currentPort := config.GetPort()
+	from := c.Get(config.HopFromHeader)
+
+	body := c.Body()
+	if len(body) < qkd.KeyIDSize {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid cells")
+	}
+	peer, link, err := linkKeys().Find(body[:qkd.KeyIDSize])
+	if err != nil || peer != from {
+		log.Printf("[Port %s] No link key with %s for these cells: %v", currentPort, from, err)
+		return c.Status(fiber.StatusUnauthorized).SendString("Unknown link key")
+	}
+	plain, err := qkd.Open(link, linkRequestInfo, body[qkd.KeyIDSize:], nil)
+	if err != nil {
+		log.Printf("[Port %s] Cells from %s failed authentication", currentPort, from)
+		return c.Status(fiber.StatusUnauthorized).SendString("Cells failed authentication")
+	}
+
+	cells, err := protocol.ReadCells(bytes.NewReader(plain))
+	if err != nil {
+		log.Printf("[Port %s] Invalid cells from %s: %v", currentPort, from, err)
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid cells")
+	}
+
+	var route []string
+	if debugRoute := c.Get(config.CustomHeaderKey); config.DebugRoute && debugRoute != "" {
+		log.Printf("[Port %s] [debug] Route header: %q\n", currentPort, debugRoute)
+		route = strings.Split(debugRoute, ",")
+	}
+
+	out, err := handleCells(from, cells, route)
+	if err != nil {
+		log.Printf("[Port %s] Error handling cells from %s: %v", currentPort, from, err)
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	var buf bytes.Buffer
+	if err := protocol.WriteCells(&buf, out); err != nil {
+		return err
+	}
+	sealed, err := qkd.Seal(qkd.Cipher(config.AEADCipher), link, linkResponseInfo, buf.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	relayed.Add(len(body) + len(sealed))
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	return c.Send(sealed)
+}
+
+// handleCells dispatches the cells received from prev and returns the cells
+// to send back to it. Padding cells are dropped.
+func handleCells(prev string, cells []*protocol.Cell, route []string) ([]*protocol.Cell, error) {
+	var out, create, relay []*protocol.Cell
+	for _, cell := range cells {
+		switch cell.Command {
+		case protocol.CmdPadding:
+		case protocol.CmdCreate:
+			create = append(create, cell)
+		case protocol.CmdDestroy:
+			handleDestroy(prev, cell.CircID)
+		case protocol.CmdRelay:
+			relay = append(relay, cell)
+		default:
+			return nil, fmt.Errorf("unexpected %s cell", cell.Command)
+		}
+	}
+	if len(create) > 0 {
+		out = append(out, handleCreate(prev, create)...)
+	}
+	if len(relay) > 0 {
+		out = append(out, handleRelay(prev, relay, route)...)
+	}
+	return out, nil
+}
+
+// handleCreate answers the key handshake carried by CREATE cells and records
+// the new circuit hop. Failures are reported with a DESTROY cell.
+func handleCreate(prev string, cells []*protocol.Cell) []*protocol.Cell {
+	currentPort := config.GetPort()
+	id := cells[0].CircID
+
+	create, err := joinHandshakeCells(cells, protocol.CmdCreate)
+	var created []byte
+	var key qkd.Key
+	var mode qkd.HandshakeMode
+	if err == nil {
+		created, key, mode, err = answerHandshake(create)
+	}
+	if err == nil {
+		err = relayCircuits().Create(id, prev, key)
+	}
+	if err != nil {
+		log.Printf("[Port %s] CREATE %d from %s failed: %v", currentPort, id, prev, err)
+		return []*protocol.Cell{destroyCell(id)}
+	}
+	log.Printf("[Port %s] Negotiated %d-bit %s layer key for circuit %d from %s", currentPort, len(key), mode, id, prev)
+
+	resp, err := handshakeCells(id, protocol.CmdCreated, created)
+	if err != nil {
+		return []*protocol.Cell{destroyCell(id)}
+	}
+	return resp
+}
+
+// handleDestroy tears down a circuit and passes the DESTROY on.
+func handleDestroy(prev string, id protocol.CircID) {
+	entry, err := relayCircuits().Lookup(id)
+	if err != nil || entry.Prev != prev {
+		return
+	}
+	relayCircuits().Remove(id)
+	log.Printf("[Port %s] Circuit %d destroyed", config.GetPort(), id)
+	if !entry.Exit() {
+		if _, err := sendCells(entry.Next, []*protocol.Cell{destroyCell(entry.NextID)}, nil); err != nil {
+			log.Printf("[Port %s] Passing DESTROY to %s failed: %v", config.GetPort(), entry.Next, err)
+		}
+	}
+}
+
+// handleRelay removes this hop's layer from RELAY cells. Cells this hop
+// recognizes are handled here; the rest are passed to the next hop, and the
+// cells coming back get this hop's layer added.
+func handleRelay(prev string, cells []*protocol.Cell, route []string) []*protocol.Cell {
+	currentPort := config.GetPort()
+	id := cells[0].CircID
+
+	entry, err := relayCircuits().Lookup(id)
+	if err != nil || entry.Prev != prev {
+		log.Printf("[Port %s] RELAY on unknown circuit %d from %s", currentPort, id, prev)
+		return []*protocol.Cell{destroyCell(id)}
+	}
+
+	var local []*protocol.RelayCell
+	var forward []*protocol.Cell
+	for _, cell := range cells {
+		if cell.CircID != id {
+			log.Printf("[Port %s] Circuit %d: cell for circuit %d in the same batch", currentPort, id, cell.CircID)
+			relayCircuits().Remove(id)
+			return []*protocol.Cell{destroyCell(id)}
+		}
+		if entry.Layer.Open(&cell.Payload, onion.Forward) {
+			rc, err := protocol.DecodeRelayCell(&cell.Payload)
+			if err != nil {
+				log.Printf("[Port %s] Circuit %d: %v", currentPort, id, err)
+				relayCircuits().Remove(id)
+				return []*protocol.Cell{destroyCell(id)}
+			}
+			local = append(local, rc)
+			continue
+		}
+		forward = append(forward, &protocol.Cell{CircID: entry.NextID, Command: protocol.CmdRelay, Payload: cell.Payload})
+	}
+
+	var replies []*protocol.RelayCell
+	if len(local) > 0 {
+		replies, err = handleLocalRelay(id, entry, local)
+		if err != nil {
+			log.Printf("[Port %s] Circuit %d: %v", currentPort, id, err)
+			relayCircuits().Remove(id)
+			return []*protocol.Cell{destroyCell(id)}
+		}
+	}
+
+	var out []*protocol.Cell
+	for _, rc := range replies {
+		payload, err := rc.Encode()
+		if err != nil {
+			log.Printf("[Port %s] Circuit %d: %v", currentPort, id, err)
+			relayCircuits().Remove(id)
+			return []*protocol.Cell{destroyCell(id)}
+		}
+		out = append(out, &protocol.Cell{CircID: id, Command: protocol.CmdRelay, Payload: payload})
+	}
+	stamped := len(out)
+
+	if len(forward) > 0 {
+		if entry.Exit() {
+			log.Printf("[Port %s] Unrecognized cell at the end of circuit %d", currentPort, id)
+			relayCircuits().Remove(id)
+			return []*protocol.Cell{destroyCell(id)}
+		}
+		log.Printf("[Port %s] Circuit %d: %s => %s (%d cells)", currentPort, id, prev, entry.Next, len(forward))
+		simulateDelay()
+		back, err := sendCells(entry.Next, forward, popRoute(route, entry.Next))
+		if err != nil {
+			log.Printf("[Port %s] Forwarding to %s failed: %v", currentPort, entry.Next, err)
+			relayCircuits().Remove(id)
+			return []*protocol.Cell{destroyCell(id)}
+		}
+		for _, cell := range back {
+			if cell.Command == protocol.CmdDestroy {
+				relayCircuits().Remove(id)
+				return []*protocol.Cell{destroyCell(id)}
+			}
+			out = append(out, &protocol.Cell{CircID: id, Command: cell.Command, Payload: cell.Payload})
+		}
+	}
+
+	// Add this hop's layer to everything going back towards the entry node,
+	// stamping the replies from this hop.
+	for i, cell := range out {
+		if cell.Command == protocol.CmdRelay {
+			entry.Layer.Seal(&cell.Payload, onion.Backward, i < stamped)
+		}
+	}
+	return out
+}
+
+// handleLocalRelay executes the relay cells addressed to this hop and returns
+// the relay cells to send back.
+func handleLocalRelay(id protocol.CircID, entry circuit.Entry, cells []*protocol.RelayCell) ([]*protocol.RelayCell, error) {
+	switch cells[0].Command {
+	case protocol.RelayExtend:
+		fragments := make([][]byte, len(cells))
+		for i, rc := range cells {
+			if rc.Command != protocol.RelayExtend {
+				return nil, fmt.Errorf("unexpected relay %s in EXTEND", rc.Command)
+			}
+			fragments[i] = rc.Data
+		}
+		data, err := protocol.JoinHandshake(fragments)
+		if err != nil {
+			return nil, err
+		}
+		created, err := extendCircuit(id, data)
+		if err != nil {
+			return nil, err
+		}
+		var replies []*protocol.RelayCell
+		for _, f := range protocol.SplitHandshake(created, protocol.RelayDataSize) {
+			replies = append(replies, &protocol.RelayCell{Command: protocol.RelayExtended, Data: f})
+		}
+		return replies, nil
+	case protocol.RelayData, protocol.RelayEnd:
+		if !entry.Exit() {
+			return nil, fmt.Errorf("data addressed to a middle hop")
+		}
+		request, err := protocol.JoinMessage(cells)
+		if err != nil {
+			return nil, err
+		}
+		key, err := onion.EndToEndKey(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := serveExitMessage(key, request)
+		if err != nil {
+			return nil, err
+		}
+		return protocol.SplitMessage(reply), nil
+	}
+	return nil, fmt.Errorf("unexpected relay %s", cells[0].Command)
+}
+
+// extendCircuit handles an EXTEND: it creates a circuit on the link to the
+// requested next hop and returns that hop's CREATED payload.
+func extendCircuit(id protocol.CircID, data []byte) ([]byte, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, errBadHandshake
+	}
+	next := string(data[1 : 1+int(data[0])])
+	create := data[1+int(data[0]):]
+
+	nextID, err := circuit.NewID()
+	if err != nil {
+		return nil, err
+	}
+	cells, err := handshakeCells(nextID, protocol.CmdCreate, create)
+	if err != nil {
+		return nil, err
+	}
+	back, err := sendCells(next, cells, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(back) == 0 || back[0].Command != protocol.CmdCreated {
+		return nil, fmt.Errorf("extend to %s refused", next)
+	}
+	if err := relayCircuits().Extend(id, next, nextID); err != nil {
+		return nil, err
+	}
+	log.Printf("[Port %s] Circuit %d extended to %s", config.GetPort(), id, next)
+	return joinHandshakeCells(back, protocol.CmdCreated)
+}
+
+// sendCells posts cells to the node on port, sealed under the link key shared
+// with it, and returns the cells it sends back. In debug mode the remaining
+// route travels along in plaintext.
+func sendCells(port string, cells []*protocol.Cell, route []string) ([]*protocol.Cell, error) {
+	var body bytes.Buffer
+	if err := protocol.WriteCells(&body, cells); err != nil {
+		return nil, err
+	}
+	link, err := linkKey(port)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := qkd.Seal(qkd.Cipher(config.AEADCipher), link, linkRequestInfo, body.Bytes(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s:%s%s", config.DefaultLink, port, CellPath)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(append(qkd.KeyID(link), sealed...)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	req.Header.Set(config.HopFromHeader, config.GetPort())
+	if config.DebugRoute && len(route) > 0 {
+		req.Header.Set(config.CustomHeaderKey, strings.Join(route, ","))
+	}
+
+	sent := time.Now()
+	resp, err := linkClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("link to %s: %s", port, resp.Status)
+	}
+	back, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	recordLinkLatency(port, time.Since(sent))
+	plain, err := qkd.Open(link, linkResponseInfo, back, nil)
+	if err != nil {
+		return nil, fmt.Errorf("link to %s: %w", port, err)
+	}
+	return protocol.ReadCells(bytes.NewReader(plain))
+}
+
+// destroyCell returns a DESTROY cell for circuit id.
+func destroyCell(id protocol.CircID) *protocol.Cell {
+	return &protocol.Cell{CircID: id, Command: protocol.CmdDestroy}
+}
+
+// popRoute drops next from the front of a debug route.
+func popRoute(route []string, next string) []string {
+	if len(route) > 0 && route[0] == next {
+		return route[1:]
+	}
+	return route
+}
+
+// simulateDelay adds the random per-hop delay of the simulated network.
+func simulateDelay() {
+	randomDelay := time.Duration(rand.Intn(config.RandomDelayUpperLimit)) * time.Millisecond
+	log.Printf("[Port %s] Adding random delay: %s", config.GetPort(), randomDelay)
+	time.Sleep(randomDelay)
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"tor-protocol/config"
+	"tor-protocol/qkd"
+)
+
+// linkStatus is the outcome of the last link exchange with a peer.
+type linkStatus struct {
+	Report      qkd.Report `json:"report"`
+	Error       string     `json:"error,omitempty"`
+	Compromised bool       `json:"compromised"`
+	At          time.Time  `json:"at"`
+
+	err error
+}
+
+var (
+	linkHealthMu sync.Mutex
+	linkHealth   = make(map[string]*linkStatus)
+
+	linkLatencyMu sync.Mutex
+	linkLatency   = make(map[string]time.Duration) // smoothed, by peer
+)
+
+// recordLink records the outcome of a link exchange with peer. A link is
+// compromised if the exchange was aborted for its error rate, or the two ends
+// ended up with different keys.
+func recordLink(peer string, report qkd.Report, err error) {
+	linkHealthMu.Lock()
+	defer linkHealthMu.Unlock()
+	s := &linkStatus{
+		Report:      report,
+		Compromised: errors.Is(err, qkd.ErrEavesdropping) || errors.Is(err, errLinkKeyMismatch),
+		At:          time.Now(),
+		err:         err,
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	linkHealth[peer] = s
+}
+
+// linkCompromised returns the error of the last exchange with peer if it
+// found the link compromised less than config.LinkRetry ago.
+func linkCompromised(peer string) error {
+	linkHealthMu.Lock()
+	defer linkHealthMu.Unlock()
+	s, ok := linkHealth[peer]
+	if !ok || !s.Compromised || time.Since(s.At) > config.LinkRetry {
+		return nil
+	}
+	return s.err
+}
+
+// linkStatuses returns a copy of the outcome of the last exchange with each
+// peer.
+func linkStatuses() map[string]linkStatus {
+	linkHealthMu.Lock()
+	defer linkHealthMu.Unlock()
+	out := make(map[string]linkStatus, len(linkHealth))
+	for peer, s := range linkHealth {
+		out[peer] = *s
+	}
+	return out
+}
+
+// recordLinkLatency folds the round-trip time of cells sent to peer into the
+// link's smoothed latency, weighting the new sample 1/8 as TCP does.
+func recordLinkLatency(peer string, rtt time.Duration) {
+	linkLatencyMu.Lock()
+	defer linkLatencyMu.Unlock()
+	if l, ok := linkLatency[peer]; ok {
+		rtt = l + (rtt-l)/8
+	}
+	linkLatency[peer] = rtt
+}
+
+// linkLatencyOf returns the smoothed latency of the link to peer, if this
+// node has sent it cells.
+func linkLatencyOf(peer string) (time.Duration, bool) {
+	linkLatencyMu.Lock()
+	defer linkLatencyMu.Unlock()
+	l, ok := linkLatency[peer]
+	return l, ok
+}
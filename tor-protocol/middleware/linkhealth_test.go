@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"tor-protocol/config"
+	"tor-protocol/qkd"
+	"tor-protocol/routing"
+)
+
+// TestEveTakesLinkOutOfPaths runs a link exchange through a seeded
+// eavesdropper on every qubit from 8803, and checks that the QBER check
+// aborts it and that the link is then left out of paths until
+// config.LinkRetry has passed.
+func TestEveTakesLinkOutOfPaths(t *testing.T) {
+	rate, engine := config.EveRate, qkdEngine
+	t.Cleanup(func() {
+		config.EveRate, qkdEngine, eveRand = rate, engine, nil
+		linkHealthMu.Lock()
+		delete(linkHealth, "8803")
+		linkHealthMu.Unlock()
+	})
+	config.EveRate, eveRand = 1, qkd.SeededSource(1)
+	qkdEngine = qkd.NewEngine(qkd.SeededSource(2))
+
+	n := 4096
+	auth, ad := testLinkKey(t), []byte("8803 bb84")
+	payload, sift, err := prepareLink(qkd.ProtocolBB84, n, auth, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := qkd.Report{Protocol: qkd.ProtocolBB84, Qubits: n}
+	bob, answer, _, err := receiveLink(qkd.ProtocolBB84, "8803", n, payload, auth, ad, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Intercepted != n {
+		t.Fatalf("Eve intercepted %d of %d qubits", report.Intercepted, n)
+	}
+	alice, _, _, err := sift(answer, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample := qkd.ChooseSample(len(bob), qkd.SampleSize(len(bob), config.QBERSample), qkdEngine.Rand)
+	report.QBER, err = qkd.CheckQBER(alice.Pick(sample), bob.Pick(sample), config.QBERThreshold)
+	var qerr *qkd.QBERError
+	if !errors.As(err, &qerr) || report.QBER <= config.QBERThreshold {
+		t.Fatalf("QBER %.3f: got %v, want a *QBERError", report.QBER, err)
+	}
+
+	recordLink("8803", report, err)
+	if got := linkCompromised("8803"); !errors.Is(got, qkd.ErrEavesdropping) {
+		t.Fatalf("linkCompromised(8803) = %v, want the QBER error", got)
+	}
+	if got := linkCompromised("8802"); got != nil {
+		t.Fatalf("linkCompromised(8802) = %v", got)
+	}
+	c := pathConstraints()
+	if candidates := c.Candidates("8801", "8805"); slices.Contains(candidates, "8803") {
+		t.Fatalf("8803 still a candidate: %v", candidates)
+	}
+	var cerr *routing.ConstraintError
+	err = c.Check("8801", "8805", []routing.Hop{{Addr: "8803"}, {Addr: "8805"}})
+	if !errors.As(err, &cerr) || cerr.Rule != "exclude" {
+		t.Fatalf("path through 8803: got %v, want an exclude violation", err)
+	}
+
+	// A link is tried again after config.LinkRetry.
+	linkHealthMu.Lock()
+	linkHealth["8803"].At = time.Now().Add(-config.LinkRetry - time.Second)
+	linkHealthMu.Unlock()
+	if got := linkCompromised("8803"); got != nil {
+		t.Fatalf("linkCompromised(8803) = %v after config.LinkRetry", got)
+	}
+}
+
+// TestLinkMismatchCompromises checks that other failures of an exchange do
+// not take a link out of paths, unlike keys that disagree.
+func TestLinkMismatchCompromises(t *testing.T) {
+	t.Cleanup(func() {
+		linkHealthMu.Lock()
+		delete(linkHealth, "8804")
+		linkHealthMu.Unlock()
+	})
+	recordLink("8804", qkd.Report{}, errUnexpectedMessage)
+	if got := linkCompromised("8804"); got != nil {
+		t.Fatalf("a malformed exchange compromised the link: %v", got)
+	}
+	recordLink("8804", qkd.Report{}, errLinkKeyMismatch)
+	if got := linkCompromised("8804"); !errors.Is(got, errLinkKeyMismatch) {
+		t.Fatalf("linkCompromised(8804) = %v, want the mismatch", got)
+	}
+}
@@ -0,0 +1,612 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"tor-protocol/config"
+	"tor-protocol/qkd"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// LinkKeyPath, LinkParityPath and LinkConfirmPath are the node-to-node
+// endpoints on which two nodes run the BB84 or E91 exchange that gives them
+// their pairwise link key (see linkprotocol.go for the protocols' parts). The first request body stands in for the quantum
+// channel; an eavesdropper and noise on it are simulated by the receiving
+// node (see config.EveRate and config.ChannelNoise).
+//
+//	LinkKeyPath request:      initiator len (1) | initiator | protocol len (1) | protocol | n (4) | protocol's part
+//	LinkKeyPath response:     exchange ID len (1) | exchange ID | protocol's part |
+//	                          sample size (4) | sample positions (4 each) | receiver's sample bits, packed
+//	LinkParityPath request:   exchange ID len (1) | exchange ID | count (4) | count × (size (4) | positions (4 each))
+//	LinkParityPath response:  receiver's parities, packed
+//	LinkConfirmPath request:  exchange ID len (1) | exchange ID | initiator's sample bits, packed |
+//	                          protocol's part | Toeplitz seed, packed | key ID (8)
+//
+// The receiver picks a sample of the sifted bits to disclose. Both ends
+// compute the QBER of the sample and abort the exchange above
+// config.QBERThreshold; otherwise they drop the sample. The initiator then
+// corrects its key to the receiver's with Cascade, asking for the parities it
+// needs, and picks a Toeplitz seed to compress the key to qkd.SecureLength,
+// which both ends compute from the QBER and the parities disclosed. The seed
+// and key ID are left out if the initiator aborts. The receiver checks that
+// the keys have the same ID, and both store the key under the other's ID (its
+// port).
+//
+// Every message of an exchange is authenticated (see linkTag) under the link
+// key the two nodes already share or, for their first exchange, under the
+// network's QKD key. A node thus only replaces a link key in an exchange with
+// the holder of that key.
+const (
+	LinkKeyPath     = "/qkd/link"
+	LinkParityPath  = "/qkd/link/parity"
+	LinkConfirmPath = "/qkd/link/confirm"
+)
+
+// maxLinkQubits bounds the qubits accepted in one link exchange.
+const maxLinkQubits = 1 << 16
+
+// pendingExchangeTTL is how long a receiver waits for an exchange's confirm.
+const pendingExchangeTTL = time.Minute
+
+// linkAuthInfo is the HKDF info of the key that authenticates link exchanges.
+const linkAuthInfo = "quaitor link auth"
+
+var (
+	// errLinkKeyMismatch is returned when the two ends of a link exchange
+	// end up with different keys.
+	errLinkKeyMismatch = errors.New("link keys disagree")
+	// errLinkAborted is returned to the receiver of a link exchange the
+	// initiator gave up on.
+	errLinkAborted = errors.New("link exchange aborted by the initiator")
+	// errLinkAuth is returned when a message of a link exchange fails
+	// authentication.
+	errLinkAuth = errors.New("link exchange failed authentication")
+)
+
+var (
+	keystoreOnce sync.Once
+	linkKeystore *qkd.Keystore
+
+	// linkKeyMu serializes the link exchanges this node starts.
+	linkKeyMu sync.Mutex
+
+	pendingMu        sync.Mutex
+	pendingExchanges = make(map[string]*pendingExchange)
+)
+
+// pendingExchange is a receiver's state between the two requests of a link
+// exchange.
+type pendingExchange struct {
+	peer    string
+	auth    qkd.Key   // authenticates the exchange
+	key     qkd.Key   // sifted key, sample dropped
+	sample  qkd.Key   // receiver's sample bits
+	chsh    *chshTest // E91 only
+	report  qkd.Report
+	created time.Time
+}
+
+// linkKeys returns this node's keystore of link keys. It is created lazily so
+// that the keystore file setting has been loaded.
+func linkKeys() *qkd.Keystore {
+	keystoreOnce.Do(func() {
+		linkKeystore = qkd.NewKeystore(nodeFile(config.KeystoreFile))
+		linkKeystore.FileKey = keyFileKey
+	})
+	return linkKeystore
+}
+
+// LinkKeyHandler is the receiver's side of the first step of a link exchange.
+func LinkKeyHandler(c *fiber.Ctx) error {
+	peer, rest, err := readString(c.Body())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed link exchange")
+	}
+	protocol, rest, err := readString(rest)
+	if err != nil || len(rest) < 4 {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed link exchange")
+	}
+	n := int(binary.BigEndian.Uint32(rest))
+	if peer == "" || n == 0 || n > maxLinkQubits {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed link exchange")
+	}
+	auth, err := linkAuthKey(peer)
+	if err != nil {
+		return err
+	}
+	if !checkLinkAuth(c, auth, peer) {
+		log.Printf("[Port %s] Refused link exchange from %s: %v", config.GetPort(), peer, errLinkAuth)
+		return c.Status(fiber.StatusUnauthorized).SendString("Link exchange failed authentication")
+	}
+
+	// The quantum channel is sealed along with the fields before it.
+	channel := rest[4:]
+	ad := c.Body()[:len(c.Body())-len(channel)]
+	report := qkd.Report{Protocol: protocol, Qubits: n}
+	key, siftAnswer, chsh, err := receiveLink(protocol, peer, n, channel, auth, ad, &report)
+	if errors.Is(err, errUnexpectedMessage) {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed link exchange")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
+	report.Sifted = len(key)
+	sample := qkd.ChooseSample(len(key), qkd.SampleSize(len(key), config.QBERSample), qkdEngine.Rand)
+	report.Sampled = len(sample)
+
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(raw[:])
+	pendingMu.Lock()
+	for k, p := range pendingExchanges {
+		if time.Since(p.created) > pendingExchangeTTL {
+			delete(pendingExchanges, k)
+		}
+	}
+	pendingExchanges[id] = &pendingExchange{
+		peer:    peer,
+		auth:    auth,
+		key:     key.Discard(sample),
+		sample:  key.Pick(sample),
+		chsh:    chsh,
+		report:  report,
+		created: time.Now(),
+	}
+	pendingMu.Unlock()
+
+	answer := appendString(nil, id)
+	answer = append(answer, siftAnswer...)
+	answer = binary.BigEndian.AppendUint32(answer, uint32(len(sample)))
+	for _, pos := range sample {
+		answer = binary.BigEndian.AppendUint32(answer, uint32(pos))
+	}
+	answer = append(answer, key.Pick(sample).Bytes()...)
+	return sendLinkAuth(c, auth, answer)
+}
+
+// LinkParityHandler answers the initiator's Cascade parity queries during a
+// link exchange.
+func LinkParityHandler(c *fiber.Ctx) error {
+	id, rest, err := readString(c.Body())
+	if err != nil || len(rest) < 4 {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed parity query")
+	}
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	p, ok := pendingExchanges[id]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Unknown link exchange")
+	}
+	if !checkLinkAuth(c, p.auth, p.peer) {
+		return c.Status(fiber.StatusUnauthorized).SendString("Link exchange failed authentication")
+	}
+
+	// No query of Cascade's asks about a bit twice, so a query can name at
+	// most as many positions as there are bits.
+	count := int(binary.BigEndian.Uint32(rest))
+	rest = rest[4:]
+	if count > len(p.key) {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed parity query")
+	}
+	sets := make([][]int, count)
+	total := 0
+	for i := range sets {
+		if len(rest) < 4 {
+			return c.Status(fiber.StatusBadRequest).SendString("Malformed parity query")
+		}
+		size := int(binary.BigEndian.Uint32(rest))
+		total += size
+		if total > len(p.key) || len(rest) < 4+4*size {
+			return c.Status(fiber.StatusBadRequest).SendString("Malformed parity query")
+		}
+		sets[i] = make([]int, size)
+		for j := range sets[i] {
+			sets[i][j] = int(binary.BigEndian.Uint32(rest[4+4*j:]))
+		}
+		rest = rest[4+4*size:]
+	}
+	if len(rest) != 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed parity query")
+	}
+	parities, err := p.key.Parities(sets)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	p.report.Leaked += len(parities)
+	return sendLinkAuth(c, p.auth, qkd.Key(parities).Bytes())
+}
+
+// LinkConfirmHandler is the receiver's side of the last step of a link
+// exchange: it checks the QBER, compresses the key and checks its ID, and
+// stores it.
+func LinkConfirmHandler(c *fiber.Ctx) error {
+	currentPort := config.GetPort()
+
+	id, rest, err := readString(c.Body())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed link confirm")
+	}
+	pendingMu.Lock()
+	p, ok := pendingExchanges[id]
+	if ok && checkLinkAuth(c, p.auth, p.peer) {
+		delete(pendingExchanges, id)
+	} else if ok {
+		pendingMu.Unlock()
+		return c.Status(fiber.StatusUnauthorized).SendString("Link exchange failed authentication")
+	}
+	pendingMu.Unlock()
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Unknown link exchange")
+	}
+	packed := (len(p.sample) + 7) / 8
+	if len(rest) < packed {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed link confirm")
+	}
+	aliceSample, err := qkd.UnpackKey(rest[:packed], len(p.sample))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed link confirm")
+	}
+
+	rest = rest[packed:]
+	if p.chsh != nil {
+		tests := len(p.chsh.aliceSettings)
+		if len(rest) < (tests+7)/8 {
+			return c.Status(fiber.StatusBadRequest).SendString("Malformed link confirm")
+		}
+		aliceTests, err := qkd.UnpackKey(rest[:(tests+7)/8], tests)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Malformed link confirm")
+		}
+		err = p.chsh.check(aliceTests, &p.report)
+		if err != nil {
+			recordLink(p.peer, p.report, err)
+			log.Printf("[Port %s] Link exchange with %s aborted: %v", currentPort, p.peer, err)
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		rest = rest[(tests+7)/8:]
+	}
+
+	p.report.QBER, err = qkd.CheckQBER(aliceSample, p.sample, config.QBERThreshold)
+	var key qkd.Key
+	if err == nil {
+		key, err = amplifyLinkKey(p.key, rest, &p.report)
+	}
+	recordLink(p.peer, p.report, err)
+	if err != nil {
+		log.Printf("[Port %s] Link exchange with %s aborted: %v", currentPort, p.peer, err)
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	}
+	if err := linkKeys().Put(p.peer, key); err != nil {
+		return err
+	}
+	logLinkKey(p.peer, p.report)
+	return sendLinkAuth(c, p.auth, nil)
+}
+
+// amplifyLinkKey is the receiver's side of privacy amplification. rest holds
+// the initiator's Toeplitz seed and the ID of its key, or nothing if it
+// aborted.
+func amplifyLinkKey(key qkd.Key, rest []byte, report *qkd.Report) (qkd.Key, error) {
+	if len(rest) == 0 {
+		return nil, errLinkAborted
+	}
+	m := qkd.SecureLength(len(key), report.Leaked, report.QBER)
+	if m == 0 {
+		return nil, qkd.ErrNoSecureKey
+	}
+	seedLen := qkd.ToeplitzSeedLength(len(key), m)
+	if len(rest) != (seedLen+7)/8+qkd.KeyIDSize {
+		return nil, fmt.Errorf("link confirm: %w", errUnexpectedMessage)
+	}
+	seed, err := qkd.UnpackKey(rest[:len(rest)-qkd.KeyIDSize], seedLen)
+	if err != nil {
+		return nil, err
+	}
+	final, err := qkd.Amplify(key, seed, m)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(rest[len(rest)-qkd.KeyIDSize:], qkd.KeyID(final)) {
+		return nil, errLinkKeyMismatch
+	}
+	report.KeyLength = m
+	return final, nil
+}
+
+// linkKey returns the key this node shares with peer. If there is none, one
+// is exchanged with the peer or, with config.LinkKeySource "etsi014", taken
+// from a KME (see kme.go).
+func linkKey(peer string) (qkd.Key, error) {
+	if config.LinkKeySource == "etsi014" {
+		key, err := linkKeys().Get(peer)
+		if !errors.Is(err, qkd.ErrNoLinkKey) {
+			return key, err
+		}
+		return kmeLinkKey(peer)
+	}
+	return exchangedLinkKey(peer)
+}
+
+// exchangedLinkKey returns the key this node shares with peer, running a link
+// exchange with it first if there is none. A link whose last exchange was
+// aborted is not retried for config.LinkRetry.
+func exchangedLinkKey(peer string) (qkd.Key, error) {
+	key, err := linkKeys().Get(peer)
+	if !errors.Is(err, qkd.ErrNoLinkKey) {
+		return key, err
+	}
+
+	linkKeyMu.Lock()
+	defer linkKeyMu.Unlock()
+	// Another request may have run the exchange in the meantime.
+	if key, err := linkKeys().Get(peer); !errors.Is(err, qkd.ErrNoLinkKey) {
+		return key, err
+	}
+	if err := linkCompromised(peer); err != nil {
+		return nil, err
+	}
+	return exchangeLinkKey(peer)
+}
+
+// exchangeLinkKey runs a link exchange with peer and stores the key.
+func exchangeLinkKey(peer string) (qkd.Key, error) {
+	protocol := linkProtocol(peer)
+	n := config.LinkKeyQubits
+	if protocol == qkd.ProtocolE91 {
+		// E91 keeps about 2/9 of its pairs, against half of BB84's qubits.
+		n *= 2
+	}
+	auth, err := linkAuthKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	body := appendString(nil, config.GetPort())
+	body = appendString(body, protocol)
+	body = binary.BigEndian.AppendUint32(body, uint32(n))
+	payload, sift, err := prepareLink(protocol, n, auth, body)
+	if err != nil {
+		return nil, err
+	}
+	body = append(body, payload...)
+	answer, err := postLink(peer, LinkKeyPath, body, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	report := qkd.Report{Protocol: protocol, Qubits: n}
+	id, rest, err := readString(answer)
+	if err != nil {
+		return nil, fmt.Errorf("link exchange with %s: %w", peer, errUnexpectedMessage)
+	}
+	// A failed CHSH check is reported to the receiver in the confirm.
+	key, disclose, rest, chshErr := sift(rest, &report)
+	if chshErr != nil && key == nil {
+		return nil, fmt.Errorf("link exchange with %s: %w", peer, chshErr)
+	}
+	if len(rest) < 4 {
+		return nil, fmt.Errorf("link exchange with %s: %w", peer, errUnexpectedMessage)
+	}
+	size := int(binary.BigEndian.Uint32(rest))
+	rest = rest[4:]
+	if size > len(key) || len(rest) != 4*size+(size+7)/8 {
+		return nil, fmt.Errorf("link exchange with %s: %w", peer, errUnexpectedMessage)
+	}
+	sample := make([]int, size)
+	for i := range sample {
+		sample[i] = int(binary.BigEndian.Uint32(rest[4*i:]))
+		if sample[i] >= len(key) || (i > 0 && sample[i] <= sample[i-1]) {
+			return nil, fmt.Errorf("link exchange with %s: %w", peer, errUnexpectedMessage)
+		}
+	}
+	bobSample, err := qkd.UnpackKey(rest[4*size:], size)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Sifted, report.Sampled = len(key), size
+	aliceSample := key.Pick(sample)
+	var final, seed qkd.Key
+	err = chshErr
+	if err == nil {
+		report.QBER, err = qkd.CheckQBER(aliceSample, bobSample, config.QBERThreshold)
+	}
+	if err == nil {
+		final, seed, err = reconcileLinkKey(peer, id, auth, key.Discard(sample), &report)
+	}
+	// The receiver is told the outcome either way, so that it drops the
+	// exchange; on success it stores the key.
+	confirm := appendString(nil, id)
+	confirm = append(confirm, aliceSample.Bytes()...)
+	confirm = append(confirm, disclose.Bytes()...)
+	if err == nil {
+		confirm = append(confirm, seed.Bytes()...)
+		confirm = append(confirm, qkd.KeyID(final)...)
+	}
+	if _, cerr := postLink(peer, LinkConfirmPath, confirm, auth); err == nil && cerr != nil {
+		err = cerr
+	}
+	recordLink(peer, report, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := linkKeys().Put(peer, final); err != nil {
+		return nil, err
+	}
+	logLinkKey(peer, report)
+	return final, nil
+}
+
+// reconcileLinkKey corrects the initiator's key to the receiver's with
+// Cascade and compresses it, returning the final key and the Toeplitz seed.
+// The parity queries are authenticated under auth.
+func reconcileLinkKey(peer, id string, auth, key qkd.Key, report *qkd.Report) (qkd.Key, qkd.Key, error) {
+	ask := func(sets [][]int) ([]uint8, error) {
+		query := appendString(nil, id)
+		query = binary.BigEndian.AppendUint32(query, uint32(len(sets)))
+		for _, set := range sets {
+			query = binary.BigEndian.AppendUint32(query, uint32(len(set)))
+			for _, pos := range set {
+				query = binary.BigEndian.AppendUint32(query, uint32(pos))
+			}
+		}
+		answer, err := postLink(peer, LinkParityPath, query, auth)
+		if err != nil {
+			return nil, err
+		}
+		return qkd.UnpackKey(answer, len(sets))
+	}
+	key, leaked, corrected, err := qkd.NewCascade(qkdEngine.Rand).Reconcile(key, report.QBER, ask)
+	report.Leaked, report.Corrected = leaked, corrected
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := qkd.SecureLength(len(key), report.Leaked, report.QBER)
+	if m == 0 {
+		return nil, nil, qkd.ErrNoSecureKey
+	}
+	seed := make(qkd.Key, qkd.ToeplitzSeedLength(len(key), m))
+	for i := range seed {
+		seed[i] = qkdEngine.Rand.Bit()
+	}
+	final, err := qkd.Amplify(key, seed, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	report.KeyLength = m
+	return final, seed, nil
+}
+
+// logLinkKey logs a link key established with peer.
+func logLinkKey(peer string, report qkd.Report) {
+	chsh := ""
+	if report.Protocol == qkd.ProtocolE91 {
+		chsh = fmt.Sprintf(", CHSH %.2f", report.CHSH)
+	}
+	log.Printf("[Port %s] Established %d-bit %s link key with %s (QBER %.1f%%%s, %d bits corrected, %d parity bits leaked, %d sifted)",
+		config.GetPort(), report.KeyLength, report.Protocol, peer, 100*report.QBER, chsh, report.Corrected, report.Leaked, report.Sifted)
+}
+
+// linkAuthKey returns the key that authenticates the link exchanges with
+// peer: the newest link key shared with it or, while there is none, the
+// current QKD key of the network.
+func linkAuthKey(peer string) (qkd.Key, error) {
+	key, err := linkKeys().Get(peer)
+	if errors.Is(err, qkd.ErrNoLinkKey) {
+		return keyStore().Key()
+	}
+	return key, err
+}
+
+// linkTag is the tag of a message of a link exchange sent by from on path: an
+// HMAC under a key derived from key of the path, the sender, the tag of the
+// request the message answers ("" for a request) and the body.
+func linkTag(key qkd.Key, path, from, request string, body []byte) (string, error) {
+	k, err := qkd.DeriveKey(key, linkAuthInfo, 32)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, k)
+	for _, s := range []string{path, from, request} {
+		mac.Write(appendString(nil, s))
+	}
+	mac.Write(body)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// checkLinkAuth reports whether the request in c was sent by peer and
+// authenticated under key.
+func checkLinkAuth(c *fiber.Ctx, key qkd.Key, peer string) bool {
+	want, err := linkTag(key, c.Path(), peer, "", c.Body())
+	return err == nil && hmac.Equal([]byte(c.Get(config.LinkAuthHeader)), []byte(want))
+}
+
+// sendLinkAuth answers the request in c with body, authenticated under key.
+func sendLinkAuth(c *fiber.Ctx, key qkd.Key, body []byte) error {
+	tag, err := linkTag(key, c.Path(), config.GetPort(), c.Get(config.LinkAuthHeader), body)
+	if err != nil {
+		return err
+	}
+	c.Set(config.LinkAuthHeader, tag)
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	return c.Send(body)
+}
+
+// postLink posts body to path on the node on port and returns the response
+// body. With an auth key, the request is authenticated under it and the
+// response must be too.
+func postLink(port, path string, body []byte, auth qkd.Key) ([]byte, error) {
+	url := fmt.Sprintf("%s:%s%s", config.DefaultLink, port, path)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	var tag string
+	if auth != nil {
+		if tag, err = linkTag(auth, path, config.GetPort(), "", body); err != nil {
+			return nil, err
+		}
+		req.Header.Set(config.LinkAuthHeader, tag)
+	}
+	resp, err := linkClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("link exchange with %s: %s: %s", port, resp.Status, answer)
+	}
+	if auth != nil {
+		want, err := linkTag(auth, path, port, tag, answer)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal([]byte(resp.Header.Get(config.LinkAuthHeader)), []byte(want)) {
+			return nil, fmt.Errorf("link exchange with %s: %w", port, errLinkAuth)
+		}
+	}
+	return answer, nil
+}
+
+// eveRand is the randomness of the simulated eavesdroppers; nil selects
+// crypto/rand.
+var eveRand qkd.RandomSource
+
+// eveOn returns the simulated eavesdropper on the link from peer, if any.
+func eveOn(peer string) *qkd.Eve {
+	if config.EveRate <= 0 {
+		return nil
+	}
+	if len(config.EveLinks) > 0 {
+		tapped := false
+		for _, p := range config.EveLinks {
+			tapped = tapped || p == peer
+		}
+		if !tapped {
+			return nil
+		}
+	}
+	return qkd.NewEve(config.EveRate, eveRand)
+}
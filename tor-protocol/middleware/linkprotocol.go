@@ -0,0 +1,224 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+
+	"tor-protocol/config"
+	"tor-protocol/qkd"
+)
+
+// A link exchange runs BB84 or E91, chosen by the initiator per peer (see
+// config.LinkProtocols). The protocols differ only up to sifting; both leave
+// a sifted key that goes through the same sampling, reconciliation and
+// amplification, and into the same keystore. Their parts of the link
+// exchange messages are:
+//
+//	BB84 request:  bases, packed | sealed qubit values, packed
+//	BB84 response: receiver's bases, packed
+//	E91 request:   initiator's settings, one byte each | sealed spins of the receiver's particles, one byte each
+//	E91 response:  receiver's settings, one byte each | receiver's test outcomes, packed
+//	E91 confirm:   initiator's test outcomes, packed
+//
+// In E91 the initiator stands in for the source of entangled pairs, measuring
+// its half of each pair before sending the other. Both ends check the CHSH
+// value of the test pairs.
+//
+// What stands for the quantum states themselves is sealed (see qkd.Seal)
+// under a key derived from the key that authenticates the exchange, with the
+// initiator, protocol and n as associated data: on a real quantum channel an
+// observer could not read the states, only the bases announced in clear.
+
+// linkChannelInfo is the HKDF info of the key that seals the quantum channel
+// of link exchanges.
+const linkChannelInfo = "quaitor link channel"
+
+// e91Engine simulates the E91 exchanges run on links.
+var e91Engine = qkd.NewE91(nil)
+
+// chshTest holds what the receiver of an E91 exchange needs to check the
+// CHSH value once the initiator discloses its test outcomes.
+type chshTest struct {
+	aliceSettings []uint8
+	bobSettings   []uint8
+	bobOutcomes   qkd.Key
+}
+
+// check computes the CHSH value from the initiator's test outcomes and checks
+// it against config.CHSHThreshold.
+func (t *chshTest) check(aliceOutcomes qkd.Key, report *qkd.Report) error {
+	s, err := qkd.CHSH(t.aliceSettings, t.bobSettings, aliceOutcomes, t.bobOutcomes)
+	if err != nil {
+		return err
+	}
+	report.CHSH = s
+	return qkd.CheckCHSH(s, config.CHSHThreshold, len(t.aliceSettings))
+}
+
+// linkProtocol returns the protocol this node runs on its link to peer.
+func linkProtocol(peer string) string {
+	if p, ok := config.LinkProtocols[peer]; ok {
+		return p
+	}
+	return config.LinkProtocol
+}
+
+// linkSifter is the initiator's side of sifting: given the protocol's part of
+// the receiver's answer, it returns the sifted key, the outcomes to disclose
+// in the confirm (E91 test outcomes) and the rest of the answer. A CHSH
+// failure is returned with the key so that the confirm can still be sent.
+type linkSifter func(answer []byte, report *qkd.Report) (key, disclose qkd.Key, rest []byte, err error)
+
+// prepareLink is the initiator's side of the quantum channel: it prepares n
+// qubits or pairs for protocol, seals them under auth with ad, and returns
+// the protocol's part of the request along with the sifter for the answer.
+func prepareLink(protocol string, n int, auth qkd.Key, ad []byte) ([]byte, linkSifter, error) {
+	switch protocol {
+	case qkd.ProtocolBB84:
+		_, bits, bases := qkdEngine.Prepare(n)
+		values, err := qkd.Seal(qkd.Cipher(config.AEADCipher), auth, linkChannelInfo, bits.Bytes(), ad)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload := append(qkd.PackBases(bases), values...)
+		return payload, func(answer []byte, report *qkd.Report) (qkd.Key, qkd.Key, []byte, error) {
+			packed := (n + 7) / 8
+			if len(answer) < packed {
+				return nil, nil, nil, errUnexpectedMessage
+			}
+			bobBases, err := qkd.UnpackBases(answer[:packed], n)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			key, err := qkd.Sift(bits, bases, bobBases)
+			return key, nil, answer[packed:], err
+		}, nil
+
+	case qkd.ProtocolE91:
+		particles, settings, outcomes := e91Engine.Emit(n)
+		spins := make([]byte, n)
+		for i, p := range particles {
+			spins[i] = p.Spin
+		}
+		sealed, err := qkd.Seal(qkd.Cipher(config.AEADCipher), auth, linkChannelInfo, spins, ad)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload := append(append([]byte(nil), settings...), sealed...)
+		return payload, func(answer []byte, report *qkd.Report) (qkd.Key, qkd.Key, []byte, error) {
+			if len(answer) < n {
+				return nil, nil, nil, errUnexpectedMessage
+			}
+			bobSettings := answer[:n]
+			keys, tests, err := qkd.SiftE91(settings, bobSettings)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			packed := (len(tests) + 7) / 8
+			if len(answer) < n+packed {
+				return nil, nil, nil, errUnexpectedMessage
+			}
+			bobTests, err := qkd.UnpackKey(answer[n:n+packed], len(tests))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			t := &chshTest{
+				aliceSettings: qkd.PickSettings(settings, tests),
+				bobSettings:   qkd.PickSettings(bobSettings, tests),
+				bobOutcomes:   bobTests,
+			}
+			// The outcomes are disclosed even if the check fails, so that
+			// the receiver sees the failure too.
+			aliceTests := outcomes.Pick(tests)
+			err = t.check(aliceTests, report)
+			return qkd.E91Key(outcomes, keys, false), aliceTests, answer[n+packed:], err
+		}, nil
+	}
+	return nil, nil, fmt.Errorf("%w %q", qkd.ErrUnknownProtocol, protocol)
+}
+
+// receiveLink is the receiver's side of the quantum channel: it opens what
+// peer sealed under auth with ad, measures it, with any simulated
+// eavesdropper and noise on the way, and returns the sifted key, the
+// protocol's part of the answer and, for E91, the pending CHSH check.
+func receiveLink(protocol, peer string, n int, payload []byte, auth qkd.Key, ad []byte, report *qkd.Report) (qkd.Key, []byte, *chshTest, error) {
+	eve := eveOn(peer)
+	var noise *qkd.Noise
+	if config.ChannelNoise > 0 {
+		noise = qkd.NewNoise(config.ChannelNoise, nil)
+	}
+
+	switch protocol {
+	case qkd.ProtocolBB84:
+		packed := (n + 7) / 8
+		if len(payload) < packed {
+			return nil, nil, nil, errUnexpectedMessage
+		}
+		aliceBases, err := qkd.UnpackBases(payload[:packed], n)
+		if err != nil {
+			return nil, nil, nil, errUnexpectedMessage
+		}
+		values, err := qkd.Open(auth, linkChannelInfo, payload[packed:], ad)
+		if err != nil {
+			return nil, nil, nil, errUnexpectedMessage
+		}
+		aliceBits, err := qkd.UnpackKey(values, n)
+		if err != nil {
+			return nil, nil, nil, errUnexpectedMessage
+		}
+		qubits := make([]qkd.Qubit, n)
+		for i := range qubits {
+			qubits[i] = qkd.Qubit{Bit: aliceBits[i], Basis: aliceBases[i]}
+		}
+		if eve != nil {
+			qubits, report.Intercepted = eve.Intercept(qubits)
+			logEve(peer, report)
+		}
+		if noise != nil {
+			qubits, report.Noisy = noise.Apply(qubits)
+		}
+		bobBits, bobBases := qkdEngine.Receive(qubits)
+		key, err := qkd.Sift(bobBits, aliceBases, bobBases)
+		return key, qkd.PackBases(bobBases), nil, err
+
+	case qkd.ProtocolE91:
+		if len(payload) < n {
+			return nil, nil, nil, errUnexpectedMessage
+		}
+		aliceSettings := payload[:n]
+		spins, err := qkd.Open(auth, linkChannelInfo, payload[n:], ad)
+		if err != nil || len(spins) != n {
+			return nil, nil, nil, errUnexpectedMessage
+		}
+		particles := make([]qkd.Particle, n)
+		for i, spin := range spins {
+			particles[i] = qkd.Particle{Spin: spin & 7}
+		}
+		if eve != nil {
+			particles, report.Intercepted = eve.InterceptParticles(particles)
+			logEve(peer, report)
+		}
+		if noise != nil {
+			particles, report.Noisy = noise.ApplyParticles(particles)
+		}
+		bobSettings, bobOutcomes := e91Engine.Measure(particles)
+		keys, tests, err := qkd.SiftE91(aliceSettings, bobSettings)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		t := &chshTest{
+			aliceSettings: qkd.PickSettings(aliceSettings, tests),
+			bobSettings:   qkd.PickSettings(bobSettings, tests),
+			bobOutcomes:   bobOutcomes.Pick(tests),
+		}
+		answer := append(append([]byte(nil), bobSettings...), t.bobOutcomes.Bytes()...)
+		return qkd.E91Key(bobOutcomes, keys, true), answer, t, nil
+	}
+	return nil, nil, nil, fmt.Errorf("%w %q", qkd.ErrUnknownProtocol, protocol)
+}
+
+// logEve logs the simulated eavesdropper's interceptions on the link from
+// peer.
+func logEve(peer string, report *qkd.Report) {
+	log.Printf("[Port %s] [eve] Intercepted %d of %d from %s (%s)", config.GetPort(), report.Intercepted, report.Qubits, peer, report.Protocol)
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"tor-protocol/qkd"
+)
+
+// testLinkKey returns a random 256-bit key.
+func testLinkKey(t *testing.T) qkd.Key {
+	t.Helper()
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	key, err := qkd.UnpackKey(raw, 8*len(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// runLinkChannel runs the quantum channel of a link exchange for protocol
+// over n qubits or pairs, and returns both ends' sifted keys.
+func runLinkChannel(t *testing.T, protocol string, n int) (qkd.Key, qkd.Key) {
+	t.Helper()
+	auth, ad := testLinkKey(t), []byte("8801 "+protocol)
+	payload, sift, err := prepareLink(protocol, n, auth, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report qkd.Report
+	bobKey, answer, _, err := receiveLink(protocol, "8801", n, payload, auth, ad, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceKey, _, _, err := sift(answer, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aliceKey, bobKey
+}
+
+func TestLinkChannelSifts(t *testing.T) {
+	for _, protocol := range []string{qkd.ProtocolBB84, qkd.ProtocolE91} {
+		alice, bob := runLinkChannel(t, protocol, 2048)
+		if len(alice) == 0 || distance(alice, bob) != 0 {
+			t.Errorf("%s: sifted keys of %d and %d bits differ in %d", protocol, len(alice), len(bob), distance(alice, bob))
+		}
+	}
+}
+
+// TestLinkChannelSealed checks that the channel cannot be opened without the
+// key that authenticates the exchange, or moved to another exchange.
+func TestLinkChannelSealed(t *testing.T) {
+	for _, protocol := range []string{qkd.ProtocolBB84, qkd.ProtocolE91} {
+		auth, ad := testLinkKey(t), []byte("8801 "+protocol)
+		payload, _, err := prepareLink(protocol, 256, auth, ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report qkd.Report
+		if _, _, _, err := receiveLink(protocol, "8801", 256, payload, testLinkKey(t), ad, &report); !errors.Is(err, errUnexpectedMessage) {
+			t.Errorf("%s: opened under another key: %v", protocol, err)
+		}
+		if _, _, _, err := receiveLink(protocol, "8801", 256, payload, auth, []byte("8802 "+protocol), &report); !errors.Is(err, errUnexpectedMessage) {
+			t.Errorf("%s: opened for another exchange: %v", protocol, err)
+		}
+	}
+}
+
+// distance returns the number of bits in which a and b differ, counting
+// missing bits as different.
+func distance(a, b qkd.Key) int {
+	d := max(len(a), len(b)) - min(len(a), len(b))
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			d++
+		}
+	}
+	return d
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"tor-protocol/config"
+	"tor-protocol/routing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MetricsPath serves the node's counters as JSON.
+const MetricsPath = "/metrics"
+
+// MetricsHandler reports the node's counters.
+func MetricsHandler(c *fiber.Ctx) error {
+	linkKeyPeers, err := linkKeys().Peers()
+	if err != nil {
+		return err
+	}
+	var guards []routing.Guard
+	if g := entryGuards(); g != nil {
+		if guards, err = g.Guards(); err != nil {
+			return err
+		}
+	}
+	return c.JSON(fiber.Map{
+		"port":      config.GetPort(),
+		"circuits":  relayCircuits().Len(),
+		"replay":    replayCache().Stats(),
+		"link_keys": linkKeyPeers,
+		"links":     linkStatuses(),
+		"bandwidth": ownDescriptor(),
+		"guards":    guards,
+	})
+}
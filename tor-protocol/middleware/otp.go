@@ -0,0 +1,334 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"tor-protocol/circuit"
+	"tor-protocol/config"
+	"tor-protocol/qkd"
+)
+
+// In one-time-pad mode the entry node and the final node encrypt with key
+// bits from a pool they share, and never reuse a bit. The pool is filled by
+// BB84 exchanges run over the circuit (top-ups). The final node has no other
+// way to tell which pool to use, so OTP messages name the entry node:
+//
+//	request:  msgOTP | entry len (1) | entry | block ID len (1) | block ID | offset (4) | sealed
+//	response: msgOTP | block ID len (1) | block ID | offset (4) | sealed
+//	top-up:   msgTopUp | entry len (1) | entry | block ID len (1) | block ID | n (4) | qubits
+//	answer:   msgTopUp | Bob's bases
+//	short:    msgPadShort | response ID len (1) | response ID | bits needed (4)
+//	fetch:    msgFetch | entry len (1) | entry | response ID len (1) | response ID
+//
+// sealed is the output of qkd.SealOTP; everything before it is authenticated
+// with the message. The entry node keeps config.OTPResponseBits ready for a
+// response; when a response needs more, the final node holds it and answers
+// short, and the entry node tops up by the bits needed and fetches it, so the
+// request is not served twice. Only a top-up that cannot be run (see
+// ensurePad) or a pool still short after it ends in msgExhausted. A top-up's sifted key is split in two: the first half for
+// messages from the entry node, the second for messages back to it. The
+// qubits are sealed under the entry node's link key with the final node, as
+// in a circuit handshake (see sendQubits).
+
+// heldResponseTTL is how long the final node holds a response for a fetch.
+const heldResponseTTL = time.Minute
+
+var (
+	otpPoolOnce sync.Once
+	otpKeyPool  *qkd.Pool
+
+	heldMu        sync.Mutex
+	heldResponses = make(map[string]*heldResponse)
+)
+
+// heldResponse is a response the final node holds until the entry node has
+// the pad to receive it.
+type heldResponse struct {
+	entry    string
+	response []byte
+	created  time.Time
+}
+
+// otpPool returns this node's one-time-pad pool. It is created lazily so that
+// the pool file setting has been loaded.
+func otpPool() *qkd.Pool {
+	otpPoolOnce.Do(func() {
+		otpKeyPool = qkd.NewPool(nodeFile(config.OTPPoolFile))
+		otpKeyPool.FileKey = keyFileKey
+	})
+	return otpKeyPool
+}
+
+// nodeFile inserts this node's port into a file name, so that nodes started
+// from the same directory keep separate files: "otp_pool.json" becomes
+// "otp_pool_8801.json".
+func nodeFile(name string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "_" + config.GetPort() + ext
+}
+
+// requestOTP sends a request message through circ to finalPort sealed with a
+// one-time pad, topping up the pool first if it is short, and returns the
+// response message. It reports qkd.ErrKeyExhausted if either side runs out of
+// pad bits.
+func requestOTP(circ *circuit.Circuit, finalPort string, request []byte) ([]byte, error) {
+	need := qkd.OTPPadBits(len(request))
+	if err := ensurePad(circ, finalPort, need, config.OTPResponseBits); err != nil {
+		return nil, err
+	}
+	id, offset, pad, err := otpPool().Reserve(finalPort, need)
+	if err != nil {
+		return nil, err
+	}
+
+	head := appendString([]byte{msgOTP}, config.GetPort())
+	head = appendString(head, id)
+	head = binary.BigEndian.AppendUint32(head, uint32(offset))
+	sealed, err := qkd.SealOTP(pad, request, head)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := exchange(circ, append(head, sealed...))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reply) > 0 && reply[0] == msgPadShort {
+		if reply, err = fetchOTPResponse(circ, finalPort, reply); err != nil {
+			return nil, err
+		}
+	}
+	if len(reply) == 1 && reply[0] == msgExhausted {
+		return nil, fmt.Errorf("final node: %w", qkd.ErrKeyExhausted)
+	}
+	if len(reply) == 0 || reply[0] != msgOTP {
+		return nil, errUnexpectedMessage
+	}
+	id, rest, err := readString(reply[1:])
+	if err != nil || len(rest) < 4+qkd.OTPTagSize {
+		return nil, errUnexpectedMessage
+	}
+	head = reply[:len(reply)-len(rest)+4]
+	offset, sealed = int(binary.BigEndian.Uint32(rest)), rest[4:]
+	pad, err = otpPool().Take(finalPort, id, offset, qkd.OTPPadBits(len(sealed)-qkd.OTPTagSize))
+	if err != nil {
+		return nil, err
+	}
+	return qkd.OpenOTP(pad, sealed, head)
+}
+
+// serveOTPRequest is the final node's side of requestOTP.
+func serveOTPRequest(msg []byte) ([]byte, error) {
+	entry, rest, err := readString(msg[1:])
+	if err != nil {
+		return nil, err
+	}
+	id, rest, err := readString(rest)
+	if err != nil || len(rest) < 4+qkd.OTPTagSize {
+		return nil, errUnexpectedMessage
+	}
+	head := msg[:len(msg)-len(rest)+4]
+	offset, sealed := int(binary.BigEndian.Uint32(rest)), rest[4:]
+
+	pad, err := otpPool().Take(entry, id, offset, qkd.OTPPadBits(len(sealed)-qkd.OTPTagSize))
+	if err != nil {
+		return nil, fmt.Errorf("otp request from %s: %w", entry, err)
+	}
+	request, err := qkd.OpenOTP(pad, sealed, head)
+	if err != nil {
+		return nil, fmt.Errorf("otp request from %s: %w", entry, err)
+	}
+
+	response := serveExitRequest(request)
+	reply, err := sealOTPResponse(entry, response)
+	if !errors.Is(err, qkd.ErrKeyExhausted) {
+		return reply, err
+	}
+
+	// Hold the response until the entry node has topped up.
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return nil, err
+	}
+	held := hex.EncodeToString(raw[:])
+	heldMu.Lock()
+	for k, h := range heldResponses {
+		if time.Since(h.created) > heldResponseTTL {
+			delete(heldResponses, k)
+		}
+	}
+	heldResponses[held] = &heldResponse{entry: entry, response: response, created: time.Now()}
+	heldMu.Unlock()
+	short := appendString([]byte{msgPadShort}, held)
+	return binary.BigEndian.AppendUint32(short, uint32(qkd.OTPPadBits(len(response)))), nil
+}
+
+// fetchOTPResponse tops up the pool shared with finalPort by the bits a
+// short reply asks for, and fetches the response the final node holds.
+func fetchOTPResponse(circ *circuit.Circuit, finalPort string, short []byte) ([]byte, error) {
+	held, rest, err := readString(short[1:])
+	if err != nil || len(rest) != 4 {
+		return nil, errUnexpectedMessage
+	}
+	need := int(binary.BigEndian.Uint32(rest))
+	if err := ensurePad(circ, finalPort, 0, need); err != nil {
+		return nil, err
+	}
+	fetch := appendString([]byte{msgFetch}, config.GetPort())
+	return exchange(circ, appendString(fetch, held))
+}
+
+// serveOTPFetch is the final node's side of fetchOTPResponse.
+func serveOTPFetch(msg []byte) ([]byte, error) {
+	entry, rest, err := readString(msg[1:])
+	if err != nil {
+		return nil, err
+	}
+	held, rest, err := readString(rest)
+	if err != nil || len(rest) != 0 {
+		return nil, errUnexpectedMessage
+	}
+	heldMu.Lock()
+	h, ok := heldResponses[held]
+	if ok && h.entry == entry {
+		delete(heldResponses, held)
+	}
+	heldMu.Unlock()
+	if !ok || h.entry != entry || time.Since(h.created) > heldResponseTTL {
+		return nil, fmt.Errorf("otp fetch from %s: no response held as %s", entry, held)
+	}
+	reply, err := sealOTPResponse(entry, h.response)
+	if errors.Is(err, qkd.ErrKeyExhausted) {
+		log.Printf("[Port %s] No pad left for the response to %s: %v", config.GetPort(), entry, err)
+		return []byte{msgExhausted}, nil
+	}
+	return reply, err
+}
+
+// sealOTPResponse seals a response to entry with pad bits shared with it.
+func sealOTPResponse(entry string, response []byte) ([]byte, error) {
+	id, offset, pad, err := otpPool().Reserve(entry, qkd.OTPPadBits(len(response)))
+	if err != nil {
+		return nil, err
+	}
+	head := appendString([]byte{msgOTP}, id)
+	head = binary.BigEndian.AppendUint32(head, uint32(offset))
+	sealed, err := qkd.SealOTP(pad, response, head)
+	if err != nil {
+		return nil, err
+	}
+	return append(head, sealed...), nil
+}
+
+// ensurePad tops up the pool shared with peer unless it already holds out
+// bits to send with and in bits to receive with.
+func ensurePad(circ *circuit.Circuit, peer string, out, in int) error {
+	haveOut, haveIn, err := otpPool().Available(peer)
+	if err != nil {
+		return err
+	}
+	if haveOut >= out && haveIn >= in {
+		return nil
+	}
+
+	// About half of the qubits survive sifting and the key is split in two,
+	// so each direction gets about a quarter of them.
+	need := out
+	if in > need {
+		need = in
+	}
+	n := 4*need + 2*qkd.DefaultKeyLength
+	if n > config.OTPMaxQubits {
+		return fmt.Errorf("%w: a top-up of %d qubits exceeds the limit of %d", qkd.ErrKeyExhausted, n, config.OTPMaxQubits)
+	}
+	return topUp(circ, peer, n)
+}
+
+// topUp runs a BB84 exchange of n qubits with the final node of circ and adds
+// the sifted key to the pool shared with peer.
+func topUp(circ *circuit.Circuit, peer string, n int) error {
+	qubits, bits, aliceBases, err := sendQubits(peer, n, nil)
+	if err != nil {
+		return err
+	}
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(raw[:])
+
+	msg := appendString([]byte{msgTopUp}, config.GetPort())
+	msg = appendString(msg, id)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(n))
+	msg = append(msg, qubits...)
+	reply, err := exchange(circ, msg)
+	if err != nil {
+		return err
+	}
+	if len(reply) != 1+(n+7)/8 || reply[0] != msgTopUp {
+		return errUnexpectedMessage
+	}
+
+	bobBases, err := qkd.UnpackBases(reply[1:], n)
+	if err != nil {
+		return err
+	}
+	key, err := qkd.Sift(bits, aliceBases, bobBases)
+	if err != nil {
+		return err
+	}
+	half := len(key) / 2
+	log.Printf("[Port %s] Added %d one-time-pad bits each way with %s", config.GetPort(), half, peer)
+	return otpPool().Deposit(peer, id, key[:half], key[half:2*half])
+}
+
+// answerTopUp is the final node's side of topUp.
+func answerTopUp(msg []byte) ([]byte, error) {
+	entry, rest, err := readString(msg[1:])
+	if err != nil {
+		return nil, err
+	}
+	id, rest, err := readString(rest)
+	if err != nil || len(rest) < 4 {
+		return nil, errUnexpectedMessage
+	}
+	n := int(binary.BigEndian.Uint32(rest))
+	if n == 0 || n > config.OTPMaxQubits || len(rest) != 4+qubitsSize(n) {
+		return nil, errUnexpectedMessage
+	}
+
+	key, bobBases, peer, err := measureQubits(n, rest[4:], nil)
+	if err != nil {
+		return nil, err
+	}
+	if peer != entry {
+		return nil, fmt.Errorf("top-up for %s sealed under the link key of %s", entry, peer)
+	}
+	half := len(key) / 2
+	if err := otpPool().Deposit(entry, id, key[half:2*half], key[:half]); err != nil {
+		return nil, err
+	}
+	return append([]byte{msgTopUp}, bobBases...), nil
+}
+
+// appendString appends s with a one-byte length prefix.
+func appendString(b []byte, s string) []byte {
+	return append(append(b, byte(len(s))), s...)
+}
+
+// readString reads a string written by appendString and returns the rest.
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, errUnexpectedMessage
+	}
+	return string(b[1 : 1+int(b[0])]), b[1+int(b[0]):], nil
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tor-protocol/qkd"
+)
+
+// testPad returns n random pad bits.
+func testPad(t *testing.T, n int) qkd.Key {
+	t.Helper()
+	raw := make([]byte, (n+7)/8)
+	rand.Read(raw)
+	pad, err := qkd.UnpackKey(raw, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pad
+}
+
+// useTestPool makes a pool in a temporary directory this node's pool.
+func useTestPool(t *testing.T) {
+	otpPoolOnce.Do(func() {})
+	otpKeyPool = qkd.NewPool(filepath.Join(t.TempDir(), "otp_pool.json"))
+}
+
+// holdResponse holds response for entry as serveOTPRequest does when its pad
+// is short, and returns the fetch message the entry node would send for it.
+func holdResponse(entry string, response []byte) []byte {
+	heldMu.Lock()
+	heldResponses["held"] = &heldResponse{entry: entry, response: response, created: time.Now()}
+	heldMu.Unlock()
+	return appendString(appendString([]byte{msgFetch}, entry), "held")
+}
+
+// TestOTPFetchHeldResponse checks that a response held for want of pad is
+// sealed with the pad added since, only for the entry node it was held for,
+// and only once.
+func TestOTPFetchHeldResponse(t *testing.T) {
+	useTestPool(t)
+	response := make([]byte, 2048)
+	rand.Read(response)
+	out := testPad(t, qkd.OTPPadBits(len(response)))
+	if err := otpPool().Deposit("8801", "block", out, testPad(t, 64)); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := holdResponse("8801", response)
+	if _, err := serveOTPFetch(appendString(appendString([]byte{msgFetch}, "8802"), "held")); err == nil {
+		t.Fatal("another entry node fetched the response")
+	}
+	reply, err := serveOTPFetch(fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != msgOTP {
+		t.Fatalf("got message type %d, want msgOTP", reply[0])
+	}
+	_, rest, err := readString(reply[1:])
+	if err != nil || binary.BigEndian.Uint32(rest) != 0 {
+		t.Fatalf("malformed reply: %v", err)
+	}
+	opened, err := qkd.OpenOTP(out, rest[4:], reply[:len(reply)-len(rest)+4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened) != string(response) {
+		t.Fatal("fetched response differs")
+	}
+	if _, err := serveOTPFetch(fetch); err == nil {
+		t.Fatal("fetched the response twice")
+	}
+}
+
+// TestOTPFetchExhausted checks that a pool still short after the top-up ends
+// in msgExhausted.
+func TestOTPFetchExhausted(t *testing.T) {
+	useTestPool(t)
+	reply, err := serveOTPFetch(holdResponse("8809", make([]byte, 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 1 || reply[0] != msgExhausted {
+		t.Fatalf("got %v, want msgExhausted", reply)
+	}
+}
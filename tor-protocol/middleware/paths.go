@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"net/url"
+	"strconv"
+
+	"tor-protocol/config"
+	"tor-protocol/routing"
+)
+
+// pathSelectorName returns the name of the routing.PathSelector that picks
+// the hops of this node's circuits (see config.RouteSelection).
+func pathSelectorName() string {
+	if s, ok := config.RouteSelections[config.GetPort()]; ok {
+		return s
+	}
+	return config.RouteSelection
+}
+
+// CheckPathSelector reports whether the configured path selector exists and
+// the flags, position weights, guard settings and hop bounds are valid, so that a
+// misspelt one stops the node at startup rather than failing every circuit.
+func CheckPathSelector() error {
+	if _, err := positionWeights(); err != nil {
+		return err
+	}
+	if _, err := routing.ParseFlags(config.RelayFlags); err != nil {
+		return err
+	}
+	if config.GuardCount > 0 && (config.GuardLifetime <= 0 || config.GuardMaxFailures <= 0) {
+		return errors.New("guard_lifetime and guard_max_failures must be positive")
+	}
+	if config.PathMinHops < 1 || (config.PathMaxHops != 0 && config.PathMaxHops < config.PathMinHops) {
+		return fmt.Errorf("path_min_hops (%d) must be at least 1 and at most path_max_hops (%d)", config.PathMinHops, config.PathMaxHops)
+	}
+	_, err := routing.New(pathSelectorName(), pathSources())
+	return err
+}
+
+// pathSources are the data this node's path selectors draw on: the measured
+// latency of its links, the bandwidths and flags of the nodes, the delays
+// posted to TrafficPath and the configured fixed route.
+func pathSources() routing.Sources {
+	// CheckPathSelector has reported weights that do not parse.
+	weights, _ := positionWeights()
+	return routing.Sources{
+		Latency:   linkLatencyOf,
+		Bandwidth: nodeBandwidth,
+		Flags:     nodeFlags,
+		Weights:   weights,
+		Predicted: func() map[string]float64 {
+			return traffic.Delays(config.TrafficMaxAge)
+		},
+		Fixed: config.FixedRoute,
+	}
+}
+
+// pathConstraints are the bounds on every route (see config.PathMinHops):
+// its length, the declared families and operators of the nodes and, with
+// config.DistinctSubnets, their subnets. Routes are picked out of the nodes
+// in the port range whose link with this node has not been found
+// compromised.
+func pathConstraints() routing.Constraints {
+	var nodes []string
+	for p := config.PortStart; p <= config.PortEnd; p++ {
+		nodes = append(nodes, strconv.Itoa(p))
+	}
+	c := routing.Constraints{
+		Nodes:    nodes,
+		MinHops:  config.PathMinHops,
+		MaxHops:  config.PathMaxHops,
+		Exclude:  linkCompromised,
+		Family:   func(addr string) string { return config.NodeFamilies[addr] },
+		Operator: func(addr string) string { return config.NodeOperators[addr] },
+	}
+	if config.DistinctSubnets {
+		c.Subnet = nodeSubnet
+	}
+	return c
+}
+
+// nodeSubnet returns the /24 (/48 for IPv6) of the node on port, whose
+// address is set in config.NodeAddrs or else is the host of
+// config.DefaultLink.
+func nodeSubnet(port string) (string, error) {
+	host, ok := config.NodeAddrs[port]
+	if !ok {
+		u, err := url.Parse(config.DefaultLink)
+		if err != nil {
+			return "", err
+		}
+		host = u.Hostname()
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", fmt.Errorf("address %q of %s is not an IP address", host, port)
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "", err
+	}
+	return prefix.String(), nil
+}
+
+// buildRoute picks the route of a new circuit from this node to finalPort
+// with the configured path selector, starting at one of this node's entry
+// guards. A selector without the data it ranks hops by yet falls back to a
+// uniform route.
+func buildRoute(ctx context.Context, currentPort, finalPort string) ([]string, error) {
+	name := pathSelectorName()
+	selector, err := routing.New(name, pathSources())
+	if err != nil {
+		return nil, err
+	}
+	constraints := pathConstraints()
+	if guards := entryGuards(); guards != nil {
+		usable := func(guard string) error {
+			return constraints.Compatible(guard, []string{finalPort})
+		}
+		guard, err := guards.Pick(constraints.Candidates(currentPort, ""), usable, chooseGuard)
+		if err != nil {
+			return nil, fmt.Errorf("%w on a circuit to %s", err, finalPort)
+		}
+		constraints.Guard = guard
+	}
+	path, err := selector.SelectPath(ctx, currentPort, finalPort, constraints)
+	if errors.Is(err, routing.ErrNoData) {
+		log.Printf("[Port %s] %s path selection unavailable (%v), building a uniform route", currentPort, name, err)
+		path, err = routing.Uniform{}.SelectPath(ctx, currentPort, finalPort, constraints)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := constraints.Check(currentPort, finalPort, path); err != nil {
+		return nil, fmt.Errorf("%s path selection: %w", name, err)
+	}
+	return routing.Addrs(path), nil
+}
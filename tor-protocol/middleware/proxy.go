@@ -2,279 +2,134 @@
 package middleware
 
 import (
-	"fmt"
+	"errors"
 	"log"
-	"math/rand"
-	"strconv"
-	"strings"
-	"time"
+	"net/http"
 
 	"tor-protocol/config"
+	"tor-protocol/qkd"
+	"tor-protocol/query"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/proxy"
+	"github.com/gofiber/fiber/v2/utils"
 )
 
-// Define port range for knownPorts generation
-var (
-	portStart = config.PortStart
-	portEnd   = config.PortEnd
-)
-
-// getKnownPorts dynamically generates the list of known ports based on the range.
-
-// parseQueryParams converts a raw query string into a map of key/value pairs.
-
-// buildQueryString rebuilds a query string from a map.
+// requestQuery parses the query string of the request. Handlers read queries
+// through it rather than through fiber, so that repeated keys and their order
+// are kept and every value is decoded the same way on every node.
+func requestQuery(c *fiber.Ctx) (query.Query, error) {
+	return query.Parse(string(c.Request().URI().QueryString()))
+}
 
+// ProxyExactMiddleware handles `/:port.onion` requests without a trailing path.
 func ProxyExactMiddleware(c *fiber.Ctx) error {
-	currentPort := config.GetPort()
-	finalPort := c.Params("port")
-
-	existingRoute := c.Get(config.CustomHeaderKey)
-	var route []string
+	return ProxyMiddleware(c)
+}
 
-	if existingRoute == "" {
-		route = buildRandomRoute(currentPort, finalPort)
-		log.Printf("[Port %s] [ProxyExactMiddleware] Generated new route: %v\n", currentPort, route)
-	} else {
-		route = strings.Split(existingRoute, ",")
-		log.Printf("[Port %s] [ProxyExactMiddleware] Existing route: %v\n", currentPort, route)
-	}
+// ProxyMiddleware runs on the entry node. It reuses (or builds) a circuit to
+// the destination and sends the whole request (method, path and query,
+// headers and body) through it as fixed-size RELAY cells, encrypted in one
+// onion layer per hop. The final node rebuilds the request and serves it
+// locally, and its response comes back the same way. End to end, the request
+// and response are sealed with an AEAD or, in OTP mode, a one-time pad; the
+// mode is chosen per request with config.CipherModeHeader.
+func ProxyMiddleware(c *fiber.Ctx) error {
+	currentPort := config.GetPort()
+	// Fiber reuses the buffer behind c.Params once the handler returns, and
+	// the port ends up in the circuit table and keystore.
+	finalPort := utils.CopyString(c.Params("port"))
 
-	if len(route) == 0 {
-		route = []string{finalPort}
+	q, err := requestQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Malformed query string")
 	}
-
-	nextHop := route[0]
-	route = route[1:]
-	updatedRoute := strings.Join(route, ",")
-
-	// Build the base target
-	target := fmt.Sprintf("%s:%s", config.DefaultLink, nextHop)
-
-	// Append the query string if it exists
-	qs := c.Request().URI().QueryString()
-	if len(qs) > 0 {
-		target = target + "?" + string(qs)
+	target := "/" + c.Params("*")
+	if len(q) > 0 {
+		target += "?" + q.Encode()
 	}
 
-	log.Printf("[Port %s] Received request from: %s => next hop: %s => remaining route: %v\n",
-		currentPort, c.IP(), nextHop, route)
-
-	// Update the route header
-	c.Request().Header.Set(config.CustomHeaderKey, updatedRoute)
-
-	err := proxy.Forward(target)(c)
-	if err != nil {
-		log.Printf("[Port %s] Error forwarding to %s: %v", currentPort, target, err)
-		return err
+	mode := c.Get(config.CipherModeHeader, config.CipherMode)
+	if mode != modeAEAD && mode != modeOTP {
+		return c.Status(fiber.StatusBadRequest).SendString("Unknown cipher mode " + mode)
 	}
-	return nil
-
-	// return proxy.Forward(target)(c)
-}
-
-// buildRandomRoute constructs a random route (1–3 intermediate hops), excluding the currentPort
-// and excluding finalPort as an intermediate hop. The final hop is always finalPort.
-func buildRandomRoute(currentPort, finalPort string) []string {
-	fPort, _ := strconv.Atoi(finalPort)
-	cPort, _ := strconv.Atoi(currentPort)
-
-	// Generate the known ports list
-	allPorts := getKnownPorts()
 
-	// Filter out currentPort and finalPort from available ports
-	var available []int
-	for _, p := range allPorts {
-		if p != fPort && p != cPort {
-			available = append(available, p)
+	inner := exitRequest{Method: c.Method(), Target: target, Body: c.Body()}
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		if name := http.CanonicalHeaderKey(string(key)); forwardedHeader(name) {
+			inner.Header = append(inner.Header, headerField{Name: name, Value: string(value)})
 		}
-	}
-
-	// Shuffle the available ports
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(available), func(i, j int) {
-		available[i], available[j] = available[j], available[i]
 	})
-
-	// Pick random number of hops: 1–3
-	fmt.Printf("Available ports: %v\n", available)
-	fmt.Printf("Port start: %d, Port end: %d\n", portStart, portEnd)
-
-	genHops := portEnd - portStart
-	numHops := rand.Intn(genHops) + 1
-	if numHops > len(available) {
-		numHops = len(available)
-	}
-
-	// Select intermediate hops
-	intermediateHops := available[:numHops]
-
-	// Build the route array (all intermediate hops + final port)
-	route := make([]string, 0, numHops+1)
-	for _, hop := range intermediateHops {
-		route = append(route, fmt.Sprintf("%d", hop))
-	}
-	route = append(route, finalPort)
-
-	return route
-}
-
-// getKnownPorts dynamically generates the list of known ports based on the range.
-func getKnownPorts() []int {
-	var ports []int
-	for p := portStart; p <= portEnd; p++ {
-		ports = append(ports, p)
+	request, err := encodeExitRequest(inner)
+	if err != nil {
+		return c.Status(fiber.StatusRequestHeaderFieldsTooLarge).SendString("Request too large to relay")
 	}
-	return ports
-}
-
-func ProxyMiddleware(c *fiber.Ctx) error {
-    currentPort := config.GetPort()
-    finalPort := c.Params("port")
-    pathAfterOnion := c.Params("*")
-    existingRoute := c.Get(config.CustomHeaderKey)
-    var route []string
-
-    // Build or retrieve existing route
-    if existingRoute == "" {
-        // We are the *first node* in the chain
-        route = buildRandomRoute(currentPort, finalPort)
-        log.Printf("[Port %s] [ProxyMiddleware] Generated new route: %v\n", currentPort, route)
-    } else {
-        // We are an *intermediate* or *last* node
-        route = strings.Split(existingRoute, ",")
-        log.Printf("[Port %s] [ProxyMiddleware] Existing route: %v\n", currentPort, route)
-    }
-
-    // --------------------------------------------------------------------
-    // 1) If the route is empty *already*, we are truly last → decrypt + no forward
-    // --------------------------------------------------------------------
-    if len(route) == 0 {
-        // This node is *the final node* (no nextHop).
-        log.Printf("[Port %s] This is the FINAL node (route empty). Decrypting + local handling.\n", currentPort)
-
-        // Decrypt "msg" and "entry" if they exist
-        incomingQuery := c.Request().URI().QueryString()
-        queryParams := parseQueryParams(string(incomingQuery))
-
-        if val, ok := queryParams["msg"]; ok && val != "" {
-            decrypted, err := decryptMessage(val)
-            if err != nil {
-                log.Printf("[Port %s] Decryption error for 'msg': %v", currentPort, err)
-            } else {
-                queryParams["msg"] = decrypted
-            }
-        }
-        if val, ok := queryParams["entry"]; ok && val != "" {
-            decrypted, err := decryptMessage(val)
-            if err != nil {
-                log.Printf("[Port %s] Decryption error for 'entry': %v", currentPort, err)
-            } else {
-                queryParams["entry"] = decrypted
-            }
-        }
-
-        // Optionally, rewrite the Fiber query so downstream handlers see the decrypted text:
-        newQueryString := buildQueryString(queryParams)
-        c.Request().URI().SetQueryString(newQueryString)
-
-        // Return c.Next() so your local final handler (e.g. controllers.HomeHandler) can serve it:
-        return c.Next()
-    }
-
-    // --------------------------------------------------------------------
-    // 2) Otherwise, we are not last. We pop the next hop + check if we’re first node for encryption
-    // --------------------------------------------------------------------
-    nextHop := route[0]
-    remaining := route[1:] // route after popping nextHop
-    updatedRoute := strings.Join(remaining, ",")
-
-    // parse incoming query
-    incomingQuery := c.Request().URI().QueryString()
-    queryParams := parseQueryParams(string(incomingQuery))
-
-    // Are we the first node in the entire chain (existingRoute == "")?
-    isFirstNode := (existingRoute == "")
-
-    // If first node, ENCRYPT
-    if isFirstNode {
-        if val, ok := queryParams["msg"]; ok && val != "" {
-            encrypted, err := encryptMessage(val)
-            if err != nil {
-                log.Printf("[Port %s] Encryption error for 'msg': %v", currentPort, err)
-            } else {
-                queryParams["msg"] = encrypted
-            }
-        }
-        if val, ok := queryParams["entry"]; ok && val != "" {
-            encrypted, err := encryptMessage(val)
-            if err != nil {
-                log.Printf("[Port %s] Encryption error for 'entry': %v", currentPort, err)
-            } else {
-                queryParams["entry"] = encrypted
-            }
-        }
-    }
-
-    // Rebuild the query string after possible encryption
-    newQueryString := buildQueryString(queryParams)
-
-    // Build the target URL for nextHop
-    target := fmt.Sprintf("%s:%s/%s", config.DefaultLink, nextHop, pathAfterOnion)
-    if newQueryString != "" {
-        target += "?" + newQueryString
-    }
-
-    // Simulate a random delay
-    randomDelay := time.Duration(rand.Intn(config.RandomDelayUpperLimit)) * time.Millisecond
-    log.Printf("[Port %s] Adding random delay: %s", currentPort, randomDelay)
-    time.Sleep(randomDelay)
-
-    log.Printf("[Port %s] Received request from: %s => next hop: %s => remaining route: %v\n",
-        currentPort, c.IP(), nextHop, remaining)
-
-    // Update the X-Tor-Route header so next node sees the updated route
-    c.Request().Header.Set(config.CustomHeaderKey, updatedRoute)
-
-    // Forward the request
-    if err := proxy.Forward(target)(c); err != nil {
-        log.Printf("[Port %s] Error forwarding to %s: %v", currentPort, target, err)
-        return err
-    }
-    return nil
-}
 
+	// A hop that no longer knows the circuit answers with DESTROY, and a
+	// link exchange may find a link compromised; the request is then retried
+	// once on a new circuit.
+	for attempt := 1; ; attempt++ {
+		circ, err := entryCircuit(c.UserContext(), currentPort, finalPort)
+		if errors.Is(err, qkd.ErrEavesdropping) && attempt == 1 {
+			// The new route avoids the link now marked compromised.
+			log.Printf("[Port %s] Link compromised while building circuit to %s, rerouting: %v", currentPort, finalPort, err)
+			continue
+		}
+		if errors.Is(err, qkd.ErrEavesdropping) {
+			log.Printf("[Port %s] Building circuit to %s failed, link compromised: %v", currentPort, finalPort, err)
+			return c.Status(fiber.StatusBadGateway).SendString("Link compromised")
+		}
+		if err != nil {
+			log.Printf("[Port %s] Building circuit to %s failed: %v", currentPort, finalPort, err)
+			return c.Status(fiber.StatusBadGateway).SendString("Circuit construction failed")
+		}
+		if config.DebugRoute {
+			log.Printf("[Port %s] [debug] Circuit %d route: %v\n", currentPort, circ.ID(), circ.Route())
+		}
 
-// parseQueryParams converts a raw query string into a map of key/value pairs.
-func parseQueryParams(rawQuery string) map[string]string {
-	result := make(map[string]string)
-	if rawQuery == "" {
-		return result
-	}
-	pairs := strings.Split(rawQuery, "&")
-	for _, pair := range pairs {
-		parts := strings.SplitN(pair, "=", 2)
-		if len(parts) == 2 {
-			key := parts[0]
-			val := parts[1]
-			result[key] = val
+		log.Printf("[Port %s] Received request from: %s => circuit %d via %s\n",
+			currentPort, c.IP(), circ.ID(), circ.Hops[0].Addr)
+		var reply []byte
+		if mode == modeOTP {
+			reply, err = requestOTP(circ, finalPort, request)
 		} else {
-			// Handle keys with no value if needed
-			result[parts[0]] = ""
+			reply, err = requestAEAD(circ, request)
+		}
+		if errors.Is(err, errCircuitDestroyed) && attempt == 1 {
+			log.Printf("[Port %s] Circuit %d was destroyed, rebuilding", currentPort, circ.ID())
+			entryCircuits.Remove(finalPort, circ)
+			continue
+		}
+		if errors.Is(err, qkd.ErrAuthFailed) {
+			// The response was altered on the way back: never hand it on.
+			log.Printf("[Port %s] Response on circuit %d failed authentication, dropping the circuit", currentPort, circ.ID())
+			entryCircuits.Remove(finalPort, circ)
+			destroyCircuit(circ)
+			return c.Status(fiber.StatusBadGateway).SendString("Response failed authentication")
+		}
+		if errors.Is(err, qkd.ErrKeyExhausted) {
+			log.Printf("[Port %s] One-time pad with %s exhausted: %v", currentPort, finalPort, err)
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Key exhausted")
+		}
+		if err != nil {
+			log.Printf("[Port %s] Error on circuit %d: %v", currentPort, circ.ID(), err)
+			entryCircuits.Remove(finalPort, circ)
+			return c.Status(fiber.StatusBadGateway).SendString("Circuit error")
 		}
-	}
-	return result
-}
 
-// buildQueryString rebuilds a query string from a map.
-func buildQueryString(params map[string]string) string {
-	var parts []string
-	for k, v := range params {
-		// URL-encode them if needed
-		part := fmt.Sprintf("%s=%s", k, v)
-		parts = append(parts, part)
+		resp, err := decodeExitResponse(reply)
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).SendString("Invalid response")
+		}
+		// The relayed headers replace any this node set, such as its own
+		// security headers.
+		for _, h := range resp.Header {
+			c.Response().Header.Del(h.Name)
+		}
+		for _, h := range resp.Header {
+			if forwardedHeader(http.CanonicalHeaderKey(h.Name)) {
+				c.Response().Header.Add(h.Name, h.Value)
+			}
+		}
+		return c.Status(resp.Status).Send(resp.Body)
 	}
-	return strings.Join(parts, "&")
 }
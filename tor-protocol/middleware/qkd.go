@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"tor-protocol/config"
+	"tor-protocol/qkd"
+)
+
+var (
+	qkdStoreOnce sync.Once
+	qkdStore     *qkd.Store
+
+	// keyFileKey encrypts the node's key files at rest, if configured; see
+	// SetupKeyFiles.
+	keyFileKey *qkd.FileKey
+)
+
+// SetupKeyFiles derives the key that encrypts this node's key files from
+// config.KeystorePassphrase or config.KeystoreKey, and encrypts any of the
+// files still in plain JSON. It must run before the key stores are used.
+func SetupKeyFiles() error {
+	fk, err := qkd.NewFileKey(config.KeystorePassphrase, config.KeystoreKey)
+	if err != nil {
+		return err
+	}
+	if fk == nil {
+		log.Printf("[Port %s] Key files are stored unencrypted; set keystore_passphrase or keystore_key to encrypt them", config.GetPort())
+		return nil
+	}
+	keyFileKey = fk
+	for _, path := range []string{config.QKDKeyFile, nodeFile(config.KeystoreFile), nodeFile(config.OTPPoolFile)} {
+		migrated, err := qkd.MigrateKeyFile(path, fk)
+		if err != nil {
+			return err
+		}
+		if migrated {
+			log.Printf("[Port %s] Encrypted key file %s", config.GetPort(), path)
+		}
+	}
+	return nil
+}
+
+// keyStore returns the node's QKD key store. It is created lazily so that
+// config.LoadConfig has run before the key file path and rotation policy are
+// read.
+func keyStore() *qkd.Store {
+	qkdStoreOnce.Do(func() {
+		qkdStore = qkd.NewStore(config.QKDKeyFile)
+		qkdStore.FileKey = keyFileKey
+		qkdStore.Policy = qkd.RotationPolicy{
+			Lifetime:    config.KeyLifetime,
+			MaxBytes:    int64(config.KeyMaxBytes),
+			MaxMessages: int64(config.KeyMaxMessages),
+			Grace:       config.KeyGrace,
+		}
+	})
+	return qkdStore
+}
+
+// StartKeyRotation checks the QKD key against its rotation policy every
+// config.KeyRotationInterval, in the background, and rotates it into a new
+// epoch when a limit is reached. Nodes sharing the key file pick up the new
+// epoch on their next read of it.
+func StartKeyRotation() {
+	if config.KeyRotationInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(config.KeyRotationInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			epoch, reason, err := keyStore().RotateIfDue()
+			if err != nil {
+				log.Printf("[Port %s] QKD key rotation failed: %v", config.GetPort(), err)
+				continue
+			}
+			if reason != "" {
+				log.Printf("[Port %s] Rotated QKD key to epoch %d: %s", config.GetPort(), epoch.ID, reason)
+			}
+		}
+	}()
+}
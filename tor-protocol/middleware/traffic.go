@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"tor-protocol/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TrafficPath is where ai/main.py posts its per-node delay predictions, as a
+// JSON object from node (port) to predicted delay in seconds:
+//
+//	{"8801": 0.52, "8802": 1.17}
+//
+// Predictions steer which hops circuits take, so only a trusted client may
+// post them: one presenting config.TrafficToken as a bearer token or, if no
+// token is set, one on this node's host.
+const TrafficPath = "/traffic"
+
+// trafficSample is the latest delay predicted for a node.
+type trafficSample struct {
+	delay   float64
+	updated time.Time
+}
+
+// trafficStore holds the latest delay predictions, safe for concurrent use by
+// TrafficHandler and the circuits being built.
+type trafficStore struct {
+	mu      sync.RWMutex
+	samples map[string]trafficSample
+}
+
+var traffic = &trafficStore{samples: make(map[string]trafficSample)}
+
+// Update records delays, replacing the previous prediction for each node.
+func (s *trafficStore) Update(delays map[string]float64) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for node, delay := range delays {
+		s.samples[node] = trafficSample{delay: delay, updated: now}
+	}
+}
+
+// Delays returns the predictions made within maxAge (all of them if maxAge
+// is 0).
+func (s *trafficStore) Delays(maxAge time.Duration) map[string]float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	delays := make(map[string]float64, len(s.samples))
+	for node, sample := range s.samples {
+		if maxAge == 0 || time.Since(sample.updated) <= maxAge {
+			delays[node] = sample.delay
+		}
+	}
+	return delays
+}
+
+// TrafficHandler ingests delay predictions. A batch is taken whole or not at
+// all: every node must be in the port range and every delay a finite,
+// non-negative number.
+func TrafficHandler(c *fiber.Ctx) error {
+	if !trafficAllowed(c) {
+		log.Printf("[Port %s] Refused traffic data from %s", config.GetPort(), c.IP())
+		return c.Status(fiber.StatusForbidden).SendString("Not allowed to post traffic data")
+	}
+	var delays map[string]float64
+	if err := json.Unmarshal(c.Body(), &delays); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid data: expected a JSON object of node delays")
+	}
+	if len(delays) == 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid data: no node delays")
+	}
+	nodes := make([]string, 0, len(delays))
+	for node := range delays {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		if port, err := strconv.Atoi(node); err != nil || port < config.PortStart || port > config.PortEnd {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid data: unknown node %q", node))
+		}
+		if d := delays[node]; math.IsNaN(d) || math.IsInf(d, 0) || d < 0 {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid data: delay of node %s must be a non-negative number", node))
+		}
+	}
+
+	traffic.Update(delays)
+	log.Printf("[Port %s] Traffic data updated for %d nodes", config.GetPort(), len(delays))
+	return c.SendString("Traffic data updated")
+}
+
+// trafficAllowed reports whether the client of c may post predictions.
+func trafficAllowed(c *fiber.Ctx) bool {
+	if config.TrafficToken != "" {
+		want := "Bearer " + config.TrafficToken
+		return subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), []byte(want)) == 1
+	}
+	ip := net.ParseIP(c.IP())
+	return ip != nil && ip.IsLoopback()
+}
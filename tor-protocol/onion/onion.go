@@ -0,0 +1,143 @@
+// Package onion implements layered (onion) encryption of relay cells routed
+// through the tor-protocol network. Every hop on a circuit owns a distinct
+// key; the entry node adds one layer per hop and each relay removes exactly
+// one on the way out, and adds one on the way back.
+package onion
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"tor-protocol/protocol"
+	"tor-protocol/qkd"
+)
+
+// Hop is one hop of a circuit as seen by the entry node: its address (node
+// port), the circuit ID on the link into it (known only for the first hop),
+// the key negotiated with it and the onion layer derived from that key.
+type Hop struct {
+	Addr   string
+	CircID protocol.CircID
+	Key    qkd.Key
+	Layer  *Layer
+}
+
+// Direction is the way a cell travels along a circuit.
+type Direction int
+
+const (
+	Forward  Direction = iota // from the entry node towards the last hop
+	Backward                  // from a hop back to the entry node
+)
+
+// The negotiated key of a hop is never used directly: it is expanded with
+// HKDF into a cipher and a digest key per direction and, at the last hop, the
+// end-to-end key of the messages it serves.
+const (
+	forwardInfo   = "quaitor onion forward"
+	backwardInfo  = "quaitor onion backward"
+	endToEndInfo  = "quaitor end-to-end"
+	layerKeySize  = 32
+	digestKeySize = 32
+)
+
+// Layer is the onion layer shared by the entry node and one hop. Each
+// direction has its own AES-256-CTR key and digest key, and counts the cells
+// that went through it: cell n is encrypted with the keystream starting at IV
+// n, so no two cells share keystream. Both ends must therefore handle the
+// cells of a direction in the same order, which they do as long as an entry
+// node has at most one exchange in flight on a circuit (see circuit.Circuit).
+type Layer struct {
+	mu   sync.Mutex
+	dirs [2]layerState
+}
+
+type layerState struct {
+	block  cipher.Block
+	digest []byte // HMAC key
+	n      uint64 // cells so far
+}
+
+// NewLayer derives the onion layer of a hop from the key negotiated with it.
+func NewLayer(key qkd.Key) (*Layer, error) {
+	l := &Layer{}
+	for d, info := range [...]string{Forward: forwardInfo, Backward: backwardInfo} {
+		k, err := qkd.DeriveKey(key, info, layerKeySize+digestKeySize)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(k[:layerKeySize])
+		if err != nil {
+			return nil, err
+		}
+		l.dirs[d] = layerState{block: block, digest: k[layerKeySize:]}
+	}
+	return l, nil
+}
+
+// EndToEndKey derives from the key negotiated with the last hop of a circuit
+// the key that seals the messages exchanged with it, so that they stay
+// private from the hops in between whatever happens to the onion layers.
+func EndToEndKey(key qkd.Key) (qkd.Key, error) {
+	b, err := qkd.DeriveKey(key, endToEndInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	return qkd.UnpackKey(b, 8*len(b))
+}
+
+// Seal adds the layer to a cell payload travelling in direction d. If stamp
+// is set the payload is a plaintext relay payload addressed to (forward) or
+// sent from (backward) this hop, and is stamped with its digest first.
+func (l *Layer) Seal(p *[protocol.CellPayloadSize]byte, d Direction, stamp bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := &l.dirs[d]
+	if stamp {
+		copy(protocol.RelayDigest(p), s.sum(p, s.n))
+	}
+	s.crypt(p)
+}
+
+// Open removes the layer from a cell payload travelling in direction d, and
+// reports whether the result is a relay payload stamped at the other end of
+// the layer.
+func (l *Layer) Open(p *[protocol.CellPayloadSize]byte, d Direction) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := &l.dirs[d]
+	n := s.crypt(p)
+	if protocol.RelayRecognized(p) != 0 {
+		return false
+	}
+	return hmac.Equal(protocol.RelayDigest(p), s.sum(p, n))
+}
+
+// crypt XORs p with the keystream of the next cell, and returns the cell's
+// number.
+func (s *layerState) crypt(p *[protocol.CellPayloadSize]byte) uint64 {
+	n := s.n
+	s.n++
+	var iv [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(iv[:8], n)
+	cipher.NewCTR(s.block, iv[:]).XORKeyStream(p[:], p[:])
+	return n
+}
+
+// sum is the digest of cell n: an HMAC of its number and its payload with the
+// digest field zeroed.
+func (s *layerState) sum(p *[protocol.CellPayloadSize]byte, n uint64) []byte {
+	tmp := *p
+	d := protocol.RelayDigest(&tmp)
+	for i := range d {
+		d[i] = 0
+	}
+	h := hmac.New(sha256.New, s.digest)
+	h.Write(binary.BigEndian.AppendUint64(nil, n))
+	h.Write(tmp[:])
+	return h.Sum(nil)[:len(d)]
+}
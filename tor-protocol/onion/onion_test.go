@@ -0,0 +1,122 @@
+package onion
+
+import (
+	"bytes"
+	"testing"
+
+	"tor-protocol/protocol"
+	"tor-protocol/qkd"
+)
+
+func testKey(t *testing.T, seed byte) qkd.Key {
+	t.Helper()
+	b := bytes.Repeat([]byte{seed}, 32)
+	k, err := qkd.UnpackKey(b, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// hops returns the entry node's and the relays' copies of the layers of a
+// circuit of n hops.
+func hops(t *testing.T, n int) (entry, relays []*Layer) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		for _, side := range []*[]*Layer{&entry, &relays} {
+			l, err := NewLayer(testKey(t, byte(i+1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			*side = append(*side, l)
+		}
+	}
+	return entry, relays
+}
+
+func TestForwardAndBackward(t *testing.T) {
+	entry, relays := hops(t, 3)
+	for round := 0; round < 3; round++ {
+		for target := range entry {
+			rc := &protocol.RelayCell{Command: protocol.RelayData, Data: []byte("hello")}
+			p, err := rc.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := target; i >= 0; i-- {
+				entry[i].Seal(&p, Forward, i == target)
+			}
+			for i := 0; i <= target; i++ {
+				if got := relays[i].Open(&p, Forward); got != (i == target) {
+					t.Fatalf("round %d: hop %d recognized a cell for hop %d: %v", round, i, target, got)
+				}
+			}
+			got, err := protocol.DecodeRelayCell(&p)
+			if err != nil || string(got.Data) != "hello" {
+				t.Fatalf("hop %d decoded %v, %v", target, got, err)
+			}
+
+			// The reply goes back from the target, gaining a layer per hop.
+			p, _ = (&protocol.RelayCell{Command: protocol.RelayEnd}).Encode()
+			for i := target; i >= 0; i-- {
+				relays[i].Seal(&p, Backward, i == target)
+			}
+			for i := 0; i <= target; i++ {
+				if got := entry[i].Open(&p, Backward); got != (i == target) {
+					t.Fatalf("round %d: reply from hop %d recognized at hop %d: %v", round, target, i, got)
+				}
+			}
+		}
+	}
+}
+
+// TestKeystreamNotReused checks that equal payloads encrypt differently from
+// cell to cell, so that the zero padding of one cell does not give away the
+// keystream of the next.
+func TestKeystreamNotReused(t *testing.T) {
+	l, err := NewLayer(testKey(t, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a, b [protocol.CellPayloadSize]byte
+	l.Seal(&a, Forward, false)
+	l.Seal(&b, Forward, false)
+	if a == b {
+		t.Fatal("two cells were encrypted with the same keystream")
+	}
+	if bytes.Equal(a[:32], a[32:64]) {
+		t.Fatal("keystream repeats within a cell")
+	}
+
+	var c [protocol.CellPayloadSize]byte
+	other, _ := NewLayer(testKey(t, 7))
+	other.Seal(&c, Backward, false)
+	if c == a {
+		t.Fatal("both directions use the same keystream")
+	}
+}
+
+func TestTamperedCellNotRecognized(t *testing.T) {
+	sender, _ := NewLayer(testKey(t, 9))
+	receiver, _ := NewLayer(testKey(t, 9))
+	p, _ := (&protocol.RelayCell{Command: protocol.RelayData, Data: []byte("pay 10")}).Encode()
+	sender.Seal(&p, Forward, true)
+	p[protocol.RelayHeaderSize+4] ^= 1
+	if receiver.Open(&p, Forward) {
+		t.Fatal("tampered cell recognized")
+	}
+}
+
+func TestEndToEndKeyDiffersFromLayers(t *testing.T) {
+	key := testKey(t, 3)
+	e2e, err := EndToEndKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e2e) != 256 || e2e.Equal(key) {
+		t.Fatalf("end-to-end key %d bits, equal to the hop key: %v", len(e2e), e2e.Equal(key))
+	}
+	if _, err := EndToEndKey(nil); err == nil {
+		t.Fatal("derived an end-to-end key from an empty key")
+	}
+}
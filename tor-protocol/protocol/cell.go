@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Cells are the fixed-size frames exchanged between nodes. Like Tor's cells,
+// every cell is CellSize bytes long whatever it carries, so an observer of a
+// link learns only how many cells were sent.
+const (
+	CellSize        = 514
+	CircIDSize      = 4
+	CellPayloadSize = CellSize - CircIDSize - 1 // 509
+)
+
+// CircID identifies a circuit on one link. IDs are chosen by the node that
+// creates the link-level circuit and are meaningless on other links.
+type CircID uint32
+
+// Command is the type of a cell.
+type Command uint8
+
+const (
+	CmdPadding Command = 0 // link padding, discarded by the receiver
+	CmdCreate  Command = 1 // create a circuit hop: carries a key handshake
+	CmdCreated Command = 2 // reply to CREATE: carries the handshake answer
+	CmdRelay   Command = 3 // onion-encrypted relay cell, see RelayCell
+	CmdDestroy Command = 4 // tear down a circuit
+)
+
+// String returns the command name.
+func (c Command) String() string {
+	switch c {
+	case CmdPadding:
+		return "PADDING"
+	case CmdCreate:
+		return "CREATE"
+	case CmdCreated:
+		return "CREATED"
+	case CmdRelay:
+		return "RELAY"
+	case CmdDestroy:
+		return "DESTROY"
+	}
+	return fmt.Sprintf("Command(%d)", uint8(c))
+}
+
+// Cell is a single fixed-size frame.
+type Cell struct {
+	CircID  CircID
+	Command Command
+	Payload [CellPayloadSize]byte
+}
+
+// ErrPayloadTooLarge is returned when data does not fit in a cell payload.
+var ErrPayloadTooLarge = errors.New("protocol: payload too large for cell")
+
+// ErrShortCell is returned when a cell stream ends in the middle of a cell.
+var ErrShortCell = errors.New("protocol: truncated cell")
+
+// NewCell returns a cell carrying payload, zero-padded to CellPayloadSize.
+func NewCell(id CircID, cmd Command, payload []byte) (*Cell, error) {
+	if len(payload) > CellPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+	c := &Cell{CircID: id, Command: cmd}
+	copy(c.Payload[:], payload)
+	return c, nil
+}
+
+// MarshalBinary encodes the cell into exactly CellSize bytes.
+func (c *Cell) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, CellSize)
+	binary.BigEndian.PutUint32(buf[0:CircIDSize], uint32(c.CircID))
+	buf[CircIDSize] = byte(c.Command)
+	copy(buf[CircIDSize+1:], c.Payload[:])
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a cell from exactly CellSize bytes.
+func (c *Cell) UnmarshalBinary(data []byte) error {
+	if len(data) != CellSize {
+		return fmt.Errorf("protocol: cell is %d bytes, want %d", len(data), CellSize)
+	}
+	c.CircID = CircID(binary.BigEndian.Uint32(data[0:CircIDSize]))
+	c.Command = Command(data[CircIDSize])
+	copy(c.Payload[:], data[CircIDSize+1:])
+	return nil
+}
+
+// WriteCells writes cells back to back to w.
+func WriteCells(w io.Writer, cells []*Cell) error {
+	for _, c := range cells {
+		buf, err := c.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadCells reads cells from r until EOF. A trailing partial cell yields
+// ErrShortCell.
+func ReadCells(r io.Reader) ([]*Cell, error) {
+	var cells []*Cell
+	buf := make([]byte, CellSize)
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return cells, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrShortCell
+		}
+		if err != nil {
+			return nil, err
+		}
+		c := &Cell{}
+		if err := c.UnmarshalBinary(buf); err != nil {
+			return nil, err
+		}
+		cells = append(cells, c)
+	}
+}
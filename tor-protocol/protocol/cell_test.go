@@ -0,0 +1,174 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCellRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		id      CircID
+		cmd     Command
+		payload []byte
+	}{
+		{"empty", 1, CmdPadding, nil},
+		{"create", 0xdeadbeef, CmdCreate, []byte("handshake")},
+		{"full", 0xffffffff, CmdRelay, bytes.Repeat([]byte{0xa5}, CellPayloadSize)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewCell(tt.id, tt.cmd, tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := c.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buf) != CellSize {
+				t.Fatalf("cell is %d bytes, want %d", len(buf), CellSize)
+			}
+			var got Cell
+			if err := got.UnmarshalBinary(buf); err != nil {
+				t.Fatal(err)
+			}
+			if got != *c {
+				t.Fatalf("got %+v, want %+v", got, *c)
+			}
+			if !bytes.HasPrefix(got.Payload[:], tt.payload) || !allZero(got.Payload[len(tt.payload):]) {
+				t.Fatal("payload not zero-padded")
+			}
+		})
+	}
+}
+
+func TestNewCellTooLarge(t *testing.T) {
+	if _, err := NewCell(1, CmdRelay, make([]byte, CellPayloadSize+1)); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("got %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestUnmarshalWrongSize(t *testing.T) {
+	var c Cell
+	for _, n := range []int{0, CellSize - 1, CellSize + 1} {
+		if err := c.UnmarshalBinary(make([]byte, n)); err == nil {
+			t.Errorf("%d bytes: no error", n)
+		}
+	}
+}
+
+func TestReadWriteCells(t *testing.T) {
+	var cells []*Cell
+	for i := 0; i < 3; i++ {
+		c, _ := NewCell(CircID(i+1), CmdRelay, []byte{byte(i)})
+		cells = append(cells, c)
+	}
+	var buf bytes.Buffer
+	if err := WriteCells(&buf, cells); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 3*CellSize {
+		t.Fatalf("wrote %d bytes, want %d", buf.Len(), 3*CellSize)
+	}
+	raw := buf.Bytes()
+
+	got, err := ReadCells(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(cells) {
+		t.Fatalf("read %d cells, want %d", len(got), len(cells))
+	}
+	for i := range got {
+		if *got[i] != *cells[i] {
+			t.Errorf("cell %d: got %+v, want %+v", i, got[i], cells[i])
+		}
+	}
+
+	if got, err := ReadCells(bytes.NewReader(nil)); err != nil || len(got) != 0 {
+		t.Fatalf("empty stream: %d cells, %v", len(got), err)
+	}
+	if _, err := ReadCells(bytes.NewReader(raw[:len(raw)-1])); !errors.Is(err, ErrShortCell) {
+		t.Fatalf("truncated stream: got %v, want ErrShortCell", err)
+	}
+}
+
+func TestRelayCellRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, RelayDataSize - 1, RelayDataSize} {
+		rc := &RelayCell{Command: RelayData, Data: bytes.Repeat([]byte{'x'}, n)}
+		p, err := rc.Encode()
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		got, err := DecodeRelayCell(&p)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if got.Command != rc.Command || !bytes.Equal(got.Data, rc.Data) {
+			t.Fatalf("%d bytes: got %v %d bytes", n, got.Command, len(got.Data))
+		}
+	}
+	if _, err := (&RelayCell{Data: make([]byte, RelayDataSize+1)}).Encode(); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("oversized relay data: got %v", err)
+	}
+}
+
+func TestDecodeRelayCellRejects(t *testing.T) {
+	p, _ := (&RelayCell{Command: RelayData, Data: []byte("x")}).Encode()
+
+	unrecognized := p
+	unrecognized[1] = 1
+	if _, err := DecodeRelayCell(&unrecognized); !errors.Is(err, ErrNotRecognized) {
+		t.Errorf("recognized field set: got %v", err)
+	}
+
+	long := p
+	long[7], long[8] = 0xff, 0xff
+	if _, err := DecodeRelayCell(&long); err == nil {
+		t.Error("length out of range: no error")
+	}
+}
+
+func TestSplitJoinMessage(t *testing.T) {
+	for _, n := range []int{0, 1, RelayDataSize, RelayDataSize + 1, 5*RelayDataSize + 17} {
+		msg := make([]byte, n)
+		for i := range msg {
+			msg[i] = byte(i)
+		}
+		cells := SplitMessage(msg)
+		if want := (n+RelayDataSize-1)/RelayDataSize + 1; len(cells) != want {
+			t.Fatalf("%d bytes: %d cells, want %d", n, len(cells), want)
+		}
+		got, err := JoinMessage(cells)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("%d bytes: message changed", n)
+		}
+	}
+}
+
+func TestJoinMessageRejects(t *testing.T) {
+	data := &RelayCell{Command: RelayData, Data: []byte("a")}
+	end := &RelayCell{Command: RelayEnd}
+	for name, cells := range map[string][]*RelayCell{
+		"no END":         {data},
+		"data after END": {end, data},
+		"wrong command":  {{Command: RelayExtend}, end},
+	} {
+		if _, err := JoinMessage(cells); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A CustomHeader travels in an HTTP header as
+//
+//	HeaderMagic + base64url(Serialize() || HMAC-SHA256 tag)
+//
+// The tag is keyed from the QKD key, so a forged, altered or truncated header
+// is rejected.
+const (
+	HeaderMagic   = "QTR1."
+	HeaderTagSize = sha256.Size
+
+	// MaxHeaderSize is the size of the largest serialized header accepted.
+	MaxHeaderSize = HeaderSize + 2 + MaxExtensionSize
+
+	headerKeyLabel = "quaitor custom header v1"
+)
+
+var (
+	// ErrHeaderMagic is returned when the encoded header lacks HeaderMagic.
+	ErrHeaderMagic = errors.New("protocol: missing header magic")
+	// ErrHeaderEncoding is returned when the header is not valid base64url.
+	ErrHeaderEncoding = errors.New("protocol: invalid header encoding")
+	// ErrHeaderLength is returned when the header has the wrong size.
+	ErrHeaderLength = errors.New("protocol: invalid header length")
+	// ErrHeaderAuth is returned when the header's tag does not verify.
+	ErrHeaderAuth = errors.New("protocol: header authentication failed")
+	// ErrHeaderEpoch is returned when there is no key for the header's key
+	// epoch.
+	ErrHeaderEpoch = errors.New("protocol: no key for header key epoch")
+)
+
+// HeaderError is returned by DecodeHeader. Err is, or wraps, one of the
+// ErrHeader* values (or ErrInvalidFlag) and can be matched with errors.Is.
+type HeaderError struct {
+	Err error
+}
+
+func (e *HeaderError) Error() string { return e.Err.Error() }
+
+func (e *HeaderError) Unwrap() error { return e.Err }
+
+// EncodeHeader serializes, authenticates and text-encodes h under key.
+func EncodeHeader(h *CustomHeader, key []byte) (string, error) {
+	data, err := h.Serialize()
+	if err != nil {
+		return "", err
+	}
+	data = append(data, headerTag(key, data)...)
+	return HeaderMagic + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeHeader verifies and parses a header produced by EncodeHeader. All
+// failures are reported as *HeaderError.
+func DecodeHeader(s string, key []byte) (*CustomHeader, error) {
+	return DecodeHeaderEpoch(s, func(uint32) ([]byte, error) { return key, nil })
+}
+
+// DecodeHeaderEpoch is DecodeHeader with the key looked up by the header's
+// key epoch (0 if the header has none). The epoch is read before the tag is
+// verified, so keyFor must not trust it beyond choosing a key; a header that
+// claims another epoch than it was sealed under fails authentication.
+func DecodeHeaderEpoch(s string, keyFor func(epoch uint32) ([]byte, error)) (*CustomHeader, error) {
+	if !strings.HasPrefix(s, HeaderMagic) {
+		return nil, &HeaderError{ErrHeaderMagic}
+	}
+	s = s[len(HeaderMagic):]
+	if n := base64.RawURLEncoding.DecodedLen(len(s)); n < HeaderSize+HeaderTagSize || n > MaxHeaderSize+HeaderTagSize {
+		return nil, &HeaderError{ErrHeaderLength}
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, &HeaderError{ErrHeaderEncoding}
+	}
+
+	body, tag := data[:len(data)-HeaderTagSize], data[len(data)-HeaderTagSize:]
+	h, err := Deserialize(body)
+	if err != nil {
+		// Parse errors are only reported once the tag verifies, so the
+		// key of the current epoch is used to check it.
+		h = &CustomHeader{}
+	}
+	key, keyErr := keyFor(h.Extensions.KeyEpoch)
+	if keyErr != nil {
+		return nil, &HeaderError{fmt.Errorf("%w %d: %v", ErrHeaderEpoch, h.Extensions.KeyEpoch, keyErr)}
+	}
+	if !hmac.Equal(tag, headerTag(key, body)) {
+		return nil, &HeaderError{ErrHeaderAuth}
+	}
+	if err != nil {
+		return nil, &HeaderError{err}
+	}
+	return h, nil
+}
+
+// headerTag computes the HMAC of a serialized header under a key derived from
+// the QKD key.
+func headerTag(key, data []byte) []byte {
+	derived := sha256.Sum256(append([]byte(headerKeyLabel), key...))
+	mac := hmac.New(sha256.New, derived[:])
+	mac.Write([]byte(HeaderMagic))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
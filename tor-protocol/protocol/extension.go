@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The extension area of a version 2 header is a 2-byte length followed by a
+// sequence of type-length-value records:
+//
+//	type (1) | length (1) | value (length)
+//
+// A node decodes the types it knows and skips the rest, so new extensions can
+// be introduced without breaking older version 2 nodes.
+
+// ExtensionType identifies a TLV record in the extension area.
+type ExtensionType uint8
+
+// Known extension types.
+const (
+	ExtCircuitID     ExtensionType = 1 // 4 bytes
+	ExtHopCount      ExtensionType = 2 // 1 byte
+	ExtPaddingLength ExtensionType = 3 // 2 bytes
+	ExtKeyEpoch      ExtensionType = 4 // 4 bytes
+	ExtNonce         ExtensionType = 5 // 8 bytes
+)
+
+// MaxExtensionSize bounds the extension area of a header.
+const MaxExtensionSize = 1024
+
+// ErrExtension is returned for a malformed extension area.
+var ErrExtension = errors.New("protocol: malformed header extension")
+
+// Extensions holds the known extensions of a header. A zero field is absent
+// and is not serialized.
+type Extensions struct {
+	CircuitID     CircID // circuit the request belongs to
+	HopCount      uint8  // number of hops on that circuit
+	PaddingLength uint16 // bytes of padding added to the payload
+	KeyEpoch      uint32 // epoch of the key the payload is sealed under
+	Nonce         uint64 // random value that tells apart headers for replay checks
+}
+
+func (e *Extensions) empty() bool {
+	return *e == Extensions{}
+}
+
+// marshal encodes the non-zero extensions in type order.
+func (e *Extensions) marshal() ([]byte, error) {
+	var out []byte
+	if e.CircuitID != 0 {
+		out = appendTLV(out, ExtCircuitID, binary.BigEndian.AppendUint32(nil, uint32(e.CircuitID)))
+	}
+	if e.HopCount != 0 {
+		out = appendTLV(out, ExtHopCount, []byte{e.HopCount})
+	}
+	if e.PaddingLength != 0 {
+		out = appendTLV(out, ExtPaddingLength, binary.BigEndian.AppendUint16(nil, e.PaddingLength))
+	}
+	if e.KeyEpoch != 0 {
+		out = appendTLV(out, ExtKeyEpoch, binary.BigEndian.AppendUint32(nil, e.KeyEpoch))
+	}
+	if e.Nonce != 0 {
+		out = appendTLV(out, ExtNonce, binary.BigEndian.AppendUint64(nil, e.Nonce))
+	}
+	if len(out) > MaxExtensionSize {
+		return nil, ErrHeaderLength
+	}
+	return out, nil
+}
+
+// unmarshal decodes an extension area. Unknown types are skipped; a known
+// type with the wrong length, or one that appears twice, is an error.
+func (e *Extensions) unmarshal(data []byte) error {
+	if len(data) > MaxExtensionSize {
+		return ErrHeaderLength
+	}
+	seen := make(map[ExtensionType]bool)
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return fmt.Errorf("%w: truncated record", ErrExtension)
+		}
+		t, value := ExtensionType(data[0]), data[2:2+int(data[1])]
+		data = data[2+len(value):]
+
+		size, known := extensionSizes[t]
+		if !known {
+			continue
+		}
+		if len(value) != size {
+			return fmt.Errorf("%w: type %d has length %d, want %d", ErrExtension, t, len(value), size)
+		}
+		if seen[t] {
+			return fmt.Errorf("%w: duplicate type %d", ErrExtension, t)
+		}
+		seen[t] = true
+
+		switch t {
+		case ExtCircuitID:
+			e.CircuitID = CircID(binary.BigEndian.Uint32(value))
+		case ExtHopCount:
+			e.HopCount = value[0]
+		case ExtPaddingLength:
+			e.PaddingLength = binary.BigEndian.Uint16(value)
+		case ExtKeyEpoch:
+			e.KeyEpoch = binary.BigEndian.Uint32(value)
+		case ExtNonce:
+			e.Nonce = binary.BigEndian.Uint64(value)
+		}
+	}
+	return nil
+}
+
+// extensionSizes maps the known extension types to their value sizes.
+var extensionSizes = map[ExtensionType]int{
+	ExtCircuitID:     4,
+	ExtHopCount:      1,
+	ExtPaddingLength: 2,
+	ExtKeyEpoch:      4,
+	ExtNonce:         8,
+}
+
+func appendTLV(out []byte, t ExtensionType, value []byte) []byte {
+	out = append(out, byte(t), byte(len(value)))
+	return append(out, value...)
+}
@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Handshakes too large for one cell, such as a hybrid CREATE carrying an
+// ML-KEM encapsulation key, are split into fragments sent in consecutive
+// cells of the same command (CREATE, CREATED, or RELAY EXTEND and EXTENDED).
+// Each fragment is
+//
+//	handshake length (2) | fragment length (2) | fragment
+//
+// and is followed by the cell's padding.
+const fragmentHeaderSize = 4
+
+// ErrBadFragment is returned for handshake fragments that do not add up to a
+// handshake.
+var ErrBadFragment = errors.New("protocol: malformed handshake fragments")
+
+// SplitHandshake cuts a handshake into fragments of at most size bytes,
+// headers included.
+func SplitHandshake(data []byte, size int) [][]byte {
+	chunk := size - fragmentHeaderSize
+	var out [][]byte
+	for rest := data; len(rest) > 0 || len(out) == 0; {
+		n := len(rest)
+		if n > chunk {
+			n = chunk
+		}
+		f := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+		f = binary.BigEndian.AppendUint16(f, uint16(n))
+		out = append(out, append(f, rest[:n]...))
+		rest = rest[n:]
+	}
+	return out
+}
+
+// JoinHandshake reassembles a handshake from its fragments, in order. Padding
+// after each fragment is ignored.
+func JoinHandshake(fragments [][]byte) ([]byte, error) {
+	var data []byte
+	total := -1
+	for _, f := range fragments {
+		if len(f) < fragmentHeaderSize {
+			return nil, ErrBadFragment
+		}
+		t, n := int(binary.BigEndian.Uint16(f)), int(binary.BigEndian.Uint16(f[2:]))
+		if (total >= 0 && t != total) || len(f) < fragmentHeaderSize+n {
+			return nil, ErrBadFragment
+		}
+		total = t
+		data = append(data, f[fragmentHeaderSize:fragmentHeaderSize+n]...)
+	}
+	if total < 0 || len(data) != total {
+		return nil, ErrBadFragment
+	}
+	return data, nil
+}
@@ -3,6 +3,17 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+)
+
+// Header versions. A version 1 header is the fixed part alone; from version 2
+// on the fixed part is followed by a TLV extension area (see extension.go).
+const (
+	VersionFixed      uint8 = 1
+	VersionExtensible uint8 = 2
+
+	// Version is the highest header version this node speaks.
+	Version = VersionExtensible
 )
 
 // CustomHeader represents the protocol header structure
@@ -12,22 +23,102 @@ type CustomHeader struct {
 	Timestamp   int64  // Unix timestamp
 	Encrypted   bool   // Encryption flag
 	PayloadSize uint32 // Size of the payload
+
+	// Extensions are carried from VersionExtensible on.
+	Extensions Extensions
+}
+
+// HeaderSize is the size of the fixed part of a serialized CustomHeader,
+// which is the whole of a version 1 header.
+const HeaderSize = 1 + 2 + 8 + 1 + 4
+
+var (
+	// ErrInvalidFlag is returned when the Encrypted byte is neither 0 nor 1.
+	ErrInvalidFlag = errors.New("protocol: invalid encrypted flag")
+	// ErrUnsupportedVersion is returned for header version 0.
+	ErrUnsupportedVersion = errors.New("protocol: unsupported header version")
+	// ErrFixedVersion is returned when serializing extensions into a
+	// version 1 header.
+	ErrFixedVersion = errors.New("protocol: version 1 headers cannot carry extensions")
+)
+
+// NegotiateVersion returns the header version to use with a peer that speaks
+// up to peer. A peer that does not advertise a version (0) is assumed to be a
+// version 1 node.
+func NegotiateVersion(peer uint8) uint8 {
+	if peer == 0 {
+		return VersionFixed
+	}
+	if peer < Version {
+		return peer
+	}
+	return Version
 }
 
 // Serialize serializes the header into a byte slice
 func (h *CustomHeader) Serialize() ([]byte, error) {
+	if h.Version == 0 {
+		return nil, ErrUnsupportedVersion
+	}
 	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.BigEndian, h); err != nil {
+	fixed := []interface{}{h.Version, h.RouteID, h.Timestamp, h.Encrypted, h.PayloadSize}
+	for _, v := range fixed {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.Version == VersionFixed {
+		if !h.Extensions.empty() {
+			return nil, ErrFixedVersion
+		}
+		return buf.Bytes(), nil
+	}
+	ext, err := h.Extensions.marshal()
+	if err != nil {
 		return nil, err
 	}
+	buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(ext))))
+	buf.Write(ext)
 	return buf.Bytes(), nil
 }
 
-// Deserialize deserializes a byte slice into a CustomHeader
+// Deserialize deserializes a byte slice into a CustomHeader. A version 1
+// header must be exactly HeaderSize bytes; later versions must hold exactly
+// the extension area they announce. The Encrypted byte must be 0 or 1, so
+// that every header has a single valid encoding.
 func Deserialize(data []byte) (*CustomHeader, error) {
-	h := &CustomHeader{}
-	buf := bytes.NewReader(data)
-	if err := binary.Read(buf, binary.BigEndian, h); err != nil {
+	if len(data) < HeaderSize {
+		return nil, ErrHeaderLength
+	}
+	if data[0] == 0 {
+		return nil, ErrUnsupportedVersion
+	}
+	if data[11] > 1 {
+		return nil, ErrInvalidFlag
+	}
+
+	h := &CustomHeader{
+		Version:     data[0],
+		RouteID:     binary.BigEndian.Uint16(data[1:]),
+		Timestamp:   int64(binary.BigEndian.Uint64(data[3:])),
+		Encrypted:   data[11] == 1,
+		PayloadSize: binary.BigEndian.Uint32(data[12:]),
+	}
+	rest := data[HeaderSize:]
+
+	if h.Version == VersionFixed {
+		if len(rest) != 0 {
+			return nil, ErrHeaderLength
+		}
+		return h, nil
+	}
+	// Headers newer than this node are read as far as it understands them:
+	// their extension area has the same layout and unknown TLVs are skipped.
+	if len(rest) < 2 || len(rest)-2 != int(binary.BigEndian.Uint16(rest)) {
+		return nil, ErrHeaderLength
+	}
+	if err := h.Extensions.unmarshal(rest[2:]); err != nil {
 		return nil, err
 	}
 	return h, nil
@@ -0,0 +1,180 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+var fullExtensions = Extensions{CircuitID: 7, HopCount: 3, PaddingLength: 100, KeyEpoch: 2, Nonce: 0x0102030405060708}
+
+func header(version uint8, ext Extensions) *CustomHeader {
+	return &CustomHeader{Version: version, RouteID: 0xbeef, Timestamp: 1700000000, Encrypted: true, PayloadSize: 42, Extensions: ext}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		h    *CustomHeader
+		size int
+	}{
+		{"v1", header(VersionFixed, Extensions{}), HeaderSize},
+		{"v2 without extensions", header(VersionExtensible, Extensions{}), HeaderSize + 2},
+		{"v2 with extensions", header(VersionExtensible, fullExtensions), HeaderSize + 2 + 6 + 3 + 4 + 6 + 10},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.h.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != tt.size {
+				t.Fatalf("serialized to %d bytes, want %d", len(data), tt.size)
+			}
+			got, err := Deserialize(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *tt.h {
+				t.Fatalf("got %+v, want %+v", got, tt.h)
+			}
+		})
+	}
+}
+
+func TestVersion1CannotCarryExtensions(t *testing.T) {
+	if _, err := header(VersionFixed, Extensions{Nonce: 1}).Serialize(); !errors.Is(err, ErrFixedVersion) {
+		t.Fatalf("got %v, want ErrFixedVersion", err)
+	}
+}
+
+// TestCrossVersion checks that a version 2 node reads the headers of version 1
+// nodes, and of newer nodes as far as it understands them.
+func TestCrossVersion(t *testing.T) {
+	v1, _ := header(VersionFixed, Extensions{}).Serialize()
+	got, err := Deserialize(v1)
+	if err != nil {
+		t.Fatalf("v1 header: %v", err)
+	}
+	if got.Version != VersionFixed || got.Extensions != (Extensions{}) {
+		t.Fatalf("v1 header read as %+v", got)
+	}
+
+	// A version 3 header with an extension this node does not know.
+	data, _ := header(VersionExtensible, fullExtensions).Serialize()
+	data[0] = 3
+	data = append(data, 200, 3, 'n', 'e', 'w')
+	binary.BigEndian.PutUint16(data[HeaderSize:], uint16(len(data)-HeaderSize-2))
+	got, err = Deserialize(data)
+	if err != nil {
+		t.Fatalf("v3 header: %v", err)
+	}
+	if got.Version != 3 || got.Extensions != fullExtensions {
+		t.Fatalf("v3 header read as %+v", got)
+	}
+}
+
+func TestDeserializeRejects(t *testing.T) {
+	v1, _ := header(VersionFixed, Extensions{}).Serialize()
+	v2, _ := header(VersionExtensible, fullExtensions).Serialize()
+	with := func(data []byte, f func([]byte) []byte) []byte {
+		return f(append([]byte(nil), data...))
+	}
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"short", v1[:HeaderSize-1], ErrHeaderLength},
+		{"version 0", with(v1, func(b []byte) []byte { b[0] = 0; return b }), ErrUnsupportedVersion},
+		{"bad flag", with(v1, func(b []byte) []byte { b[11] = 2; return b }), ErrInvalidFlag},
+		{"v1 with trailing bytes", append(with(v1, func(b []byte) []byte { return b }), 0), ErrHeaderLength},
+		{"v2 without extension length", v2[:HeaderSize], ErrHeaderLength},
+		{"v2 with wrong extension length", v2[:len(v2)-1], ErrHeaderLength},
+		{"v2 with wrong record size", with(v2, func(b []byte) []byte { b[HeaderSize+3] = 3; return b }), ErrExtension},
+		{"v2 with duplicate record", with(v2, func(b []byte) []byte {
+			b = append(b, byte(ExtHopCount), 1, 9)
+			binary.BigEndian.PutUint16(b[HeaderSize:], uint16(len(b)-HeaderSize-2))
+			return b
+		}), ErrExtension},
+	} {
+		if _, err := Deserialize(tt.data); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	for peer, want := range map[uint8]uint8{0: VersionFixed, 1: VersionFixed, 2: VersionExtensible, 9: Version} {
+		if got := NegotiateVersion(peer); got != want {
+			t.Errorf("NegotiateVersion(%d) = %d, want %d", peer, got, want)
+		}
+	}
+}
+
+func TestEncodeDecodeHeader(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, h := range []*CustomHeader{header(VersionFixed, Extensions{}), header(VersionExtensible, fullExtensions)} {
+		s, err := EncodeHeader(h, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodeHeader(s, key)
+		if err != nil {
+			t.Fatalf("v%d: %v", h.Version, err)
+		}
+		if *got != *h {
+			t.Fatalf("v%d: got %+v, want %+v", h.Version, got, h)
+		}
+		if _, err := DecodeHeader(s, []byte("another key")); !errors.Is(err, ErrHeaderAuth) {
+			t.Errorf("v%d under another key: got %v", h.Version, err)
+		}
+	}
+
+	s, _ := EncodeHeader(header(VersionExtensible, fullExtensions), key)
+	tampered := []byte(s)
+	tampered[len(HeaderMagic)+3] ^= 'A' ^ 'B'
+	for name, tt := range map[string]struct {
+		s    string
+		want error
+	}{
+		"no magic":   {s[len(HeaderMagic):], ErrHeaderMagic},
+		"truncated":  {s[:len(s)-4], ErrHeaderAuth},
+		"tampered":   {string(tampered), ErrHeaderAuth},
+		"not base64": {HeaderMagic + string(make([]byte, 80)), ErrHeaderEncoding},
+		"too short":  {HeaderMagic + "AAAA", ErrHeaderLength},
+	} {
+		_, err := DecodeHeader(tt.s, key)
+		var herr *HeaderError
+		if !errors.As(err, &herr) || !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want a HeaderError wrapping %v", name, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeHeaderEpoch(t *testing.T) {
+	keys := map[uint32][]byte{1: []byte("epoch one key"), 2: []byte("epoch two key")}
+	keyFor := func(epoch uint32) ([]byte, error) {
+		if k, ok := keys[epoch]; ok {
+			return k, nil
+		}
+		return nil, errors.New("no such epoch")
+	}
+
+	h := header(VersionExtensible, Extensions{KeyEpoch: 2, Nonce: 1})
+	s, _ := EncodeHeader(h, keys[2])
+	if _, err := DecodeHeaderEpoch(s, keyFor); err != nil {
+		t.Fatalf("epoch 2: %v", err)
+	}
+
+	// A header sealed under epoch 1 claiming epoch 2.
+	s, _ = EncodeHeader(h, keys[1])
+	if _, err := DecodeHeaderEpoch(s, keyFor); !errors.Is(err, ErrHeaderAuth) {
+		t.Errorf("wrong epoch: got %v, want ErrHeaderAuth", err)
+	}
+
+	h.Extensions.KeyEpoch = 3
+	s, _ = EncodeHeader(h, keys[1])
+	if _, err := DecodeHeaderEpoch(s, keyFor); !errors.Is(err, ErrHeaderEpoch) {
+		t.Errorf("unknown epoch: got %v, want ErrHeaderEpoch", err)
+	}
+}
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A relay cell's payload starts with a header that is only readable by the
+// hop it is addressed to, once every outer onion layer has been removed:
+//
+//	command (1) | recognized (2) | digest (4) | length (2) | data (500)
+//
+// Recognized is zero and the digest matches for the addressed hop; for any
+// other hop the header is still encrypted and looks random.
+const (
+	RelayHeaderSize = 1 + 2 + 4 + 2
+	RelayDataSize   = CellPayloadSize - RelayHeaderSize // 500
+
+	relayDigestOffset = 3
+	relayDigestSize   = 4
+)
+
+// RelayCommand is the type of a relay cell.
+type RelayCommand uint8
+
+const (
+	RelayData     RelayCommand = 2 // a chunk of a request or response message
+	RelayEnd      RelayCommand = 3 // end of a message
+	RelayExtend   RelayCommand = 6 // extend the circuit by one hop
+	RelayExtended RelayCommand = 7 // reply to EXTEND
+)
+
+// String returns the relay command name.
+func (c RelayCommand) String() string {
+	switch c {
+	case RelayData:
+		return "DATA"
+	case RelayEnd:
+		return "END"
+	case RelayExtend:
+		return "EXTEND"
+	case RelayExtended:
+		return "EXTENDED"
+	}
+	return fmt.Sprintf("RelayCommand(%d)", uint8(c))
+}
+
+// RelayCell is the decrypted content of a RELAY cell.
+type RelayCell struct {
+	Command RelayCommand
+	Data    []byte
+}
+
+// ErrNotRecognized is returned when decoding a relay payload whose recognized
+// field is not zero.
+var ErrNotRecognized = errors.New("protocol: relay cell not recognized")
+
+// Encode lays the relay cell out as a cell payload with a zero digest.
+func (r *RelayCell) Encode() ([CellPayloadSize]byte, error) {
+	var p [CellPayloadSize]byte
+	if len(r.Data) > RelayDataSize {
+		return p, ErrPayloadTooLarge
+	}
+	p[0] = byte(r.Command)
+	binary.BigEndian.PutUint16(p[7:9], uint16(len(r.Data)))
+	copy(p[RelayHeaderSize:], r.Data)
+	return p, nil
+}
+
+// DecodeRelayCell parses a cell payload whose onion layers have all been
+// removed.
+func DecodeRelayCell(p *[CellPayloadSize]byte) (*RelayCell, error) {
+	if RelayRecognized(p) != 0 {
+		return nil, ErrNotRecognized
+	}
+	n := int(binary.BigEndian.Uint16(p[7:9]))
+	if n > RelayDataSize {
+		return nil, fmt.Errorf("protocol: relay data length %d out of range", n)
+	}
+	data := make([]byte, n)
+	copy(data, p[RelayHeaderSize:RelayHeaderSize+n])
+	return &RelayCell{Command: RelayCommand(p[0]), Data: data}, nil
+}
+
+// RelayRecognized returns the recognized field of a relay payload.
+func RelayRecognized(p *[CellPayloadSize]byte) uint16 {
+	return binary.BigEndian.Uint16(p[1:3])
+}
+
+// RelayDigest returns the digest field of a relay payload.
+func RelayDigest(p *[CellPayloadSize]byte) []byte {
+	return p[relayDigestOffset : relayDigestOffset+relayDigestSize]
+}
+
+// SplitMessage cuts a message into DATA relay cells followed by one END cell.
+func SplitMessage(msg []byte) []*RelayCell {
+	var cells []*RelayCell
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > RelayDataSize {
+			n = RelayDataSize
+		}
+		cells = append(cells, &RelayCell{Command: RelayData, Data: msg[:n]})
+		msg = msg[n:]
+	}
+	return append(cells, &RelayCell{Command: RelayEnd})
+}
+
+// JoinMessage reassembles a message from DATA cells terminated by an END cell.
+func JoinMessage(cells []*RelayCell) ([]byte, error) {
+	var msg []byte
+	for i, c := range cells {
+		switch c.Command {
+		case RelayData:
+			msg = append(msg, c.Data...)
+		case RelayEnd:
+			if i != len(cells)-1 {
+				return nil, errors.New("protocol: data after END")
+			}
+			return msg, nil
+		default:
+			return nil, fmt.Errorf("protocol: unexpected %s cell in message", c.Command)
+		}
+	}
+	return nil, errors.New("protocol: message not terminated by END")
+}
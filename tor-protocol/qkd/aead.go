@@ -0,0 +1,132 @@
+package qkd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Cipher names an AEAD used to seal payloads.
+type Cipher string
+
+// Supported ciphers. Both use 256-bit keys derived from the QKD key.
+const (
+	AESGCM           Cipher = "aes-gcm"
+	ChaCha20Poly1305 Cipher = "chacha20-poly1305"
+)
+
+var (
+	// ErrAuthFailed is returned when a sealed message fails authentication:
+	// it was altered in transit or sealed under a different key.
+	ErrAuthFailed = errors.New("qkd: message authentication failed")
+	// ErrUnknownCipher is returned for an unsupported Cipher.
+	ErrUnknownCipher = errors.New("qkd: unknown cipher")
+)
+
+// A sealed message is
+//
+//	cipher ID (1) | nonce | ciphertext and tag
+//
+// The cipher ID lets the receiver open messages from peers configured with a
+// different cipher; it is authenticated along with the caller's data.
+var cipherIDs = map[Cipher]byte{AESGCM: 1, ChaCha20Poly1305: 2}
+
+// SealOverhead is the number of bytes Seal adds to a message. It is the same
+// for every supported cipher: the cipher ID, a 12-byte nonce and a 16-byte
+// tag.
+const SealOverhead = 1 + 12 + 16
+
+// DeriveKey expands k into size bytes of key material with HKDF-SHA256. Keys
+// for different purposes must use different info strings.
+func DeriveKey(k Key, info string, size int) ([]byte, error) {
+	if len(k) == 0 {
+		return nil, ErrEmptyKey
+	}
+	out := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, k.Bytes(), nil, []byte(info)), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Seal encrypts and authenticates plaintext, and authenticates ad, under a
+// key derived from k for info.
+func Seal(c Cipher, k Key, info string, plaintext, ad []byte) ([]byte, error) {
+	id, ok := cipherIDs[c]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCipher, c)
+	}
+	aead, err := newAEAD(c, k, info)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out[0] = id
+	if _, err := rand.Read(out[1:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[1:], plaintext, append([]byte{id}, ad...)), nil
+}
+
+// Open reverses Seal. It returns ErrAuthFailed if sealed or ad were altered
+// or k is not the key the message was sealed under.
+func Open(k Key, info string, sealed, ad []byte) ([]byte, error) {
+	if len(sealed) == 0 {
+		return nil, ErrAuthFailed
+	}
+	c, ok := cipherByID(sealed[0])
+	if !ok {
+		return nil, ErrAuthFailed
+	}
+	aead, err := newAEAD(c, k, info)
+	if err != nil {
+		return nil, err
+	}
+
+	rest := sealed[1:]
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrAuthFailed
+	}
+	nonce, ct := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	pt, err := aead.Open(nil, nonce, ct, append([]byte{sealed[0]}, ad...))
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return pt, nil
+}
+
+// newAEAD returns cipher c keyed from k for info.
+func newAEAD(c Cipher, k Key, info string) (cipher.AEAD, error) {
+	key, err := DeriveKey(k, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case AESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case ChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownCipher, c)
+}
+
+func cipherByID(id byte) (Cipher, bool) {
+	for c, cid := range cipherIDs {
+		if cid == id {
+			return c, true
+		}
+	}
+	return "", false
+}
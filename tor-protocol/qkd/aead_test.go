@@ -0,0 +1,58 @@
+package qkd
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := randomKey(SeededSource(1), DefaultKeyLength)
+	msg, ad := []byte("GET /home?data=x"), []byte("route 1")
+	for _, c := range []Cipher{AESGCM, ChaCha20Poly1305} {
+		sealed, err := Seal(c, key, "test", msg, ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sealed) != len(msg)+SealOverhead {
+			t.Errorf("%s: sealed %d bytes into %d", c, len(msg), len(sealed))
+		}
+		opened, err := Open(key, "test", sealed, ad)
+		if err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+		if !bytes.Equal(opened, msg) {
+			t.Fatalf("%s: opened %q", c, opened)
+		}
+		again, _ := Seal(c, key, "test", msg, ad)
+		if bytes.Equal(again, sealed) {
+			t.Errorf("%s: sealing twice gave the same message", c)
+		}
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	key := randomKey(SeededSource(1), DefaultKeyLength)
+	sealed, err := Seal(AESGCM, key, "test", []byte("message"), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	for name, open := range map[string]func() ([]byte, error){
+		"tampered": func() ([]byte, error) { return Open(key, "test", tampered, []byte("ad")) },
+		"other key": func() ([]byte, error) {
+			return Open(randomKey(SeededSource(2), DefaultKeyLength), "test", sealed, []byte("ad"))
+		},
+		"other info": func() ([]byte, error) { return Open(key, "other", sealed, []byte("ad")) },
+		"other ad":   func() ([]byte, error) { return Open(key, "test", sealed, []byte("da")) },
+		"empty":      func() ([]byte, error) { return Open(key, "test", nil, nil) },
+	} {
+		if _, err := open(); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%s: got %v, want ErrAuthFailed", name, err)
+		}
+	}
+	if _, err := Seal("rot13", key, "test", nil, nil); !errors.Is(err, ErrUnknownCipher) {
+		t.Errorf("got %v, want ErrUnknownCipher", err)
+	}
+}
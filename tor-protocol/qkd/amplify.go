@@ -0,0 +1,69 @@
+package qkd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// SecurityMargin is the number of bits privacy amplification removes beyond
+// the eavesdropper's estimated knowledge, to cover the finite-size error of
+// that estimate.
+const SecurityMargin = 64
+
+// ErrNoSecureKey is returned when privacy amplification leaves no key.
+var ErrNoSecureKey = errors.New("qkd: no secure key left after privacy amplification")
+
+// BinaryEntropy returns h(p) = -p log2 p - (1-p) log2 (1-p).
+func BinaryEntropy(p float64) float64 {
+	if p <= 0 || p >= 1 {
+		return 0
+	}
+	return -p*math.Log2(p) - (1-p)*math.Log2(1-p)
+}
+
+// SecureLength returns the length to which a reconciled n-bit key must be
+// compressed: an eavesdropper may know up to n h(qber) bits of it from the
+// quantum channel, plus the leaked bits disclosed during reconciliation. It
+// returns 0 if nothing secure is left.
+func SecureLength(n, leaked int, qber float64) int {
+	m := int(float64(n)*(1-BinaryEntropy(qber))) - leaked - SecurityMargin
+	if m < 0 {
+		return 0
+	}
+	return m
+}
+
+// ToeplitzSeedLength is the number of seed bits that define the m×n Toeplitz
+// matrix used by Amplify.
+func ToeplitzSeedLength(n, m int) int {
+	return n + m - 1
+}
+
+// Amplify compresses k to m bits by multiplying it with the m×n Toeplitz
+// matrix whose diagonals are the bits of seed. Toeplitz matrices are a
+// universal hash family, so with a random public seed the output is close to
+// uniform for an eavesdropper who knows fewer than len(k)-m bits of k.
+func Amplify(k Key, seed Key, m int) (Key, error) {
+	n := len(k)
+	if m <= 0 || n == 0 {
+		return nil, ErrNoSecureKey
+	}
+	if m > n {
+		return nil, fmt.Errorf("qkd: cannot amplify %d bits to %d", n, m)
+	}
+	if len(seed) != ToeplitzSeedLength(n, m) {
+		return nil, fmt.Errorf("qkd: Toeplitz seed of %d bits for a %dx%d matrix", len(seed), m, n)
+	}
+	// Row i, column j of the matrix is seed[i-j+n-1].
+	out := make(Key, m)
+	for i := range out {
+		var b uint8
+		row := seed[i : i+n]
+		for j, bit := range k {
+			b ^= row[n-1-j] & bit
+		}
+		out[i] = b
+	}
+	return out, nil
+}
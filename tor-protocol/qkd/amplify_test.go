@@ -0,0 +1,128 @@
+package qkd
+
+import (
+	"errors"
+	"testing"
+)
+
+func randomKey(rng RandomSource, n int) Key {
+	k := make(Key, n)
+	for i := range k {
+		k[i] = rng.Bit()
+	}
+	return k
+}
+
+// toeplitz multiplies k with the m×n Toeplitz matrix of seed the long way.
+func toeplitz(k, seed Key, m int) Key {
+	n := len(k)
+	matrix := make([][]uint8, m)
+	for i := range matrix {
+		matrix[i] = make([]uint8, n)
+		for j := range matrix[i] {
+			matrix[i][j] = seed[i-j+n-1]
+		}
+	}
+	out := make(Key, m)
+	for i := range out {
+		for j := range k {
+			out[i] ^= matrix[i][j] & k[j]
+		}
+	}
+	return out
+}
+
+func TestAmplifyMatchesMatrix(t *testing.T) {
+	rng := SeededSource(1)
+	for _, size := range []struct{ n, m int }{{1, 1}, {8, 3}, {100, 37}, {512, 256}} {
+		k := randomKey(rng, size.n)
+		seed := randomKey(rng, ToeplitzSeedLength(size.n, size.m))
+		got, err := Amplify(k, seed, size.m)
+		if err != nil {
+			t.Fatalf("%dx%d: %v", size.m, size.n, err)
+		}
+		if want := toeplitz(k, seed, size.m); !got.Equal(want) {
+			t.Fatalf("%dx%d: got %v, want %v", size.m, size.n, got, want)
+		}
+	}
+}
+
+// TestAmplifyIsLinear checks the property privacy amplification relies on:
+// the hash of a key that differs from another in a few bits differs from its
+// hash by the hash of the difference.
+func TestAmplifyIsLinear(t *testing.T) {
+	rng := SeededSource(2)
+	ref, noisy, _ := noisyPair(t, 1024, 0.05, 2)
+	seed := randomKey(rng, ToeplitzSeedLength(1024, 300))
+	diff := make(Key, len(ref))
+	for i := range diff {
+		diff[i] = ref[i] ^ noisy[i]
+	}
+	a, _ := Amplify(ref, seed, 300)
+	b, _ := Amplify(noisy, seed, 300)
+	d, _ := Amplify(diff, seed, 300)
+	for i := range a {
+		if a[i]^b[i] != d[i] {
+			t.Fatalf("bit %d: hash is not linear", i)
+		}
+	}
+	if a.Equal(b) {
+		t.Fatal("keys that differ hash alike")
+	}
+}
+
+func TestAmplifyRejects(t *testing.T) {
+	k := randomKey(SeededSource(3), 16)
+	for name, tt := range map[string]struct {
+		key  Key
+		seed int
+		m    int
+	}{
+		"m of 0":        {k, ToeplitzSeedLength(16, 0), 0},
+		"empty key":     {nil, 0, 4},
+		"m above n":     {k, ToeplitzSeedLength(16, 17), 17},
+		"seed too long": {k, ToeplitzSeedLength(16, 8) + 1, 8},
+	} {
+		if _, err := Amplify(tt.key, make(Key, tt.seed), tt.m); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := Amplify(k, nil, 0); !errors.Is(err, ErrNoSecureKey) {
+		t.Errorf("m of 0: got %v, want ErrNoSecureKey", err)
+	}
+}
+
+// TestReconcileThenAmplify runs the classical post-processing of a link
+// exchange: both sides end up with the same compressed key.
+func TestReconcileThenAmplify(t *testing.T) {
+	ref, noisy, _ := noisyPair(t, 4096, 0.03, 9)
+	corrected, leaked, _, err := NewCascade(SeededSource(9)).Reconcile(noisy, 0.03, ref.Parities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := SecureLength(len(corrected), leaked, 0.03)
+	if m == 0 || m >= len(corrected) {
+		t.Fatalf("secure length %d of %d bits", m, len(corrected))
+	}
+	seed := randomKey(SeededSource(10), ToeplitzSeedLength(len(corrected), m))
+	a, err := Amplify(corrected, seed, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := Amplify(ref, seed, m)
+	if !a.Equal(b) {
+		t.Fatal("the two sides amplified to different keys")
+	}
+}
+
+func TestSecureLength(t *testing.T) {
+	if got := SecureLength(1000, 0, 0); got != 1000-SecurityMargin {
+		t.Errorf("noiseless: %d", got)
+	}
+	if got := SecureLength(1000, 100, 0.05); got != int(1000*(1-BinaryEntropy(0.05)))-100-SecurityMargin {
+		t.Errorf("5%% QBER: %d", got)
+	}
+	if got := SecureLength(100, 50, 0.05); got != 0 {
+		t.Errorf("leaked more than is left: %d", got)
+	}
+}
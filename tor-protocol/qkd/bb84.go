@@ -0,0 +1,194 @@
+// Package qkd is a pure-Go simulation of quantum key distribution. It models
+// the BB84 protocol (random bits, random bases, measurement and sifting), so
+// nodes can generate QKD keys in-process, and derives the keys of the ciphers
+// that use them.
+package qkd
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Basis is the measurement/preparation basis of a single qubit.
+type Basis uint8
+
+const (
+	// Rectilinear is the Z basis (|0>, |1>).
+	Rectilinear Basis = 0
+	// Diagonal is the X basis (|+>, |->).
+	Diagonal Basis = 1
+)
+
+// String returns the conventional name of the basis.
+func (b Basis) String() string {
+	if b == Diagonal {
+		return "X"
+	}
+	return "Z"
+}
+
+// Qubit is a simulated photon prepared by Alice: a bit encoded in a basis.
+type Qubit struct {
+	Bit   uint8
+	Basis Basis
+}
+
+// ErrKeyTooShort is returned when sifting leaves no usable key bits.
+var ErrKeyTooShort = errors.New("qkd: sifted key is empty")
+
+// Measure simulates measuring q in basis. Measuring in the preparation basis
+// returns the encoded bit; measuring in the conjugate basis yields a uniformly
+// random outcome.
+func Measure(q Qubit, basis Basis, rng RandomSource) uint8 {
+	if q.Basis == basis {
+		return q.Bit
+	}
+	return rng.Bit()
+}
+
+// PrepareQubits draws n random bits and bases and encodes them as qubits.
+func PrepareQubits(n int, rng RandomSource) []Qubit {
+	qubits := make([]Qubit, n)
+	for i := range qubits {
+		qubits[i] = Qubit{Bit: rng.Bit(), Basis: Basis(rng.Bit())}
+	}
+	return qubits
+}
+
+// RandomBases draws n random measurement bases.
+func RandomBases(n int, rng RandomSource) []Basis {
+	bases := make([]Basis, n)
+	for i := range bases {
+		bases[i] = Basis(rng.Bit())
+	}
+	return bases
+}
+
+// FormatBases encodes bases as a string of 'Z' and 'X' characters.
+func FormatBases(bases []Basis) string {
+	out := make([]byte, len(bases))
+	for i, b := range bases {
+		out[i] = b.String()[0]
+	}
+	return string(out)
+}
+
+// ParseBases decodes a string produced by FormatBases.
+func ParseBases(s string) ([]Basis, error) {
+	bases := make([]Basis, len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case 'Z':
+			bases[i] = Rectilinear
+		case 'X':
+			bases[i] = Diagonal
+		default:
+			return nil, fmt.Errorf("qkd: invalid basis %q at %d", s[i], i)
+		}
+	}
+	return bases, nil
+}
+
+// PackBases packs bases one bit each, most significant bit first.
+func PackBases(bases []Basis) []byte {
+	bits := make(Key, len(bases))
+	for i, b := range bases {
+		bits[i] = uint8(b)
+	}
+	return bits.Bytes()
+}
+
+// UnpackBases is the inverse of PackBases for n bases.
+func UnpackBases(b []byte, n int) ([]Basis, error) {
+	bits, err := UnpackKey(b, n)
+	if err != nil {
+		return nil, err
+	}
+	bases := make([]Basis, n)
+	for i, bit := range bits {
+		bases[i] = Basis(bit)
+	}
+	return bases, nil
+}
+
+// Sift keeps the bits whose preparation and measurement bases agree.
+func Sift(bits Key, aliceBases, bobBases []Basis) (Key, error) {
+	if len(bits) != len(aliceBases) || len(bits) != len(bobBases) {
+		return nil, fmt.Errorf("qkd: sift length mismatch: %d bits, %d/%d bases",
+			len(bits), len(aliceBases), len(bobBases))
+	}
+	key := make(Key, 0, len(bits)/2)
+	for i, bit := range bits {
+		if aliceBases[i] == bobBases[i] {
+			key = append(key, bit)
+		}
+	}
+	if len(key) == 0 {
+		return nil, ErrKeyTooShort
+	}
+	return key, nil
+}
+
+// Engine runs simulated BB84 exchanges.
+type Engine struct {
+	Rand RandomSource
+}
+
+// NewEngine returns an Engine drawing randomness from rng. A nil rng selects
+// the cryptographically secure default source.
+func NewEngine(rng RandomSource) *Engine {
+	if rng == nil {
+		rng = CryptoSource()
+	}
+	return &Engine{Rand: rng}
+}
+
+// Prepare is Alice's side of an exchange: it returns n freshly prepared
+// qubits together with her bits and bases.
+func (e *Engine) Prepare(n int) (qubits []Qubit, bits Key, bases []Basis) {
+	qubits = PrepareQubits(n, e.Rand)
+	bits = make(Key, n)
+	bases = make([]Basis, n)
+	for i, q := range qubits {
+		bits[i] = q.Bit
+		bases[i] = q.Basis
+	}
+	return qubits, bits, bases
+}
+
+// Receive is Bob's side of an exchange: every qubit is measured in a randomly
+// chosen basis. The bases are announced to Alice for sifting.
+func (e *Engine) Receive(qubits []Qubit) (bits Key, bases []Basis) {
+	bases = RandomBases(len(qubits), e.Rand)
+	bits = make(Key, len(qubits))
+	for i, q := range qubits {
+		bits[i] = Measure(q, bases[i], e.Rand)
+	}
+	return bits, bases
+}
+
+// Generate runs a full BB84 exchange over length qubits and returns the sifted
+// key shared by Alice and Bob. As in qkd/main.py, roughly half of the qubits
+// survive sifting.
+func (e *Engine) Generate(length int) (Key, error) {
+	if length <= 0 {
+		return nil, fmt.Errorf("qkd: invalid key length %d", length)
+	}
+
+	qubits, aliceBits, aliceBases := e.Prepare(length)
+	bobBits, bobBases := e.Receive(qubits)
+
+	// Only the bits where Alice's and Bob's bases match are kept.
+	aliceKey, err := Sift(aliceBits, aliceBases, bobBases)
+	if err != nil {
+		return nil, err
+	}
+	bobKey, err := Sift(bobBits, aliceBases, bobBases)
+	if err != nil {
+		return nil, err
+	}
+	if !aliceKey.Equal(bobKey) {
+		return nil, errors.New("qkd: sifted keys disagree")
+	}
+	return aliceKey, nil
+}
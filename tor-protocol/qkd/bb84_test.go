@@ -0,0 +1,133 @@
+package qkd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGenerateSeeded(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		key, err := NewEngine(SeededSource(seed)).Generate(DefaultKeyLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// About half of the qubits survive sifting.
+		if len(key) < DefaultKeyLength/2-32 || len(key) > DefaultKeyLength/2+32 {
+			t.Errorf("seed %d: sifted %d of %d qubits", seed, len(key), DefaultKeyLength)
+		}
+		again, _ := NewEngine(SeededSource(seed)).Generate(DefaultKeyLength)
+		if !key.Equal(again) {
+			t.Errorf("seed %d: keys differ between runs", seed)
+		}
+	}
+	a, _ := NewEngine(SeededSource(1)).Generate(DefaultKeyLength)
+	b, _ := NewEngine(SeededSource(2)).Generate(DefaultKeyLength)
+	if a.Equal(b) {
+		t.Error("seeds 1 and 2 gave the same key")
+	}
+}
+
+func TestGenerateRejectsLength(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if _, err := NewEngine(SeededSource(1)).Generate(n); err == nil {
+			t.Errorf("generated a key of %d qubits", n)
+		}
+	}
+}
+
+// TestSiftSeeded checks that Bob's sifted bits agree with Alice's, and are
+// the bits at the positions where their bases agree.
+func TestSiftSeeded(t *testing.T) {
+	e := NewEngine(SeededSource(7))
+	qubits, aliceBits, aliceBases := e.Prepare(1024)
+	bobBits, bobBases := e.Receive(qubits)
+	aliceKey, err := Sift(aliceBits, aliceBases, bobBases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey, err := Sift(bobBits, aliceBases, bobBases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aliceKey.Equal(bobKey) {
+		t.Fatal("sifted keys disagree without noise")
+	}
+	var want Key
+	for i := range qubits {
+		if aliceBases[i] == bobBases[i] {
+			want = append(want, aliceBits[i])
+		}
+	}
+	if !aliceKey.Equal(want) {
+		t.Fatal("sifting kept bits measured in different bases")
+	}
+}
+
+func TestSift(t *testing.T) {
+	bits := Key{1, 0, 1, 1}
+	key, err := Sift(bits, []Basis{Rectilinear, Diagonal, Diagonal, Rectilinear}, []Basis{Rectilinear, Rectilinear, Diagonal, Diagonal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(Key{1, 1}) {
+		t.Fatalf("got %s, want 11", key)
+	}
+	if _, err := Sift(bits, []Basis{Rectilinear}, []Basis{Rectilinear}); err == nil {
+		t.Error("sifted bits with too few bases")
+	}
+	if _, err := Sift(Key{1}, []Basis{Rectilinear}, []Basis{Diagonal}); !errors.Is(err, ErrKeyTooShort) {
+		t.Errorf("got %v, want ErrKeyTooShort", err)
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	rng := SeededSource(3)
+	ones := 0
+	for i := 0; i < 1000; i++ {
+		q := Qubit{Bit: uint8(i % 2), Basis: Diagonal}
+		if Measure(q, Diagonal, rng) != q.Bit {
+			t.Fatal("measuring in the preparation basis changed the bit")
+		}
+		ones += int(Measure(Qubit{Bit: 0, Basis: Rectilinear}, Diagonal, rng))
+	}
+	if ones < 400 || ones > 600 {
+		t.Errorf("measuring in the conjugate basis gave %d ones in 1000", ones)
+	}
+}
+
+// TestRandomSources checks that both sources give balanced bits, and that a
+// seeded source repeats itself.
+func TestRandomSources(t *testing.T) {
+	for name, rng := range map[string]RandomSource{"crypto": CryptoSource(), "seeded": SeededSource(1)} {
+		ones := 0
+		for _, bit := range randomKey(rng, 8000) {
+			ones += int(bit)
+		}
+		if ones < 3700 || ones > 4300 {
+			t.Errorf("%s: %d ones in 8000 bits", name, ones)
+		}
+	}
+	if !randomKey(SeededSource(9), 256).Equal(randomKey(SeededSource(9), 256)) {
+		t.Error("seeded sources with the same seed differ")
+	}
+}
+
+func TestBasesRoundTrip(t *testing.T) {
+	bases := RandomBases(77, SeededSource(5))
+	parsed, err := ParseBases(FormatBases(bases))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked, err := UnpackBases(PackBases(bases), len(bases))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range bases {
+		if parsed[i] != bases[i] || unpacked[i] != bases[i] {
+			t.Fatalf("basis %d changed", i)
+		}
+	}
+	if _, err := ParseBases("ZXY"); err == nil {
+		t.Error("parsed basis Y")
+	}
+}
@@ -0,0 +1,204 @@
+package qkd
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultCascadePasses is the number of Cascade passes. Four passes leave a
+// negligible number of errors at the QBERs a link exchange accepts.
+const DefaultCascadePasses = 4
+
+// ErrReconcile is returned when reconciliation fails: the other side's
+// parities are inconsistent, or a query is out of range.
+var ErrReconcile = errors.New("qkd: reconciliation failed")
+
+// ParityOracle returns the other side's parity of its key bits at each set of
+// positions. Every parity it discloses leaks one bit of the key to an
+// eavesdropper. One call is one round trip between the two sides, so Cascade
+// batches all the queries it can.
+type ParityOracle func(sets [][]int) ([]uint8, error)
+
+// Parities answers Cascade's parity queries against k. It is the reference
+// side's ParityOracle.
+func (k Key) Parities(sets [][]int) ([]uint8, error) {
+	out := make([]uint8, len(sets))
+	for i, set := range sets {
+		for _, pos := range set {
+			if pos < 0 || pos >= len(k) {
+				return nil, fmt.Errorf("%w: position %d of a %d-bit key", ErrReconcile, pos, len(k))
+			}
+			out[i] ^= k[pos]
+		}
+	}
+	return out, nil
+}
+
+// parity returns the parity of k's bits at positions.
+func (k Key) parity(positions []int) uint8 {
+	var p uint8
+	for _, pos := range positions {
+		p ^= k[pos]
+	}
+	return p
+}
+
+// Cascade reconciles a key with the other side's by the Cascade protocol: in
+// each pass the key is shuffled and cut into blocks whose parities are
+// compared; a block that disagrees has an odd number of errors, one of which
+// is found by bisection and corrected. Correcting a bit changes the parity of
+// the blocks holding it in earlier passes, which are bisected in turn. Block
+// sizes start at about 0.73/QBER and double with each pass.
+//
+// Only the correcting side needs a Cascade; the shuffles are carried in the
+// queries it sends.
+type Cascade struct {
+	Passes int
+	// Rand shuffles the key between passes.
+	Rand RandomSource
+}
+
+// NewCascade returns a Cascade of DefaultCascadePasses passes. A nil rng
+// selects the cryptographically secure default source.
+func NewCascade(rng RandomSource) *Cascade {
+	if rng == nil {
+		rng = CryptoSource()
+	}
+	return &Cascade{Passes: DefaultCascadePasses, Rand: rng}
+}
+
+// cascadeBlock is a block of key positions and the other side's parity of it.
+type cascadeBlock struct {
+	positions []int
+	parity    uint8
+}
+
+// Reconcile corrects key towards the other side's, given the estimated QBER,
+// and returns the corrected key, the number of parity bits disclosed and the
+// number of bits corrected. key is not modified.
+func (c *Cascade) Reconcile(key Key, qber float64, ask ParityOracle) (Key, int, int, error) {
+	key = append(Key(nil), key...)
+	if len(key) == 0 {
+		return key, 0, 0, nil
+	}
+	// Sampled QBERs of zero are common on short keys; assume at least 1%.
+	if qber < 0.01 {
+		qber = 0.01
+	}
+	size := int(0.73/qber + 0.5)
+	if size < 2 {
+		size = 2
+	}
+
+	leaked, corrected := 0, 0
+	var passes [][]cascadeBlock
+	for p := 0; p < c.Passes; p++ {
+		order := make([]int, len(key))
+		for i := range order {
+			order[i] = i
+		}
+		if p > 0 {
+			for i := len(order) - 1; i > 0; i-- {
+				j := Intn(c.Rand, i+1)
+				order[i], order[j] = order[j], order[i]
+			}
+		}
+		var sets [][]int
+		for start := 0; start < len(order); start += size {
+			end := start + size
+			if end > len(order) {
+				end = len(order)
+			}
+			sets = append(sets, order[start:end])
+		}
+		parities, err := ask(sets)
+		if err != nil {
+			return nil, leaked, corrected, err
+		}
+		if len(parities) != len(sets) {
+			return nil, leaked, corrected, fmt.Errorf("%w: %d parities for %d blocks", ErrReconcile, len(parities), len(sets))
+		}
+		leaked += len(sets)
+		blocks := make([]cascadeBlock, len(sets))
+		for i := range sets {
+			blocks[i] = cascadeBlock{positions: sets[i], parity: parities[i]}
+		}
+		passes = append(passes, blocks)
+
+		// Bisect the disagreeing blocks of one pass at a time: blocks of the
+		// same pass are disjoint, so their bisections do not interfere.
+		for {
+			var odd [][]int
+			for _, blocks := range passes {
+				for _, b := range blocks {
+					if key.parity(b.positions) != b.parity {
+						odd = append(odd, b.positions)
+					}
+				}
+				if len(odd) > 0 {
+					break
+				}
+			}
+			if len(odd) == 0 {
+				break
+			}
+			errs, n, err := bisect(key, odd, ask)
+			leaked += n
+			if err != nil {
+				return nil, leaked, corrected, err
+			}
+			for _, pos := range errs {
+				key[pos] ^= 1
+			}
+			corrected += len(errs)
+			// Each correction fixes an error, so there can be no more of
+			// them than bits; more means the parities were inconsistent.
+			if corrected > len(key) {
+				return nil, leaked, corrected, fmt.Errorf("%w: parities do not converge", ErrReconcile)
+			}
+		}
+		size *= 2
+	}
+	return key, leaked, corrected, nil
+}
+
+// bisect finds one error in each of the disjoint blocks, each of which has an
+// odd number of errors, halving all of them in step. It returns the positions
+// of the errors and the number of parities disclosed.
+func bisect(key Key, blocks [][]int, ask ParityOracle) ([]int, int, error) {
+	leaked := 0
+	for {
+		var sets [][]int
+		var open []int
+		for i, b := range blocks {
+			if len(b) > 1 {
+				sets = append(sets, b[:len(b)/2])
+				open = append(open, i)
+			}
+		}
+		if len(sets) == 0 {
+			break
+		}
+		parities, err := ask(sets)
+		if err != nil {
+			return nil, leaked, err
+		}
+		if len(parities) != len(sets) {
+			return nil, leaked, fmt.Errorf("%w: %d parities for %d blocks", ErrReconcile, len(parities), len(sets))
+		}
+		leaked += len(sets)
+		for j, i := range open {
+			half := len(blocks[i]) / 2
+			if key.parity(blocks[i][:half]) != parities[j] {
+				blocks[i] = blocks[i][:half]
+			} else {
+				blocks[i] = blocks[i][half:]
+			}
+		}
+	}
+	errs := make([]int, len(blocks))
+	for i, b := range blocks {
+		errs[i] = b[0]
+	}
+	return errs, leaked, nil
+}
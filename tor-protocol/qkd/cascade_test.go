@@ -0,0 +1,113 @@
+package qkd
+
+import (
+	"errors"
+	"testing"
+)
+
+// noisyPair returns a random n-bit reference key and a copy of it sent
+// through a seeded noise channel of the given rate, and the number of bits
+// the channel flipped.
+func noisyPair(t *testing.T, n int, rate float64, seed int64) (Key, Key, int) {
+	t.Helper()
+	rng := SeededSource(seed)
+	qubits := make([]Qubit, n)
+	ref := make(Key, n)
+	for i := range qubits {
+		ref[i] = rng.Bit()
+		qubits[i] = Qubit{Bit: ref[i], Basis: Basis(rng.Bit())}
+	}
+	received, flipped := NewNoise(rate, rng).Apply(qubits)
+	noisy := make(Key, n)
+	for i, q := range received {
+		noisy[i] = q.Bit
+	}
+	return ref, noisy, flipped
+}
+
+func TestCascadeCorrectsSeededNoise(t *testing.T) {
+	for _, rate := range []float64{0, 0.01, 0.03, 0.05, 0.08} {
+		for seed := int64(1); seed <= 5; seed++ {
+			ref, noisy, flipped := noisyPair(t, 4096, rate, seed)
+			got, leaked, corrected, err := NewCascade(SeededSource(seed)).Reconcile(noisy, rate, ref.Parities)
+			if err != nil {
+				t.Fatalf("rate %.2f seed %d: %v", rate, seed, err)
+			}
+			if !got.Equal(ref) {
+				t.Fatalf("rate %.2f seed %d: %d errors left", rate, seed, distance(got, ref))
+			}
+			if corrected != flipped {
+				t.Errorf("rate %.2f seed %d: corrected %d bits, the channel flipped %d", rate, seed, corrected, flipped)
+			}
+			// Cascade should disclose little more than the Shannon limit.
+			if limit := 4096 * BinaryEntropy(rate); rate > 0 && float64(leaked) > 2*limit {
+				t.Errorf("rate %.2f seed %d: leaked %d parities, more than twice the %.0f-bit limit", rate, seed, leaked, limit)
+			}
+		}
+	}
+}
+
+func TestCascadeDoesNotModifyKey(t *testing.T) {
+	ref, noisy, _ := noisyPair(t, 1024, 0.05, 7)
+	before := append(Key(nil), noisy...)
+	if _, _, _, err := NewCascade(SeededSource(7)).Reconcile(noisy, 0.05, ref.Parities); err != nil {
+		t.Fatal(err)
+	}
+	if !noisy.Equal(before) {
+		t.Fatal("Reconcile modified its input")
+	}
+}
+
+func TestCascadeIsReproducible(t *testing.T) {
+	ref, noisy, _ := noisyPair(t, 2048, 0.04, 3)
+	_, a, _, _ := NewCascade(SeededSource(11)).Reconcile(noisy, 0.04, ref.Parities)
+	_, b, _, _ := NewCascade(SeededSource(11)).Reconcile(noisy, 0.04, ref.Parities)
+	if a != b {
+		t.Fatalf("the same seed leaked %d and %d parities", a, b)
+	}
+}
+
+func TestCascadeRejectsBadOracle(t *testing.T) {
+	ref, noisy, _ := noisyPair(t, 512, 0.05, 5)
+	short := func(sets [][]int) ([]uint8, error) {
+		p, err := ref.Parities(sets)
+		return p[:len(p)-1], err
+	}
+	if _, _, _, err := NewCascade(SeededSource(5)).Reconcile(noisy, 0.05, short); !errors.Is(err, ErrReconcile) {
+		t.Errorf("missing parities: got %v, want ErrReconcile", err)
+	}
+
+	// An oracle that disagrees with every parity can never be satisfied.
+	liar := func(sets [][]int) ([]uint8, error) {
+		p, err := noisy.Parities(sets)
+		for i := range p {
+			p[i] ^= 1
+		}
+		return p, err
+	}
+	if _, _, _, err := NewCascade(SeededSource(5)).Reconcile(noisy, 0.05, liar); !errors.Is(err, ErrReconcile) {
+		t.Errorf("inconsistent parities: got %v, want ErrReconcile", err)
+	}
+
+	failed := errors.New("link down")
+	down := func([][]int) ([]uint8, error) { return nil, failed }
+	if _, _, _, err := NewCascade(SeededSource(5)).Reconcile(noisy, 0.05, down); !errors.Is(err, failed) {
+		t.Errorf("failing oracle: got %v", err)
+	}
+}
+
+func TestParitiesRejectsOutOfRange(t *testing.T) {
+	if _, err := (Key{1, 0, 1}).Parities([][]int{{0, 3}}); !errors.Is(err, ErrReconcile) {
+		t.Fatalf("got %v, want ErrReconcile", err)
+	}
+}
+
+func distance(a, b Key) int {
+	d := 0
+	for i := range a {
+		if a[i] != b[i] {
+			d++
+		}
+	}
+	return d
+}
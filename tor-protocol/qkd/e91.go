@@ -0,0 +1,241 @@
+package qkd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protocols a link key exchange can run.
+const (
+	ProtocolBB84 = "bb84"
+	ProtocolE91  = "e91"
+)
+
+// ErrUnknownProtocol is returned for an unsupported key exchange protocol.
+var ErrUnknownProtocol = errors.New("qkd: unknown protocol")
+
+// In E91 a source emits pairs of spins in the singlet state and Alice and Bob
+// each measure one half along one of three directions, in the plane, chosen
+// at random. Directions are Bloch-sphere angles in units of π/4:
+//
+//	Alice: 0, π/4, π/2
+//	Bob:   π/4, π/2, 3π/4
+//
+// Where they measure along the same direction (Alice's settings 1 and 2 with
+// Bob's 0 and 1) their outcomes are opposite, and become key bits. Where
+// Alice measures along 0 or π/2 and Bob along π/4 or 3π/4, their outcomes
+// give the CHSH value S, which is 2√2 for singlets and at most 2 once an
+// eavesdropper has measured either half. The other pairs are discarded.
+var (
+	e91Alice = [3]uint8{0, 1, 2}
+	e91Bob   = [3]uint8{1, 2, 3}
+)
+
+// E91Settings is the number of measurement settings of each side.
+const E91Settings = 3
+
+// DefaultCHSHThreshold is the |S| below which an E91 exchange is aborted:
+// halfway between the classical bound 2 and the quantum bound 2√2.
+const DefaultCHSHThreshold = 1 + math.Sqrt2
+
+// Particle is Bob's half of an entangled pair once Alice has measured hers,
+// which leaves it a spin pointing along Spin, in units of π/4 (0–7).
+type Particle struct {
+	Spin uint8
+}
+
+// measureSpin measures a spin along direction angle (both in units of π/4)
+// and returns 0 for up and 1 for down.
+func measureSpin(spin, angle uint8, rng RandomSource) uint8 {
+	up := (1 + math.Cos(float64(int(spin)-int(angle))*math.Pi/4)) / 2
+	if Uniform(rng) < up {
+		return 0
+	}
+	return 1
+}
+
+// E91 runs simulated E91 exchanges.
+type E91 struct {
+	Rand RandomSource
+}
+
+// NewE91 returns an E91 drawing randomness from rng. A nil rng selects the
+// cryptographically secure default source.
+func NewE91(rng RandomSource) *E91 {
+	if rng == nil {
+		rng = CryptoSource()
+	}
+	return &E91{Rand: rng}
+}
+
+// Emit is Alice's side of an exchange: she measures her halves of n singlet
+// pairs with random settings, and returns Bob's halves along with her
+// settings and outcomes. Her outcome is uniformly random, and Bob's half is
+// left pointing opposite to it.
+func (e *E91) Emit(n int) (particles []Particle, settings []uint8, outcomes Key) {
+	particles = make([]Particle, n)
+	settings = make([]uint8, n)
+	outcomes = make(Key, n)
+	for i := range particles {
+		settings[i] = uint8(Intn(e.Rand, E91Settings))
+		outcomes[i] = e.Rand.Bit()
+		angle := e91Alice[settings[i]]
+		if outcomes[i] == 0 {
+			angle += 4
+		}
+		particles[i] = Particle{Spin: angle % 8}
+	}
+	return particles, settings, outcomes
+}
+
+// Measure is Bob's side of an exchange: every particle is measured with a
+// randomly chosen setting. The settings are announced to Alice for sifting.
+func (e *E91) Measure(particles []Particle) (settings []uint8, outcomes Key) {
+	settings = make([]uint8, len(particles))
+	outcomes = make(Key, len(particles))
+	for i, p := range particles {
+		settings[i] = uint8(Intn(e.Rand, E91Settings))
+		outcomes[i] = measureSpin(p.Spin, e91Bob[settings[i]], e.Rand)
+	}
+	return settings, outcomes
+}
+
+// SiftE91 returns the positions of the key pairs, where Alice and Bob measured
+// along the same direction, and of the test pairs used for the CHSH value.
+func SiftE91(aliceSettings, bobSettings []uint8) (keys, tests []int, err error) {
+	if len(aliceSettings) != len(bobSettings) {
+		return nil, nil, fmt.Errorf("qkd: sift length mismatch: %d/%d settings", len(aliceSettings), len(bobSettings))
+	}
+	for i := range aliceSettings {
+		a, b := aliceSettings[i], bobSettings[i]
+		if a >= E91Settings || b >= E91Settings {
+			return nil, nil, fmt.Errorf("qkd: invalid E91 setting at %d", i)
+		}
+		switch {
+		case e91Alice[a] == e91Bob[b]:
+			keys = append(keys, i)
+		case a != 1 && b != 1:
+			tests = append(tests, i)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, ErrKeyTooShort
+	}
+	return keys, tests, nil
+}
+
+// PickSettings returns the E91 settings at positions.
+func PickSettings(settings []uint8, positions []int) []uint8 {
+	out := make([]uint8, len(positions))
+	for i, pos := range positions {
+		out[i] = settings[pos]
+	}
+	return out
+}
+
+// E91Key returns the key bits of the pairs at positions keys. Bob's outcomes
+// are opposite to Alice's, so he inverts his.
+func E91Key(outcomes Key, keys []int, bob bool) Key {
+	key := outcomes.Pick(keys)
+	if bob {
+		for i := range key {
+			key[i] ^= 1
+		}
+	}
+	return key
+}
+
+// CHSH returns the CHSH value
+//
+//	S = E(0, π/4) − E(0, 3π/4) + E(π/2, π/4) + E(π/2, 3π/4)
+//
+// of the test pairs, where E is the mean product of Alice's and Bob's
+// outcomes (as ±1) over the pairs measured along the given directions.
+func CHSH(aliceSettings, bobSettings []uint8, aliceOutcomes, bobOutcomes Key) (float64, error) {
+	if len(aliceSettings) != len(bobSettings) || len(aliceSettings) != len(aliceOutcomes) || len(aliceOutcomes) != len(bobOutcomes) {
+		return 0, errors.New("qkd: CHSH inputs of different lengths")
+	}
+	var sum, count [E91Settings][E91Settings]float64
+	for i := range aliceSettings {
+		a, b := aliceSettings[i], bobSettings[i]
+		if a >= E91Settings || b >= E91Settings {
+			return 0, fmt.Errorf("qkd: invalid E91 setting at %d", i)
+		}
+		product := 1.0
+		if aliceOutcomes[i] != bobOutcomes[i] {
+			product = -1
+		}
+		sum[a][b] += product
+		count[a][b]++
+	}
+	corr := func(a, b int) float64 {
+		if count[a][b] == 0 {
+			return 0
+		}
+		return sum[a][b] / count[a][b]
+	}
+	return corr(0, 0) - corr(0, 2) + corr(2, 0) + corr(2, 2), nil
+}
+
+// CHSHError is returned when the CHSH value of an E91 exchange falls below
+// the threshold: the pairs are no longer entangled, as they are once an
+// eavesdropper has measured them.
+type CHSHError struct {
+	S         float64
+	Threshold float64
+	Pairs     int // number of test pairs
+}
+
+func (e *CHSHError) Error() string {
+	return fmt.Sprintf("qkd: CHSH |S| = %.2f over %d pairs is below %.2f, aborting", math.Abs(e.S), e.Pairs, e.Threshold)
+}
+
+// Is reports that a CHSHError matches ErrEavesdropping.
+func (e *CHSHError) Is(target error) bool {
+	return target == ErrEavesdropping
+}
+
+// CheckCHSH returns a *CHSHError if |s|, measured over pairs test pairs, is
+// below threshold.
+func CheckCHSH(s, threshold float64, pairs int) error {
+	if math.Abs(s) < threshold {
+		return &CHSHError{S: s, Threshold: threshold, Pairs: pairs}
+	}
+	return nil
+}
+
+// InterceptParticles is intercept-resend on E91 particles: Eve measures each
+// particle she intercepts along a random one of Alice's and Bob's directions
+// and sends Bob a fresh spin along her result, which breaks the entanglement.
+func (e *Eve) InterceptParticles(particles []Particle) ([]Particle, int) {
+	out := make([]Particle, len(particles))
+	intercepted := 0
+	for i, p := range particles {
+		if e.Rate <= 0 || Uniform(e.Rand) >= e.Rate {
+			out[i] = p
+			continue
+		}
+		angle := uint8(Intn(e.Rand, 4))
+		if measureSpin(p.Spin, angle, e.Rand) == 1 {
+			angle += 4
+		}
+		out[i] = Particle{Spin: angle}
+		intercepted++
+	}
+	return out, intercepted
+}
+
+// ApplyParticles flips the given fraction of E91 particles.
+func (ch *Noise) ApplyParticles(particles []Particle) ([]Particle, int) {
+	out := make([]Particle, len(particles))
+	flipped := 0
+	for i, p := range particles {
+		out[i] = p
+		if ch.Rate > 0 && Uniform(ch.Rand) < ch.Rate {
+			out[i].Spin = (p.Spin + 4) % 8
+			flipped++
+		}
+	}
+	return out, flipped
+}
@@ -0,0 +1,85 @@
+package qkd
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// runE91 runs an E91 exchange of n pairs, with an Eve intercepting rate of
+// them, and returns the CHSH value of the test pairs, their number and both
+// sides' keys.
+func runE91(t *testing.T, n int, rate float64, seed int64) (float64, int, Key, Key) {
+	t.Helper()
+	rng := SeededSource(seed)
+	e := NewE91(rng)
+	particles, aliceSettings, aliceOutcomes := e.Emit(n)
+	particles, _ = NewEve(rate, rng).InterceptParticles(particles)
+	bobSettings, bobOutcomes := e.Measure(particles)
+	keys, tests, err := SiftE91(aliceSettings, bobSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CHSH(PickSettings(aliceSettings, tests), PickSettings(bobSettings, tests), aliceOutcomes.Pick(tests), bobOutcomes.Pick(tests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, len(tests), E91Key(aliceOutcomes, keys, false), E91Key(bobOutcomes, keys, true)
+}
+
+// TestCHSHHonest checks that singlet pairs reach the quantum bound 2√2 and
+// give Alice and Bob the same key.
+func TestCHSHHonest(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		s, pairs, alice, bob := runE91(t, 20000, 0, seed)
+		if math.Abs(math.Abs(s)-2*math.Sqrt2) > 0.15 {
+			t.Errorf("seed %d: |S| = %.3f, want about 2√2", seed, math.Abs(s))
+		}
+		if err := CheckCHSH(s, DefaultCHSHThreshold, pairs); err != nil {
+			t.Errorf("seed %d: %v", seed, err)
+		}
+		if !alice.Equal(bob) {
+			t.Errorf("seed %d: keys differ without Eve", seed)
+		}
+	}
+}
+
+// TestCHSHEavesdropped checks that once Eve has measured every pair, |S| is
+// no more than the classical bound 2 and the exchange aborts.
+func TestCHSHEavesdropped(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		s, pairs, _, _ := runE91(t, 20000, 1, seed)
+		if math.Abs(s) > 2+0.1 {
+			t.Errorf("seed %d: |S| = %.3f with Eve on every pair, want at most 2", seed, math.Abs(s))
+		}
+		err := CheckCHSH(s, DefaultCHSHThreshold, pairs)
+		var cerr *CHSHError
+		if !errors.As(err, &cerr) || !errors.Is(err, ErrEavesdropping) {
+			t.Fatalf("seed %d: got %v, want a *CHSHError", seed, err)
+		}
+		if cerr.S != s || cerr.Pairs != pairs {
+			t.Errorf("seed %d: error %+v does not describe the check", seed, cerr)
+		}
+	}
+}
+
+func TestSiftE91(t *testing.T) {
+	// Alice's settings 1 and 2 meet Bob's 0 and 1; settings 0 and 2 of
+	// each test CHSH.
+	keys, tests, err := SiftE91([]uint8{1, 2, 0, 2, 0, 1}, []uint8{0, 1, 0, 2, 1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != 0 || keys[1] != 1 {
+		t.Errorf("key pairs %v, want [0 1]", keys)
+	}
+	if len(tests) != 2 || tests[0] != 2 || tests[1] != 3 {
+		t.Errorf("test pairs %v, want [2 3]", tests)
+	}
+	if _, _, err := SiftE91([]uint8{3}, []uint8{0}); err == nil {
+		t.Error("sifted setting 3")
+	}
+	if _, _, err := SiftE91([]uint8{0}, []uint8{0}); !errors.Is(err, ErrKeyTooShort) {
+		t.Errorf("got %v, want ErrKeyTooShort", err)
+	}
+}
@@ -0,0 +1,66 @@
+package qkd
+
+// Eve is an intercept-resend eavesdropper on the quantum channel. She
+// measures each qubit she intercepts in a random basis and sends Bob a fresh
+// qubit prepared in her basis with her result. Whenever her basis differs
+// from Alice's, Bob's result is random even where his basis matches Alice's,
+// so intercepting every qubit raises the QBER of the sifted key to 25%.
+type Eve struct {
+	// Rate is the fraction of qubits intercepted, from 0 to 1.
+	Rate float64
+	Rand RandomSource
+}
+
+// NewEve returns an Eve intercepting the given fraction of qubits. A nil rng
+// selects the cryptographically secure default source.
+func NewEve(rate float64, rng RandomSource) *Eve {
+	if rng == nil {
+		rng = CryptoSource()
+	}
+	return &Eve{Rate: rate, Rand: rng}
+}
+
+// Intercept returns the qubits that reach Bob and the number Eve intercepted.
+func (e *Eve) Intercept(qubits []Qubit) ([]Qubit, int) {
+	out := make([]Qubit, len(qubits))
+	intercepted := 0
+	for i, q := range qubits {
+		if e.Rate <= 0 || Uniform(e.Rand) >= e.Rate {
+			out[i] = q
+			continue
+		}
+		basis := Basis(e.Rand.Bit())
+		out[i] = Qubit{Bit: Measure(q, basis, e.Rand), Basis: basis}
+		intercepted++
+	}
+	return out, intercepted
+}
+
+// Uniform draws a float64 uniformly from [0, 1).
+func Uniform(rng RandomSource) float64 {
+	var v uint64
+	for i := 0; i < 53; i++ {
+		v = v<<1 | uint64(rng.Bit())
+	}
+	return float64(v) / (1 << 53)
+}
+
+// Intn draws an int uniformly from [0, n).
+func Intn(rng RandomSource, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	bits := 0
+	for 1<<bits < n {
+		bits++
+	}
+	for {
+		v := 0
+		for i := 0; i < bits; i++ {
+			v = v<<1 | int(rng.Bit())
+		}
+		if v < n {
+			return v
+		}
+	}
+}
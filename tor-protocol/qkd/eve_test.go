@@ -0,0 +1,64 @@
+package qkd
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// exchangeQBER runs a BB84 exchange of n qubits through an Eve intercepting
+// rate of them, and returns the QBER of a sample of a quarter of the sifted
+// key and CheckQBER's verdict on it.
+func exchangeQBER(n int, rate float64, seed int64) (float64, error) {
+	rng := SeededSource(seed)
+	e := NewEngine(rng)
+	qubits, aliceBits, aliceBases := e.Prepare(n)
+	qubits, _ = NewEve(rate, rng).Intercept(qubits)
+	bobBits, bobBases := e.Receive(qubits)
+	alice, _ := Sift(aliceBits, aliceBases, bobBases)
+	bob, _ := Sift(bobBits, aliceBases, bobBases)
+	sample := ChooseSample(len(alice), SampleSize(len(alice), 0.25), rng)
+	return CheckQBER(alice.Pick(sample), bob.Pick(sample), DefaultQBERThreshold)
+}
+
+// TestEveRaisesQBER checks that an intercept-resend Eve on every qubit raises
+// the QBER to about 25% and aborts the exchange with a *QBERError.
+func TestEveRaisesQBER(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		qber, err := exchangeQBER(8192, 1, seed)
+		if math.Abs(qber-0.25) > 0.04 {
+			t.Errorf("seed %d: QBER %.3f with Eve on every qubit, want about 0.25", seed, qber)
+		}
+		var qerr *QBERError
+		if !errors.As(err, &qerr) || !errors.Is(err, ErrEavesdropping) {
+			t.Fatalf("seed %d: got %v, want a *QBERError", seed, err)
+		}
+		if qerr.QBER != qber || qerr.Threshold != DefaultQBERThreshold || qerr.Sample == 0 {
+			t.Errorf("seed %d: error %+v does not describe the check", seed, qerr)
+		}
+	}
+}
+
+func TestQBERWithoutEve(t *testing.T) {
+	for _, rate := range []float64{0, 0.1} {
+		qber, err := exchangeQBER(8192, rate, 1)
+		if err != nil {
+			t.Errorf("Eve on %.0f%% of the qubits: %v", 100*rate, err)
+		}
+		if want := rate / 4; math.Abs(qber-want) > 0.03 {
+			t.Errorf("Eve on %.0f%% of the qubits: QBER %.3f, want about %.3f", 100*rate, qber, want)
+		}
+	}
+}
+
+func TestCheckQBER(t *testing.T) {
+	if qber, err := CheckQBER(Key{0, 1, 1, 0}, Key{0, 1, 0, 0}, 0.25); err != nil || qber != 0.25 {
+		t.Errorf("got %v, %v at the threshold", qber, err)
+	}
+	if _, err := CheckQBER(Key{0, 1, 1, 0}, Key{1, 1, 0, 0}, 0.25); !errors.Is(err, ErrEavesdropping) {
+		t.Errorf("got %v above the threshold", err)
+	}
+	if _, err := CheckQBER(Key{0}, Key{0, 1}, 0.25); err == nil || errors.Is(err, ErrEavesdropping) {
+		t.Errorf("got %v for samples of different lengths", err)
+	}
+}
@@ -0,0 +1,134 @@
+package qkd
+
+import (
+	"crypto/hmac"
+	"crypto/mlkem"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// HandshakeMode selects the secrets a circuit handshake combines into a layer
+// key. It is the first byte of CREATE and CREATED, and is bound into the key.
+type HandshakeMode uint8
+
+const (
+	// ModeQKD derives the layer key from the BB84 exchange alone.
+	ModeQKD HandshakeMode = 1
+	// ModeHybrid also runs an ML-KEM-768 encapsulation, so that the layer
+	// key stays secret unless both the QKD exchange and ML-KEM are broken.
+	ModeHybrid HandshakeMode = 2
+)
+
+// LayerKeyBits is the size of the layer keys derived by CombineKeys.
+const LayerKeyBits = 256
+
+// ConfirmTagSize is the size of a handshake confirmation tag.
+const ConfirmTagSize = sha256.Size
+
+var (
+	// ErrDowngrade is returned when a handshake is answered in, or offered
+	// in, a weaker mode than required.
+	ErrDowngrade = errors.New("qkd: handshake downgrade refused")
+	// ErrConfirm is returned when a handshake's confirmation tag does not
+	// match: the two sides derived different keys from what they saw.
+	ErrConfirm = errors.New("qkd: handshake confirmation failed")
+	// ErrUnknownMode is returned for an unsupported HandshakeMode.
+	ErrUnknownMode = errors.New("qkd: unknown handshake mode")
+)
+
+// ParseHandshakeMode parses "qkd" or "hybrid".
+func ParseHandshakeMode(s string) (HandshakeMode, error) {
+	switch s {
+	case "qkd":
+		return ModeQKD, nil
+	case "hybrid":
+		return ModeHybrid, nil
+	}
+	return 0, fmt.Errorf("%w %q", ErrUnknownMode, s)
+}
+
+// String returns the mode's name.
+func (m HandshakeMode) String() string {
+	switch m {
+	case ModeQKD:
+		return "qkd"
+	case ModeHybrid:
+		return "hybrid"
+	}
+	return fmt.Sprintf("HandshakeMode(%d)", uint8(m))
+}
+
+// KEMSizes returns the sizes of the ML-KEM encapsulation key and ciphertext a
+// handshake in mode m carries: zero for ModeQKD.
+func (m HandshakeMode) KEMSizes() (encapsulationKey, ciphertext int) {
+	if m == ModeHybrid {
+		return mlkem.EncapsulationKeySize768, mlkem.CiphertextSize768
+	}
+	return 0, 0
+}
+
+// CombineKeys derives a layer key and a confirmation key from the sifted QKD
+// key and, in ModeHybrid, the ML-KEM shared secret. The input key material
+// is
+//
+//	mode (1) | QKD key length in bits (2) | QKD key, packed | ML-KEM shared secret
+//
+// expanded with HKDF-SHA256 salted with the SHA-256 of transcript, the
+// handshake messages as both sides saw them. A side that was sent a
+// different mode or handshake derives different keys, which the confirmation
+// tag exposes.
+func CombineKeys(mode HandshakeMode, qkdKey Key, kemShared, transcript []byte) (Key, []byte, error) {
+	if len(qkdKey) == 0 {
+		return nil, nil, ErrEmptyKey
+	}
+	switch mode {
+	case ModeQKD:
+		if len(kemShared) != 0 {
+			return nil, nil, fmt.Errorf("qkd: %s handshake with an ML-KEM secret", mode)
+		}
+	case ModeHybrid:
+		if len(kemShared) != mlkem.SharedKeySize {
+			return nil, nil, fmt.Errorf("qkd: ML-KEM secret of %d bytes", len(kemShared))
+		}
+	default:
+		return nil, nil, fmt.Errorf("%w %d", ErrUnknownMode, mode)
+	}
+
+	ikm := []byte{byte(mode)}
+	ikm = binary.BigEndian.AppendUint16(ikm, uint16(len(qkdKey)))
+	ikm = append(ikm, qkdKey.Bytes()...)
+	ikm = append(ikm, kemShared...)
+	salt := sha256.Sum256(transcript)
+
+	out := make([]byte, LayerKeyBits/8+ConfirmTagSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt[:], []byte("quaitor hybrid handshake")), out); err != nil {
+		return nil, nil, err
+	}
+	key, err := UnpackKey(out[:LayerKeyBits/8], LayerKeyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, out[LayerKeyBits/8:], nil
+}
+
+// ConfirmTag returns the tag with which the answering side of a handshake
+// proves it derived the same keys from the same transcript.
+func ConfirmTag(confirmKey, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, confirmKey)
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+// CheckConfirmTag returns ErrConfirm unless tag is the confirmation tag of
+// transcript.
+func CheckConfirmTag(confirmKey, transcript, tag []byte) error {
+	if !hmac.Equal(tag, ConfirmTag(confirmKey, transcript)) {
+		return ErrConfirm
+	}
+	return nil
+}
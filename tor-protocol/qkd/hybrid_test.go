@@ -0,0 +1,145 @@
+package qkd
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// Known-answer vectors for the hybrid handshake. The ML-KEM vector
+// decapsulates a ciphertext under the decapsulation key generated from the
+// seed 00 01 02 ... 3f; the combiner vectors derive layer keys and
+// confirmation tags from its shared secret and a fixed QKD key and
+// transcript. Other implementations of the handshake can check against them
+// too.
+const (
+	hybridVectorEKHash     = "0b7934c83125c788995e2ba6bd761e33046b3e40571be53e023309a29f398cc9"
+	hybridVectorCiphertext = "fd8aa0de8e0a2311625d022c4de5c9b6730d772a98295b8b1dd1b7f9286e2ab5a90decd644f62888bb2408405f4f2eb1" +
+		"af5b1bfcaa0a5f787f13ce0b5a2d0a8804a524c208de62f1834a724586c8c2efb7fcd40db16eac0ef4f8d977a57745a5" +
+		"a9ce5724582f6676a64cfbfae1ce32143dea3ac3ba498da7c97b5cf80a8ecbda47f4a7407100a6c2b0c5e27bf51ccbab" +
+		"d2a324935001947c9fc58f1076037c3f13cab569a2e7effe04d05533469fc615faea84241178002cf7ed55e61db5cca5" +
+		"34947957fba60583facd1124b488f8ae997908a74bb26637e582e840701613f44956f2b63bfd0fa13e2dc34ebe1252dc" +
+		"11f2a80d66e43d5c8bd18ae50bddfe8052400495a3579d1b6e3fc3897f1e24b64f118d05580ca9fb8ea5ca694b291399" +
+		"89e8767e954eceebf3c75c845337f3274c4e697ecd138461dda616de505853ba958d282ce5114c6eb07d310195ccc776" +
+		"85bcc86f34ad37721064f55f487e2ee062ee8c0760b26d92d85c8c1e43d0bffb45e64e2804c770b81b654d01bb8503fd" +
+		"e75cf8ed92ccd8c86e8288a7d1f5076b8c29e24ac7e2be9853fc2b955821575738257afba5e3d5399c1eb66442463636" +
+		"bca3ee765eb9eaccd701272b8254a765bc51499b3858a036b7d84e61f98d4dad1fb3c5675f80b284efb9aca266cd43e0" +
+		"a9321ac0cfe4b507c7cb53f93e7715ff8cb40dffc7ad0a9fa01b22c8fe89b7f5a10bd665b665c5ea19ab7998ed58719c" +
+		"4715da8633ae09b9f3fdbf99df9801ff243633252e68a26b959244d3942fa13909f78bdfc04df25c0c96bcb95f4bdbfc" +
+		"fc4e8c1b2a2dbff3efe40e17c4bb7f52f438112596d591afd2c582b95735fe73dd0539ab9f5b9a441b05ef719b09eeec" +
+		"86919d73dffea99606d1d8e8c76dc6cf58c0b922426d38352137ed72ca4f22648266e72e85b9c7f1b6a7596de55e3b1a" +
+		"6d83f4985f0184d1f7f0738bd1cfff73f19f9e61d17365b5fa39ec15246099ebf349f573e0b95084153592fdd29673d1" +
+		"56fbf2fbe5a4627dec4c5adc3a5e1bc6347ff016e9974daf6aa6ff16d5070c73dda1b047cd0330afe868aefb2ccaf538" +
+		"d49bda64a49522923e2ca32c50b2aa847b7b2dbf236d42f4f2dcdc868c09829cc441a6f2fb8e6a07294019eca2a27808" +
+		"25192b2d6db389166878565fd4a2abf4c1bfdcba8ecf95b1ea29f2a44990714d63ef78ed85f19baf6f690709cb5867b3" +
+		"6e1eb743030932e6b1efefa31275418283a3e60a665526c85accdf98d20ce991d85e673ecaf2d21b5ae099449022aa6a" +
+		"7971dfb512d9929ca0b9849fa182906f3b89b0cf5fbb0eac4c8608ae86dbefbbe491b898fc773f5e6e05089db491d62d" +
+		"af053cdbb69b049ec05ad2f9fa9ad7d4d846c386a8c4416da4a3158a6ff67796e0ef977be4adf45482241c985ec00a44" +
+		"f785b4f8582b224babd002ba8665a1df93ceb64975152811c9004279967d527fbae5056c12780d4b14022a952d9fb119" +
+		"a7a9b8aaea62c155108737252a8bf0d35bb65006b5866b46d5270ad1ec23a353"
+	hybridVectorShared     = "8c6de38641502cfe864dda41ce3fe728f0d609e0ece18ef1d0f2d0dd9b3481cc"
+	hybridVectorQKDKey     = "1011001110001111000011111000001111110000000111111100000000111111111000000000111111111100000000001111"
+	hybridVectorTranscript = "quaitor hybrid handshake test transcript"
+)
+
+// hybridVectors are the expected outputs of CombineKeys and ConfirmTag for
+// the vector inputs, per mode.
+var hybridVectors = []struct {
+	mode     HandshakeMode
+	layerKey string
+	tag      string
+}{
+	{ModeQKD, "c132e9af32d0e71463fe1bd19e85687807745533e26fc85787dc401866cacd2b", "72b25e5c171d4ec95d9d626d697bc66c1eaefa4b282b61236dd33df05081c843"},
+	{ModeHybrid, "12744672b81fa817b6f177f3362f38365a13e218e5f88fab30df5f75887eca6b", "383885bacdaa798d5965a3cb4b4c01347ec7f21d5ba5f224ea142d4364874645"},
+}
+
+func TestHybridVectors(t *testing.T) {
+	seed := make([]byte, mlkem.SeedSize)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	dk, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ekHash := sha256.Sum256(dk.EncapsulationKey().Bytes())
+	if hex.EncodeToString(ekHash[:]) != hybridVectorEKHash {
+		t.Fatal("ML-KEM encapsulation key mismatch")
+	}
+	ct, _ := hex.DecodeString(hybridVectorCiphertext)
+	shared, err := dk.Decapsulate(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(shared) != hybridVectorShared {
+		t.Fatal("ML-KEM shared secret mismatch")
+	}
+
+	qkdKey, err := ParseKey(hybridVectorQKDKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript := []byte(hybridVectorTranscript)
+	for _, v := range hybridVectors {
+		var kemShared []byte
+		if v.mode == ModeHybrid {
+			kemShared = shared
+		}
+		key, confirm, err := CombineKeys(v.mode, qkdKey, kemShared, transcript)
+		if err != nil {
+			t.Fatalf("%s: %v", v.mode, err)
+		}
+		want, _ := hex.DecodeString(v.layerKey)
+		if !bytes.Equal(key.Bytes(), want) {
+			t.Errorf("%s: layer key %x, want %s", v.mode, key.Bytes(), v.layerKey)
+		}
+		if tag := hex.EncodeToString(ConfirmTag(confirm, transcript)); tag != v.tag {
+			t.Errorf("%s: confirmation tag %s, want %s", v.mode, tag, v.tag)
+		}
+	}
+}
+
+func TestCombineKeysBindsTranscript(t *testing.T) {
+	qkdKey, _ := ParseKey(hybridVectorQKDKey)
+	shared := bytes.Repeat([]byte{1}, mlkem.SharedKeySize)
+	key, confirm, err := CombineKeys(ModeHybrid, qkdKey, shared, []byte("transcript"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, otherConfirm, _ := CombineKeys(ModeHybrid, qkdKey, shared, []byte("transcripT"))
+	if key.Equal(other) {
+		t.Fatal("different transcripts derived the same layer key")
+	}
+	tag := ConfirmTag(confirm, []byte("transcript"))
+	if err := CheckConfirmTag(confirm, []byte("transcript"), tag); err != nil {
+		t.Fatalf("own tag: %v", err)
+	}
+	if err := CheckConfirmTag(otherConfirm, []byte("transcripT"), tag); !errors.Is(err, ErrConfirm) {
+		t.Fatalf("tag of another transcript: got %v, want ErrConfirm", err)
+	}
+}
+
+func TestCombineKeysRejects(t *testing.T) {
+	qkdKey, _ := ParseKey(hybridVectorQKDKey)
+	shared := make([]byte, mlkem.SharedKeySize)
+	for name, tt := range map[string]struct {
+		mode   HandshakeMode
+		key    Key
+		shared []byte
+		want   error
+	}{
+		"empty QKD key":           {ModeQKD, nil, nil, ErrEmptyKey},
+		"qkd with an ML-KEM key":  {ModeQKD, qkdKey, shared, nil},
+		"hybrid without one":      {ModeHybrid, qkdKey, nil, nil},
+		"hybrid with a short one": {ModeHybrid, qkdKey, shared[1:], nil},
+		"unknown mode":            {HandshakeMode(9), qkdKey, nil, ErrUnknownMode},
+	} {
+		_, _, err := CombineKeys(tt.mode, tt.key, tt.shared, nil)
+		if err == nil || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
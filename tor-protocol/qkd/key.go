@@ -0,0 +1,75 @@
+package qkd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Key is a sifted QKD key, one bit (0 or 1) per element.
+type Key []uint8
+
+// ErrEmptyKey is returned when a key that is needed is empty.
+var ErrEmptyKey = errors.New("qkd: empty key")
+
+// ParseKey parses the "0101..." representation stored in quantum_key.json.
+func ParseKey(s string) (Key, error) {
+	s = strings.TrimSpace(s)
+	key := make(Key, len(s))
+	for i, c := range s {
+		switch c {
+		case '0':
+			key[i] = 0
+		case '1':
+			key[i] = 1
+		default:
+			return nil, fmt.Errorf("qkd: invalid key character %q at %d", c, i)
+		}
+	}
+	return key, nil
+}
+
+// String returns the key as a string of '0' and '1' characters.
+func (k Key) String() string {
+	var sb strings.Builder
+	sb.Grow(len(k))
+	for _, b := range k {
+		sb.WriteByte('0' + b)
+	}
+	return sb.String()
+}
+
+// Equal reports whether k and other hold the same bits.
+func (k Key) Equal(other Key) bool {
+	if len(k) != len(other) {
+		return false
+	}
+	for i := range k {
+		if k[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Bytes packs the key bits into bytes, most significant bit first. A trailing
+// partial byte is padded with zero bits.
+func (k Key) Bytes() []byte {
+	out := make([]byte, (len(k)+7)/8)
+	for i, b := range k {
+		out[i/8] |= b << (7 - uint(i%8))
+	}
+	return out
+}
+
+// UnpackKey is the inverse of Bytes for a key of n bits.
+func UnpackKey(b []byte, n int) (Key, error) {
+	if n < 0 || len(b) != (n+7)/8 {
+		return nil, fmt.Errorf("qkd: %d bytes cannot hold a %d-bit key", len(b), n)
+	}
+	key := make(Key, n)
+	for i := range key {
+		key[i] = (b[i/8] >> (7 - uint(i%8))) & 1
+	}
+	return key, nil
+}
@@ -0,0 +1,247 @@
+package qkd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"tor-protocol/atomicfile"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Files holding key material (the QKD key file, keystores and one-time-pad
+// pools) are written with mode 0600, through a synced temporary file renamed
+// over the old one, under an advisory lock on the file's ".lock" companion.
+// With a FileKey they are also encrypted, in the envelope
+//
+//	{"quaitor_sealed": 1, "kdf": "scrypt" or "raw", "salt": ..., "n": ..., "r": ..., "p": ..., "data": ...}
+//
+// where data is the sealed JSON document (see Seal) under a key derived from
+// a passphrase with scrypt, or taken from the environment as is. A file in
+// the plain JSON format is still read, and is encrypted the next time it is
+// written, which is how existing files are migrated.
+
+// sealedFileVersion is the version of the encrypted envelope.
+const sealedFileVersion = 1
+
+// Scrypt parameters for passphrase-derived file keys.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// fileKeyInfo is the AEAD info of encrypted key files.
+const fileKeyInfo = "quaitor key file"
+
+var (
+	// ErrFileSealed is returned for an encrypted key file when no FileKey
+	// is configured.
+	ErrFileSealed = errors.New("qkd: key file is encrypted and no file key is configured")
+	// ErrFileKey is returned for an encrypted key file that does not open
+	// under the configured FileKey.
+	ErrFileKey = errors.New("qkd: key file does not open with the configured file key")
+)
+
+// sealedFile is the encrypted envelope of a key file.
+type sealedFile struct {
+	Sealed int    `json:"quaitor_sealed"`
+	KDF    string `json:"kdf"`
+	Salt   []byte `json:"salt,omitempty"`
+	N      int    `json:"n,omitempty"`
+	R      int    `json:"r,omitempty"`
+	P      int    `json:"p,omitempty"`
+	Data   []byte `json:"data"`
+}
+
+// FileKey encrypts key files at rest.
+type FileKey struct {
+	kdf    string // "scrypt" or "raw"
+	secret []byte
+
+	mu      sync.Mutex
+	salt    []byte         // salt new files are written with
+	derived map[string]Key // scrypt keys by salt
+}
+
+// NewFileKey returns the FileKey for a passphrase or, if passphrase is empty,
+// for a hex-encoded 32-byte raw key. It returns nil if both are empty: key
+// files are then written in plain JSON.
+func NewFileKey(passphrase, rawHex string) (*FileKey, error) {
+	switch {
+	case passphrase != "":
+		return &FileKey{kdf: "scrypt", secret: []byte(passphrase), derived: make(map[string]Key)}, nil
+	case rawHex != "":
+		raw, err := hex.DecodeString(rawHex)
+		if err != nil || len(raw) != 32 {
+			return nil, errors.New("qkd: file key must be 32 bytes, hex-encoded")
+		}
+		return &FileKey{kdf: "raw", secret: raw}, nil
+	}
+	return nil, nil
+}
+
+// key returns the key files sealed with salt are encrypted under.
+func (fk *FileKey) key(salt []byte, n, r, p int) (Key, error) {
+	if fk.kdf == "raw" {
+		return UnpackKey(fk.secret, 8*len(fk.secret))
+	}
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	id := fmt.Sprintf("%x/%d/%d/%d", salt, n, r, p)
+	if k, ok := fk.derived[id]; ok {
+		return k, nil
+	}
+	derived, err := scrypt.Key(fk.secret, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	k, err := UnpackKey(derived, 256)
+	if err != nil {
+		return nil, err
+	}
+	fk.derived[id] = k
+	return k, nil
+}
+
+// seal encrypts a key file's JSON document into its envelope. Files are
+// sealed with one salt per FileKey, so that the key is derived once.
+func (fk *FileKey) seal(doc []byte) ([]byte, error) {
+	env := sealedFile{Sealed: sealedFileVersion, KDF: fk.kdf}
+	if fk.kdf == "scrypt" {
+		fk.mu.Lock()
+		if fk.salt == nil {
+			fk.salt = make([]byte, 16)
+			if _, err := rand.Read(fk.salt); err != nil {
+				fk.mu.Unlock()
+				return nil, err
+			}
+		}
+		env.Salt, env.N, env.R, env.P = fk.salt, scryptN, scryptR, scryptP
+		fk.mu.Unlock()
+	}
+	k, err := fk.key(env.Salt, env.N, env.R, env.P)
+	if err != nil {
+		return nil, err
+	}
+	if env.Data, err = Seal(AESGCM, k, fileKeyInfo, doc, []byte(env.KDF)); err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// open decrypts an envelope.
+func (fk *FileKey) open(env *sealedFile) ([]byte, error) {
+	if env.KDF != fk.kdf || (env.KDF == "scrypt" && (env.N <= 1 || env.N > 1<<20 || env.R <= 0 || env.P <= 0)) {
+		return nil, ErrFileKey
+	}
+	k, err := fk.key(env.Salt, env.N, env.R, env.P)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := Open(k, fileKeyInfo, env.Data, []byte(env.KDF))
+	if err != nil {
+		return nil, ErrFileKey
+	}
+	return doc, nil
+}
+
+// readKeyFile reads the key file at path into v, decrypting it with fk. It
+// reports whether the file exists and whether it was in plain JSON. An empty
+// file is reported as missing.
+func readKeyFile(path string, fk *FileKey, v any) (exists, plain bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return false, false, nil
+	}
+
+	var env sealedFile
+	if err := json.Unmarshal(data, &env); err == nil && env.Sealed != 0 {
+		if fk == nil {
+			return true, false, fmt.Errorf("%w: %s", ErrFileSealed, path)
+		}
+		if env.Sealed != sealedFileVersion {
+			return true, false, fmt.Errorf("qkd: %s: unsupported key file version %d", path, env.Sealed)
+		}
+		if data, err = fk.open(&env); err != nil {
+			return true, false, fmt.Errorf("%w: %s", err, path)
+		}
+		plain = false
+	} else {
+		plain = true
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return true, plain, fmt.Errorf("qkd: parse %s: %w", path, err)
+	}
+	return true, plain, nil
+}
+
+// writeKeyFile writes v to the key file at path, encrypted with fk if not
+// nil. The file is replaced atomically and synced to disk with mode 0600.
+func writeKeyFile(path string, fk *FileKey, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if fk != nil {
+		if data, err = fk.seal(data); err != nil {
+			return err
+		}
+	}
+
+	return atomicfile.WriteFile(path, data, 0600)
+}
+
+// lockKeyFile takes an exclusive advisory lock on the key file at path,
+// shared by every process using the file, and returns the function that
+// releases it. The lock is held on path+".lock", which is left in place, so
+// that it survives the file being replaced.
+func lockKeyFile(path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("qkd: lock %s: %w", path, err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// MigrateKeyFile encrypts the plain JSON key file at path with fk, and
+// reports whether it did. Missing and already encrypted files are left
+// alone.
+func MigrateKeyFile(path string, fk *FileKey) (bool, error) {
+	if fk == nil {
+		return false, nil
+	}
+	unlock, err := lockKeyFile(path)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	var doc json.RawMessage
+	exists, plain, err := readKeyFile(path, fk, &doc)
+	if err != nil || !exists || !plain {
+		return false, err
+	}
+	if err := writeKeyFile(path, fk, doc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,152 @@
+package qkd
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// envelope reads the encrypted envelope of the key file at path.
+func envelope(t *testing.T, path string) sealedFile {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env sealedFile
+	if err := json.Unmarshal(data, &env); err != nil || env.Sealed != sealedFileVersion {
+		t.Fatalf("%s is not encrypted: %s", path, data)
+	}
+	return env
+}
+
+func TestFileKeyEncryptsStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quantum_key.json")
+	fk, err := NewFileKey("correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(path)
+	s.FileKey = fk
+	epoch, err := s.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if env := envelope(t, path); env.KDF != "scrypt" || len(env.Salt) == 0 {
+		t.Errorf("envelope %+v, want scrypt with a salt", env)
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), epoch.Key.String()) {
+		t.Error("the key is in the file in clear")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("key file mode %v, want 0600", perm)
+	}
+
+	// Another process with the passphrase reads the same key.
+	again, _ := NewFileKey("correct horse", "")
+	s2 := NewStore(path)
+	s2.FileKey = again
+	got, err := s2.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != epoch.ID || !got.Key.Equal(epoch.Key) {
+		t.Fatal("reopened store has another key")
+	}
+}
+
+func TestFileKeyRejects(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quantum_key.json")
+	fk, _ := NewFileKey("correct horse", "")
+	s := NewStore(path)
+	s.FileKey = fk
+	if _, err := s.Current(); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(path)
+
+	wrong, _ := NewFileKey("battery staple", "")
+	raw, _ := NewFileKey("", strings.Repeat("ab", 32))
+	for name, key := range map[string]*FileKey{"wrong passphrase": wrong, "raw key": raw} {
+		s := NewStore(path)
+		s.FileKey = key
+		if _, err := s.Current(); !errors.Is(err, ErrFileKey) {
+			t.Errorf("%s: got %v, want ErrFileKey", name, err)
+		}
+	}
+	if _, err := NewStore(path).Current(); !errors.Is(err, ErrFileSealed) {
+		t.Errorf("no file key: got %v, want ErrFileSealed", err)
+	}
+	if _, err := LoadKeyFile(path); !errors.Is(err, ErrFileSealed) {
+		t.Errorf("LoadKeyFile: got %v, want ErrFileSealed", err)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Error("a rejected store rewrote the key file")
+	}
+}
+
+func TestNewFileKey(t *testing.T) {
+	if fk, err := NewFileKey("", ""); fk != nil || err != nil {
+		t.Errorf("got %v, %v without a passphrase or key", fk, err)
+	}
+	for _, bad := range []string{"zz", strings.Repeat("ab", 16), strings.Repeat("ab", 33)} {
+		if _, err := NewFileKey("", bad); err == nil {
+			t.Errorf("accepted raw key %q", bad)
+		}
+	}
+	fk, err := NewFileKey("", strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	if err := writeKeyFile(path, fk, map[string]string{"8802": "0101"}); err != nil {
+		t.Fatal(err)
+	}
+	if env := envelope(t, path); env.KDF != "raw" || env.Salt != nil {
+		t.Errorf("envelope %+v, want a raw key without salt", env)
+	}
+	var doc map[string]string
+	if _, _, err := readKeyFile(path, fk, &doc); err != nil || doc["8802"] != "0101" {
+		t.Fatalf("read %v, %v", doc, err)
+	}
+}
+
+// TestMigrateKeyFile checks that a plain quantum_key.json is encrypted in
+// place, once, and keeps its key.
+func TestMigrateKeyFile(t *testing.T) {
+	path := copyFixture(t, "quantum_key.json")
+	want := legacyKey(t, path)
+	fk, _ := NewFileKey("correct horse", "")
+
+	if migrated, err := MigrateKeyFile(path, nil); migrated || err != nil {
+		t.Fatalf("migrated without a file key: %v, %v", migrated, err)
+	}
+	if migrated, err := MigrateKeyFile(path, fk); !migrated || err != nil {
+		t.Fatalf("got %v, %v, want a migration", migrated, err)
+	}
+	envelope(t, path)
+	if migrated, err := MigrateKeyFile(path, fk); migrated || err != nil {
+		t.Fatalf("migrated twice: %v, %v", migrated, err)
+	}
+	if migrated, err := MigrateKeyFile(filepath.Join(t.TempDir(), "missing.json"), fk); migrated || err != nil {
+		t.Fatalf("migrated a missing file: %v, %v", migrated, err)
+	}
+
+	s := NewStore(path)
+	s.FileKey = fk
+	epoch, err := s.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epoch.Key.String() != want {
+		t.Fatalf("migrated key %s, want %s", epoch.Key, want)
+	}
+}
@@ -0,0 +1,163 @@
+package qkd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// KeyIDSize is the size of a link key's ID.
+const KeyIDSize = 8
+
+// ErrNoLinkKey is returned when no key is shared with a peer, or none has the
+// requested ID.
+var ErrNoLinkKey = errors.New("qkd: no link key")
+
+// Keystore holds the pairwise keys this node shares with its peers, each
+// established by a BB84 exchange over the link between the two. Keys are
+// indexed by peer ID and can be found by their key ID, which both ends derive
+// from the key itself. The keystore is saved to Path after every change.
+type Keystore struct {
+	Path string
+	// FileKey encrypts the keystore file at rest.
+	FileKey *FileKey
+
+	mu     sync.Mutex
+	loaded bool
+	keys   map[string]*linkKey // by hex key ID
+}
+
+// linkKey is one stored pairwise key.
+type linkKey struct {
+	Peer    string    `json:"peer"`
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// keystoreFile is the on-disk format of a Keystore.
+type keystoreFile struct {
+	Keys map[string]*linkKey `json:"keys"`
+}
+
+// NewKeystore returns the keystore persisted at path. The file is read on
+// first use.
+func NewKeystore(path string) *Keystore {
+	return &Keystore{Path: path}
+}
+
+// KeyID returns the ID of a link key. It identifies the key to the peer
+// without revealing it.
+func KeyID(k Key) []byte {
+	sum := sha256.Sum256(append([]byte("quaitor link key id"), k.Bytes()...))
+	return sum[:KeyIDSize]
+}
+
+// Put stores a key shared with peer.
+func (s *Keystore) Put(peer string, k Key) error {
+	if len(k) == 0 {
+		return ErrEmptyKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.keys[hex.EncodeToString(KeyID(k))] = &linkKey{Peer: peer, Key: k.String(), Created: time.Now()}
+	return s.save()
+}
+
+// Get returns the newest key shared with peer.
+func (s *Keystore) Get(peer string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	var newest *linkKey
+	for _, lk := range s.keys {
+		if lk.Peer == peer && (newest == nil || lk.Created.After(newest.Created)) {
+			newest = lk
+		}
+	}
+	if newest == nil {
+		return nil, fmt.Errorf("%w for %s", ErrNoLinkKey, peer)
+	}
+	return ParseKey(newest.Key)
+}
+
+// Find returns the key with the given ID and the peer it is shared with.
+func (s *Keystore) Find(id []byte) (string, Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", nil, err
+	}
+	lk, ok := s.keys[hex.EncodeToString(id)]
+	if !ok {
+		return "", nil, fmt.Errorf("%w with ID %x", ErrNoLinkKey, id)
+	}
+	k, err := ParseKey(lk.Key)
+	return lk.Peer, k, err
+}
+
+// Peers returns the number of keys held for each peer.
+func (s *Keystore) Peers() (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	peers := make(map[string]int)
+	for _, lk := range s.keys {
+		peers[lk.Peer]++
+	}
+	return peers, nil
+}
+
+// load reads the keystore file on first use. A missing file is an empty
+// keystore; a plain JSON one is encrypted if the keystore has a FileKey.
+func (s *Keystore) load() error {
+	if s.loaded {
+		return nil
+	}
+	unlock, err := lockKeyFile(s.Path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var kf keystoreFile
+	exists, plain, err := readKeyFile(s.Path, s.FileKey, &kf)
+	if err != nil {
+		return err
+	}
+	if kf.Keys == nil {
+		kf.Keys = make(map[string]*linkKey)
+	}
+	s.keys = kf.Keys
+	s.loaded = true
+	if exists && plain && s.FileKey != nil {
+		return s.write()
+	}
+	return nil
+}
+
+// save writes the keystore file.
+func (s *Keystore) save() error {
+	unlock, err := lockKeyFile(s.Path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.write()
+}
+
+// write writes the keystore file under its lock.
+func (s *Keystore) write() error {
+	if err := writeKeyFile(s.Path, s.FileKey, keystoreFile{Keys: s.keys}); err != nil {
+		return fmt.Errorf("qkd: save %s: %w", s.Path, err)
+	}
+	return nil
+}
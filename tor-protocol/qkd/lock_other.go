@@ -0,0 +1,11 @@
+//go:build !unix
+
+package qkd
+
+import "os"
+
+// lockFile is a no-op where flock is not available: key files are then only
+// protected by their atomic replacement.
+func lockFile(f *os.File) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
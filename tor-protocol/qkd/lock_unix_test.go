@@ -0,0 +1,42 @@
+//go:build unix
+
+package qkd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestLockKeyFile checks that a key file is locked by one user at a time.
+func TestLockKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quantum_key.json")
+	unlock, err := lockKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan func())
+	go func() {
+		unlock, err := lockKeyFile(path)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the lock was taken twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock was not released")
+	}
+	if info, err := os.Stat(path + ".lock"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("lock file: %v, %v", info, err)
+	}
+}
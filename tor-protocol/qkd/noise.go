@@ -0,0 +1,34 @@
+package qkd
+
+// Noise is a depolarizing quantum channel: it flips the value of each qubit
+// with probability Rate, independently of its basis. Unlike Eve it adds
+// errors without learning anything, so its errors are what reconciliation is
+// for.
+type Noise struct {
+	Rate float64
+	Rand RandomSource
+}
+
+// NewNoise returns a channel flipping the given fraction of qubits. A nil rng
+// selects the cryptographically secure default source; simulations pass a
+// SeededSource to get reproducible errors.
+func NewNoise(rate float64, rng RandomSource) *Noise {
+	if rng == nil {
+		rng = CryptoSource()
+	}
+	return &Noise{Rate: rate, Rand: rng}
+}
+
+// Apply returns the qubits after the channel and the number it flipped.
+func (ch *Noise) Apply(qubits []Qubit) ([]Qubit, int) {
+	out := make([]Qubit, len(qubits))
+	flipped := 0
+	for i, q := range qubits {
+		out[i] = q
+		if ch.Rate > 0 && Uniform(ch.Rand) < ch.Rate {
+			out[i].Bit ^= 1
+			flipped++
+		}
+	}
+	return out, flipped
+}
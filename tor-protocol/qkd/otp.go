@@ -0,0 +1,78 @@
+package qkd
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/poly1305"
+)
+
+// A one-time-pad message is
+//
+//	tag (16) | message XOR pad
+//
+// The first OTPMACBits bits of the pad key a one-time Poly1305 MAC over the
+// caller's data and the ciphertext (a Wegman-Carter authenticator), the rest
+// encrypt the message. Like the pad, the MAC key is never reused, so the
+// scheme does not rely on any computational assumption.
+const (
+	OTPMACBits = 256
+	OTPTagSize = poly1305.TagSize
+)
+
+// OTPPadBits returns the number of pad bits needed for a message of n bytes.
+func OTPPadBits(n int) int {
+	return OTPMACBits + 8*n
+}
+
+// SealOTP encrypts and authenticates msg, and authenticates ad, with pad,
+// which must hold exactly OTPPadBits(len(msg)) bits.
+func SealOTP(pad Key, msg, ad []byte) ([]byte, error) {
+	if len(pad) != OTPPadBits(len(msg)) {
+		return nil, fmt.Errorf("qkd: %d-bit pad for a %d-byte message", len(pad), len(msg))
+	}
+	macKey, stream := splitPad(pad)
+	ct := make([]byte, len(msg))
+	for i := range msg {
+		ct[i] = msg[i] ^ stream[i]
+	}
+	var tag [OTPTagSize]byte
+	poly1305.Sum(&tag, macInput(ad, ct), macKey)
+	return append(tag[:], ct...), nil
+}
+
+// OpenOTP reverses SealOTP. It returns ErrAuthFailed if sealed or ad were
+// altered.
+func OpenOTP(pad Key, sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < OTPTagSize || len(pad) != OTPPadBits(len(sealed)-OTPTagSize) {
+		return nil, ErrAuthFailed
+	}
+	macKey, stream := splitPad(pad)
+	tag, ct := sealed[:OTPTagSize], sealed[OTPTagSize:]
+	var want [OTPTagSize]byte
+	poly1305.Sum(&want, macInput(ad, ct), macKey)
+	if subtle.ConstantTimeCompare(tag, want[:]) != 1 {
+		return nil, ErrAuthFailed
+	}
+	msg := make([]byte, len(ct))
+	for i := range ct {
+		msg[i] = ct[i] ^ stream[i]
+	}
+	return msg, nil
+}
+
+// splitPad packs pad into the MAC key and the encryption stream.
+func splitPad(pad Key) (*[32]byte, []byte) {
+	b := pad.Bytes()
+	var macKey [32]byte
+	copy(macKey[:], b[:OTPMACBits/8])
+	return &macKey, b[OTPMACBits/8:]
+}
+
+// macInput frames ad and ct unambiguously for the MAC.
+func macInput(ad, ct []byte) []byte {
+	in := binary.BigEndian.AppendUint32(nil, uint32(len(ad)))
+	in = append(in, ad...)
+	return append(in, ct...)
+}
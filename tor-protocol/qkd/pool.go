@@ -0,0 +1,253 @@
+package qkd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrKeyExhausted is returned when a peer's pool has too few unused bits
+	// left for a one-time pad.
+	ErrKeyExhausted = errors.New("qkd: key exhausted")
+	// ErrKeyReused is returned when a peer asks this node to decrypt with pad
+	// bits that were already consumed, or that it never deposited.
+	ErrKeyReused = errors.New("qkd: one-time pad bits already consumed")
+)
+
+// Pool holds one-time-pad key material shared with each peer, and records
+// which bits have been consumed so that no bit is ever used twice.
+//
+// Material is deposited in blocks. Each block has two halves: Out, which this
+// node encrypts with, and In, which the peer encrypts with (the peer holds the
+// same block with the halves swapped). Out is consumed from the front, in
+// order; In is consumed in whatever order the peer's messages arrive. The
+// pool is saved to Path after every change.
+type Pool struct {
+	Path string
+	// FileKey encrypts the pool file at rest.
+	FileKey *FileKey
+
+	mu     sync.Mutex
+	loaded bool
+	peers  map[string]map[string]*poolBlock
+}
+
+// poolBlock is one block of material shared with a peer.
+type poolBlock struct {
+	Out     string `json:"out"`      // bits this node encrypts with
+	In      string `json:"in"`       // bits the peer encrypts with
+	OutUsed int    `json:"out_used"` // Out bits consumed, from the front
+	InUsed  []span `json:"in_used"`  // In bit ranges consumed, sorted and merged
+}
+
+// span is the half-open bit range [Start, End).
+type span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// poolFile is the on-disk format of a Pool.
+type poolFile struct {
+	Peers map[string]map[string]*poolBlock `json:"peers"`
+}
+
+// NewPool returns the pool persisted at path. The file is read on first use.
+func NewPool(path string) *Pool {
+	return &Pool{Path: path}
+}
+
+// Deposit adds a block of material shared with peer under id.
+func (p *Pool) Deposit(peer, id string, out, in Key) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.load(); err != nil {
+		return err
+	}
+	blocks := p.peers[peer]
+	if blocks == nil {
+		blocks = make(map[string]*poolBlock)
+		p.peers[peer] = blocks
+	}
+	if _, ok := blocks[id]; ok {
+		return fmt.Errorf("qkd: pool block %q already exists for %s", id, peer)
+	}
+	blocks[id] = &poolBlock{Out: out.String(), In: in.String()}
+	return p.save()
+}
+
+// Reserve consumes n unused Out bits shared with peer, from a single block,
+// and returns the block ID, the offset of the bits in its Out half and the
+// bits themselves.
+func (p *Pool) Reserve(peer string, n int) (string, int, Key, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.load(); err != nil {
+		return "", 0, nil, err
+	}
+	for _, id := range p.blockIDs(peer) {
+		b := p.peers[peer][id]
+		if len(b.Out)-b.OutUsed < n {
+			continue
+		}
+		offset := b.OutUsed
+		pad, err := ParseKey(b.Out[offset : offset+n])
+		if err != nil {
+			return "", 0, nil, err
+		}
+		b.OutUsed += n
+		p.prune(peer, id)
+		if err := p.save(); err != nil {
+			return "", 0, nil, err
+		}
+		return id, offset, pad, nil
+	}
+	return "", 0, nil, fmt.Errorf("%w: need %d bits for %s", ErrKeyExhausted, n, peer)
+}
+
+// Take consumes the n In bits at offset of block id shared with peer, which
+// the peer reserved to encrypt a message to this node.
+func (p *Pool) Take(peer, id string, offset, n int) (Key, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	b, ok := p.peers[peer][id]
+	if !ok || offset < 0 || n <= 0 || offset+n > len(b.In) {
+		return nil, ErrKeyReused
+	}
+	used, ok := addSpan(b.InUsed, span{offset, offset + n})
+	if !ok {
+		return nil, ErrKeyReused
+	}
+	pad, err := ParseKey(b.In[offset : offset+n])
+	if err != nil {
+		return nil, err
+	}
+	b.InUsed = used
+	p.prune(peer, id)
+	if err := p.save(); err != nil {
+		return nil, err
+	}
+	return pad, nil
+}
+
+// Available returns the largest number of Out bits, and of In bits, left in
+// any single block shared with peer: the longest messages that can currently
+// be sent to and received from the peer. The peer consumes In bits from the
+// front, so the In bits left are those after the last consumed range.
+func (p *Pool) Available(peer string) (out, in int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.load(); err != nil {
+		return 0, 0, err
+	}
+	for _, b := range p.peers[peer] {
+		if left := len(b.Out) - b.OutUsed; left > out {
+			out = left
+		}
+		left := len(b.In)
+		if len(b.InUsed) > 0 {
+			left -= b.InUsed[len(b.InUsed)-1].End
+		}
+		if left > in {
+			in = left
+		}
+	}
+	return out, in, nil
+}
+
+// blockIDs returns peer's block IDs in a stable order.
+func (p *Pool) blockIDs(peer string) []string {
+	ids := make([]string, 0, len(p.peers[peer]))
+	for id := range p.peers[peer] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// prune drops block id once both of its halves are consumed.
+func (p *Pool) prune(peer, id string) {
+	b := p.peers[peer][id]
+	if b.OutUsed < len(b.Out) {
+		return
+	}
+	if len(b.In) > 0 && (len(b.InUsed) != 1 || b.InUsed[0] != span{0, len(b.In)}) {
+		return
+	}
+	delete(p.peers[peer], id)
+}
+
+// load reads the pool file on first use. A missing file is an empty pool; a
+// plain JSON one is encrypted if the pool has a FileKey.
+func (p *Pool) load() error {
+	if p.loaded {
+		return nil
+	}
+	unlock, err := lockKeyFile(p.Path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var pf poolFile
+	exists, plain, err := readKeyFile(p.Path, p.FileKey, &pf)
+	if err != nil {
+		return err
+	}
+	if pf.Peers == nil {
+		pf.Peers = make(map[string]map[string]*poolBlock)
+	}
+	p.peers = pf.Peers
+	p.loaded = true
+	if exists && plain && p.FileKey != nil {
+		return p.write()
+	}
+	return nil
+}
+
+// save writes the pool file.
+func (p *Pool) save() error {
+	unlock, err := lockKeyFile(p.Path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return p.write()
+}
+
+// write writes the pool file under its lock.
+func (p *Pool) write() error {
+	if err := writeKeyFile(p.Path, p.FileKey, poolFile{Peers: p.peers}); err != nil {
+		return fmt.Errorf("qkd: save %s: %w", p.Path, err)
+	}
+	return nil
+}
+
+// addSpan adds s to the sorted, merged spans, reporting false if it overlaps
+// any of them.
+func addSpan(spans []span, s span) ([]span, bool) {
+	i := sort.Search(len(spans), func(i int) bool { return spans[i].End > s.Start })
+	if i < len(spans) && spans[i].Start < s.End {
+		return spans, false
+	}
+	out := make([]span, 0, len(spans)+1)
+	out = append(out, spans[:i]...)
+	if i > 0 && out[i-1].End == s.Start {
+		out[i-1].End = s.End
+	} else {
+		out = append(out, s)
+	}
+	last := len(out) - 1
+	for _, next := range spans[i:] {
+		if out[last].End == next.Start {
+			out[last].End = next.End
+			continue
+		}
+		out = append(out, next)
+		last++
+	}
+	return out, true
+}
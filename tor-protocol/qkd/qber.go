@@ -0,0 +1,105 @@
+package qkd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// DefaultQBERThreshold is the QBER above which an exchange is aborted. Above
+// about 11% no secret key can be distilled from BB84 with one-way
+// post-processing.
+const DefaultQBERThreshold = 0.11
+
+// ErrEavesdropping is matched, with errors.Is, by a *QBERError.
+var ErrEavesdropping = errors.New("qkd: eavesdropping detected")
+
+// QBERError is returned when the quantum bit error rate of an exchange, as
+// estimated on a sacrificed sample of the sifted key, exceeds the threshold.
+type QBERError struct {
+	QBER      float64
+	Threshold float64
+	Sample    int // number of bits compared
+}
+
+func (e *QBERError) Error() string {
+	return fmt.Sprintf("qkd: QBER %.1f%% over %d bits exceeds %.1f%%, aborting", 100*e.QBER, e.Sample, 100*e.Threshold)
+}
+
+func (e *QBERError) Is(target error) bool {
+	return target == ErrEavesdropping
+}
+
+// ChooseSample picks size distinct positions out of n, in increasing order.
+func ChooseSample(n, size int, rng RandomSource) []int {
+	if size > n {
+		size = n
+	}
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	for i := 0; i < size; i++ {
+		j := i + Intn(rng, n-i)
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+	sample := perm[:size]
+	sort.Ints(sample)
+	return sample
+}
+
+// SampleSize returns the number of sifted bits to sacrifice for a QBER
+// estimate when fraction of the n sifted bits are sampled.
+func SampleSize(n int, fraction float64) int {
+	size := int(float64(n) * fraction)
+	if size < 1 && fraction > 0 && n > 0 {
+		size = 1
+	}
+	return size
+}
+
+// Pick returns the bits of k at the sample positions.
+func (k Key) Pick(sample []int) Key {
+	out := make(Key, len(sample))
+	for i, pos := range sample {
+		out[i] = k[pos]
+	}
+	return out
+}
+
+// Discard returns k without the bits at the sample positions, which have been
+// disclosed.
+func (k Key) Discard(sample []int) Key {
+	out := make(Key, 0, len(k)-len(sample))
+	next := 0
+	for i, b := range k {
+		if next < len(sample) && sample[next] == i {
+			next++
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// CheckQBER compares Alice's and Bob's values of the sampled bits and returns
+// the QBER, with a *QBERError if it exceeds threshold.
+func CheckQBER(alice, bob Key, threshold float64) (float64, error) {
+	if len(alice) != len(bob) {
+		return 0, fmt.Errorf("qkd: samples of %d and %d bits", len(alice), len(bob))
+	}
+	if len(alice) == 0 {
+		return 0, nil
+	}
+	errs := 0
+	for i := range alice {
+		if alice[i] != bob[i] {
+			errs++
+		}
+	}
+	qber := float64(errs) / float64(len(alice))
+	if qber > threshold {
+		return qber, &QBERError{QBER: qber, Threshold: threshold, Sample: len(alice)}
+	}
+	return qber, nil
+}
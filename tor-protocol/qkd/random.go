@@ -0,0 +1,56 @@
+package qkd
+
+import (
+	"crypto/rand"
+	mrand "math/rand"
+	"sync"
+)
+
+// RandomSource supplies the random bits used to choose qubit values and
+// bases. Implementations must be safe for concurrent use.
+type RandomSource interface {
+	Bit() uint8
+}
+
+// cryptoSource draws bits from crypto/rand, buffering one byte at a time.
+type cryptoSource struct {
+	mu   sync.Mutex
+	buf  [1]byte
+	left int
+}
+
+// CryptoSource returns a RandomSource backed by crypto/rand.
+func CryptoSource() RandomSource {
+	return &cryptoSource{}
+}
+
+func (s *cryptoSource) Bit() uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.left == 0 {
+		if _, err := rand.Read(s.buf[:]); err != nil {
+			panic("qkd: crypto/rand failed: " + err.Error())
+		}
+		s.left = 8
+	}
+	s.left--
+	return (s.buf[0] >> s.left) & 1
+}
+
+// seededSource is a deterministic RandomSource for reproducible simulations.
+type seededSource struct {
+	mu sync.Mutex
+	r  *mrand.Rand
+}
+
+// SeededSource returns a deterministic RandomSource. It must not be used to
+// generate keys that protect real traffic.
+func SeededSource(seed int64) RandomSource {
+	return &seededSource{r: mrand.New(mrand.NewSource(seed))}
+}
+
+func (s *seededSource) Bit() uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint8(s.r.Intn(2))
+}
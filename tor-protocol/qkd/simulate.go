@@ -0,0 +1,133 @@
+package qkd
+
+import "fmt"
+
+// Report describes the outcome of a simulated key exchange.
+type Report struct {
+	Protocol    string  `json:"protocol"`
+	Qubits      int     `json:"qubits"`         // qubits (or E91 pairs) sent by Alice
+	Intercepted int     `json:"intercepted"`    // qubits intercepted by Eve
+	Noisy       int     `json:"noisy"`          // qubits flipped by channel noise
+	Sifted      int     `json:"sifted"`         // bits left after sifting
+	CHSH        float64 `json:"chsh,omitempty"` // E91 only: CHSH value of the test pairs
+	Sampled     int     `json:"sampled"`        // sifted bits disclosed for the QBER estimate
+	QBER        float64 `json:"qber"`           // error rate of the sample
+	Corrected   int     `json:"corrected"`      // bits corrected by reconciliation
+	Leaked      int     `json:"leaked"`         // parity bits disclosed by reconciliation
+	KeyLength   int     `json:"key_length"`     // length of the final key, after privacy amplification
+}
+
+// Exchange configures a full simulated BB84 or E91 exchange.
+type Exchange struct {
+	Engine *Engine
+	// Protocol is ProtocolBB84 (the default if empty) or ProtocolE91. E91
+	// draws its randomness from the Engine's source.
+	Protocol string
+	// Eve, if not nil, sits on the quantum channel.
+	Eve *Eve
+	// Noise, if not nil, adds errors on the quantum channel after Eve.
+	Noise *Noise
+	// SampleFraction of the sifted bits is disclosed to estimate the QBER.
+	SampleFraction float64
+	// Threshold is the QBER above which the exchange aborts.
+	Threshold float64
+	// CHSHThreshold is the |S| below which an E91 exchange aborts.
+	CHSHThreshold float64
+}
+
+// Run exchanges n qubits (or E91 pairs) and returns the key Alice and Bob keep. If the QBER
+// of the sample exceeds the threshold it returns a *QBERError along with the
+// report. Otherwise Bob corrects his key to Alice's with Cascade and both
+// compress theirs by privacy amplification. Bob's key is returned as well,
+// as reconciliation can leave errors behind.
+func (x *Exchange) Run(n int) (alice, bob Key, report Report, err error) {
+	report.Qubits = n
+	switch x.Protocol {
+	case "", ProtocolBB84:
+		report.Protocol = ProtocolBB84
+		alice, bob, err = x.runBB84(n, &report)
+	case ProtocolE91:
+		report.Protocol = ProtocolE91
+		alice, bob, err = x.runE91(n, &report)
+	default:
+		err = fmt.Errorf("%w %q", ErrUnknownProtocol, x.Protocol)
+	}
+	if err != nil {
+		return nil, nil, report, err
+	}
+	report.Sifted = len(alice)
+
+	sample := ChooseSample(len(alice), SampleSize(len(alice), x.SampleFraction), x.Engine.Rand)
+	report.Sampled = len(sample)
+	report.QBER, err = CheckQBER(alice.Pick(sample), bob.Pick(sample), x.Threshold)
+	if err != nil {
+		return nil, nil, report, err
+	}
+	alice, bob = alice.Discard(sample), bob.Discard(sample)
+
+	bob, report.Leaked, report.Corrected, err = NewCascade(x.Engine.Rand).Reconcile(bob, report.QBER, alice.Parities)
+	if err != nil {
+		return nil, nil, report, err
+	}
+	m := SecureLength(len(alice), report.Leaked, report.QBER)
+	seed := make(Key, ToeplitzSeedLength(len(alice), m))
+	for i := range seed {
+		seed[i] = x.Engine.Rand.Bit()
+	}
+	if alice, err = Amplify(alice, seed, m); err != nil {
+		return nil, nil, report, err
+	}
+	if bob, err = Amplify(bob, seed, m); err != nil {
+		return nil, nil, report, err
+	}
+	report.KeyLength = m
+	return alice, bob, report, nil
+}
+
+// runBB84 returns Alice's and Bob's sifted keys from a BB84 exchange.
+func (x *Exchange) runBB84(n int, report *Report) (alice, bob Key, err error) {
+	qubits, aliceBits, aliceBases := x.Engine.Prepare(n)
+	if x.Eve != nil {
+		qubits, report.Intercepted = x.Eve.Intercept(qubits)
+	}
+	if x.Noise != nil {
+		qubits, report.Noisy = x.Noise.Apply(qubits)
+	}
+	bobBits, bobBases := x.Engine.Receive(qubits)
+
+	if alice, err = Sift(aliceBits, aliceBases, bobBases); err != nil {
+		return nil, nil, err
+	}
+	if bob, err = Sift(bobBits, aliceBases, bobBases); err != nil {
+		return nil, nil, err
+	}
+	return alice, bob, nil
+}
+
+// runE91 returns Alice's and Bob's sifted keys from an E91 exchange of n
+// pairs, after checking the CHSH value of the test pairs.
+func (x *Exchange) runE91(n int, report *Report) (alice, bob Key, err error) {
+	e91 := NewE91(x.Engine.Rand)
+	particles, aliceSettings, aliceOutcomes := e91.Emit(n)
+	if x.Eve != nil {
+		particles, report.Intercepted = x.Eve.InterceptParticles(particles)
+	}
+	if x.Noise != nil {
+		particles, report.Noisy = x.Noise.ApplyParticles(particles)
+	}
+	bobSettings, bobOutcomes := e91.Measure(particles)
+
+	keys, tests, err := SiftE91(aliceSettings, bobSettings)
+	if err != nil {
+		return nil, nil, err
+	}
+	report.CHSH, err = CHSH(PickSettings(aliceSettings, tests), PickSettings(bobSettings, tests),
+		aliceOutcomes.Pick(tests), bobOutcomes.Pick(tests))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := CheckCHSH(report.CHSH, x.CHSHThreshold, len(tests)); err != nil {
+		return nil, nil, err
+	}
+	return E91Key(aliceOutcomes, keys, false), E91Key(bobOutcomes, keys, true), nil
+}
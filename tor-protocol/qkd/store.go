@@ -0,0 +1,342 @@
+package qkd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultKeyLength is the number of qubits exchanged per key, matching the
+// --key-length default of qkd/main.py.
+const DefaultKeyLength = 256
+
+var (
+	// ErrUnknownEpoch is returned for a key epoch the store never had, or
+	// has forgotten.
+	ErrUnknownEpoch = errors.New("qkd: unknown key epoch")
+	// ErrEpochExpired is returned for a previous key epoch whose grace
+	// window has passed.
+	ErrEpochExpired = errors.New("qkd: key epoch expired")
+	// ErrNoEngine is returned when a Store without an Engine needs to
+	// generate a key.
+	ErrNoEngine = errors.New("qkd: store has no engine to generate a key")
+)
+
+// keyFile is the on-disk format of quantum_key.json shared with qkd/main.py.
+// Key is always the current key, so the file stays readable by main.py; the
+// other fields are added by nodes that rotate the key.
+type keyFile struct {
+	Key      string      `json:"key"`
+	Epoch    uint32      `json:"epoch,omitempty"`
+	Created  int64       `json:"created,omitempty"`
+	Previous []pastEpoch `json:"previous,omitempty"`
+}
+
+// pastEpoch is a rotated-out key, kept until Expires (Unix seconds).
+type pastEpoch struct {
+	Epoch   uint32 `json:"epoch"`
+	Key     string `json:"key"`
+	Expires int64  `json:"expires"`
+}
+
+// Epoch is one generation of the stored key. Epochs are numbered from 1; the
+// number travels in the protocol header (protocol.ExtKeyEpoch) so that the
+// receiver picks the right key to authenticate it. An epoch's key only
+// authenticates headers, and link exchanges with peers that have no link key
+// yet: payloads are sealed under link and circuit keys, never under it.
+type Epoch struct {
+	ID      uint32
+	Key     Key
+	Created time.Time
+}
+
+// LoadKeyFile reads a key from a quantum_key.json file in plain JSON.
+func LoadKeyFile(path string) (Key, error) {
+	var kf keyFile
+	exists, _, err := readKeyFile(path, nil, &kf)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("qkd: %s: %w", path, os.ErrNotExist)
+	}
+	return ParseKey(kf.Key)
+}
+
+// SaveKeyFile writes key to path in the quantum_key.json format, in plain
+// JSON.
+func SaveKeyFile(path string, key Key) error {
+	unlock, err := lockKeyFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeKeyFile(path, nil, &keyFile{Key: key.String()})
+}
+
+// RotationPolicy bounds the life of a key epoch. A zero limit is not
+// enforced.
+type RotationPolicy struct {
+	Lifetime    time.Duration // age of the epoch
+	MaxBytes    int64         // header bytes authenticated under the epoch by this process
+	MaxMessages int64         // headers authenticated under the epoch by this process
+	// Grace is how long the previous epochs stay acceptable after a
+	// rotation, for messages already in flight.
+	Grace time.Duration
+}
+
+// Store mirrors generate_quantum_key in qkd/main.py: the key in Path is reused
+// if present, otherwise a new one is generated and saved there. With a
+// RotationPolicy the key is also replaced by a new epoch once it has been
+// used for long enough (see Rotate).
+type Store struct {
+	Path      string
+	KeyLength int
+	Engine    *Engine
+	Policy    RotationPolicy
+	// FileKey encrypts the key file at rest; main.py can only read the
+	// file without one.
+	FileKey *FileKey
+
+	mu       sync.Mutex
+	usage    uint32 // epoch the counters below belong to
+	bytes    int64
+	messages int64
+}
+
+// NewStore returns a Store for the key file at path using a secure engine.
+func NewStore(path string) *Store {
+	return &Store{Path: path, KeyLength: DefaultKeyLength, Engine: NewEngine(nil)}
+}
+
+// Key returns the current key; see Current.
+func (s *Store) Key() (Key, error) {
+	e, err := s.Current()
+	if err != nil {
+		return nil, err
+	}
+	return e.Key, nil
+}
+
+// Current returns the current epoch, generating and persisting a key if the
+// file does not exist or is empty. The file is read on every call so that a
+// key cleared with `--mode clear-key`, or rotated by another node sharing the
+// file, is picked up without restarting the node. A key written by main.py
+// becomes epoch 1.
+func (s *Store) Current() (Epoch, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return Epoch{}, err
+	}
+	defer unlock()
+	kf, err := s.load()
+	if err != nil {
+		return Epoch{}, err
+	}
+	return currentEpoch(kf)
+}
+
+// EpochKey returns the key of epoch id: the current epoch, or a previous one
+// still within its grace window. Epoch 0, sent by peers that do not know
+// about epochs, is the current epoch.
+func (s *Store) EpochKey(id uint32) (Key, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	kf, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 || id == kf.Epoch {
+		return ParseKey(kf.Key)
+	}
+	for _, p := range kf.Previous {
+		if p.Epoch != id {
+			continue
+		}
+		if !time.Now().Before(time.Unix(p.Expires, 0)) {
+			return nil, fmt.Errorf("%w: %d", ErrEpochExpired, id)
+		}
+		return ParseKey(p.Key)
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownEpoch, id)
+}
+
+// Use records that one header of n bytes was authenticated under epoch id
+// (0 for the current epoch). Usage of previous epochs is not counted.
+func (s *Store) Use(id uint32, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id != 0 && id != s.usage {
+		return
+	}
+	s.bytes += int64(n)
+	s.messages++
+}
+
+// RotateIfDue rotates the key if the current epoch has exceeded one of the
+// policy's limits, and returns the reason it did ("" if it did not).
+func (s *Store) RotateIfDue() (Epoch, string, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return Epoch{}, "", err
+	}
+	defer unlock()
+	kf, err := s.load()
+	if err != nil {
+		return Epoch{}, "", err
+	}
+	cur, err := currentEpoch(kf)
+	if err != nil {
+		return Epoch{}, "", err
+	}
+
+	var reason string
+	switch p := s.Policy; {
+	case p.Lifetime > 0 && time.Since(cur.Created) >= p.Lifetime:
+		reason = fmt.Sprintf("lifetime %s reached", p.Lifetime)
+	case p.MaxBytes > 0 && s.bytes >= p.MaxBytes:
+		reason = fmt.Sprintf("%d header bytes authenticated", s.bytes)
+	case p.MaxMessages > 0 && s.messages >= p.MaxMessages:
+		reason = fmt.Sprintf("%d headers authenticated", s.messages)
+	default:
+		return cur, "", nil
+	}
+	next, err := s.rotate(kf)
+	return next, reason, err
+}
+
+// Rotate replaces the current key with a freshly generated one under the
+// next epoch. The old key stays acceptable for Policy.Grace, and epochs whose
+// grace window has passed are dropped.
+func (s *Store) Rotate() (Epoch, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return Epoch{}, err
+	}
+	defer unlock()
+	kf, err := s.load()
+	if err != nil {
+		return Epoch{}, err
+	}
+	return s.rotate(kf)
+}
+
+func (s *Store) rotate(kf *keyFile) (Epoch, error) {
+	key, err := s.generate()
+	if err != nil {
+		return Epoch{}, err
+	}
+	now := time.Now()
+	previous := []pastEpoch{{Epoch: kf.Epoch, Key: kf.Key, Expires: now.Add(s.Policy.Grace).Unix()}}
+	for _, p := range kf.Previous {
+		if now.Before(time.Unix(p.Expires, 0)) {
+			previous = append(previous, p)
+		}
+	}
+	next := &keyFile{Key: key.String(), Epoch: kf.Epoch + 1, Created: now.Unix(), Previous: previous}
+	if err := s.save(next); err != nil {
+		return Epoch{}, err
+	}
+	return currentEpoch(next)
+}
+
+// lock takes s.mu and the advisory lock on the key file, which every
+// operation holds while it reads, and possibly rewrites, the file.
+func (s *Store) lock() (func(), error) {
+	s.mu.Lock()
+	unlock, err := lockKeyFile(s.Path)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		s.mu.Unlock()
+	}, nil
+}
+
+// load reads the key file, generating a key if there is none and stamping a
+// key without an epoch as epoch 1. A plain JSON file is encrypted if the
+// store has a FileKey. The store must be locked.
+func (s *Store) load() (*keyFile, error) {
+	var kf keyFile
+	exists, plain, err := readKeyFile(s.Path, s.FileKey, &kf)
+	if err != nil {
+		return nil, err
+	}
+	if exists && kf.Key != "" {
+		if kf.Epoch == 0 {
+			kf.Epoch, kf.Created = 1, time.Now().Unix()
+		} else if !plain || s.FileKey == nil {
+			s.track(kf.Epoch)
+			return &kf, nil
+		}
+		if err := s.save(&kf); err != nil {
+			return nil, err
+		}
+		return &kf, nil
+	}
+
+	key, err := s.generate()
+	if err != nil {
+		return nil, err
+	}
+	kf = keyFile{Key: key.String(), Epoch: 1, Created: time.Now().Unix()}
+	if err := s.save(&kf); err != nil {
+		return nil, err
+	}
+	return &kf, nil
+}
+
+func (s *Store) generate() (Key, error) {
+	if s.Engine == nil {
+		return nil, ErrNoEngine
+	}
+	return s.Engine.Generate(s.KeyLength)
+}
+
+func (s *Store) save(kf *keyFile) error {
+	if err := writeKeyFile(s.Path, s.FileKey, kf); err != nil {
+		return fmt.Errorf("qkd: save %s: %w", s.Path, err)
+	}
+	s.track(kf.Epoch)
+	return nil
+}
+
+// track resets the usage counters when the current epoch changes. s.mu must
+// be held.
+func (s *Store) track(epoch uint32) {
+	if epoch != s.usage {
+		s.usage, s.bytes, s.messages = epoch, 0, 0
+	}
+}
+
+func currentEpoch(kf *keyFile) (Epoch, error) {
+	key, err := ParseKey(kf.Key)
+	if err != nil {
+		return Epoch{}, err
+	}
+	if len(key) == 0 {
+		return Epoch{}, ErrEmptyKey
+	}
+	return Epoch{ID: kf.Epoch, Key: key, Created: time.Unix(kf.Created, 0)}, nil
+}
+
+// Clear removes the stored key, like `--mode clear-key`. The next key starts
+// over at epoch 1.
+func (s *Store) Clear() error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(s.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package qkd
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copyFixture copies a file from testdata into a temporary directory.
+func copyFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// legacyKey reads path as qkd/main.py does: a JSON object whose "key" is the
+// key as a string of 0s and 1s.
+func legacyKey(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("%s is no longer plain JSON: %v", path, err)
+	}
+	key, _ := doc["key"].(string)
+	return key
+}
+
+// TestLegacyKeyFile checks that a quantum_key.json written by qkd/main.py
+// reads as the node's key, and stays readable by main.py once the store has
+// stamped it with an epoch.
+func TestLegacyKeyFile(t *testing.T) {
+	path := copyFixture(t, "quantum_key.json")
+	want := legacyKey(t, path)
+
+	key, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.String() != want {
+		t.Fatalf("LoadKeyFile read %s, want %s", key, want)
+	}
+
+	s := NewStore(path)
+	epoch, err := s.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epoch.ID != 1 || epoch.Key.String() != want {
+		t.Fatalf("store read epoch %d key %s, want epoch 1 key %s", epoch.ID, epoch.Key, want)
+	}
+	if got := legacyKey(t, path); got != want {
+		t.Fatalf("main.py would now read %q, want %q", got, want)
+	}
+}
+
+func TestSaveKeyFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quantum_key.json")
+	key := randomKey(SeededSource(1), DefaultKeyLength/2)
+	if err := SaveKeyFile(path, key); err != nil {
+		t.Fatal(err)
+	}
+	if got := legacyKey(t, path); got != key.String() {
+		t.Fatalf("main.py would read %q, want %q", got, key)
+	}
+	loaded, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(key) {
+		t.Fatal("key changed on the round trip")
+	}
+}
+
+// TestStoreWithoutEngine checks that a Store with no Engine refuses to
+// generate a key rather than panicking, but still serves a key it has.
+func TestStoreWithoutEngine(t *testing.T) {
+	s := &Store{Path: filepath.Join(t.TempDir(), "quantum_key.json")}
+	if _, err := s.Current(); !errors.Is(err, ErrNoEngine) {
+		t.Fatalf("got %v, want ErrNoEngine", err)
+	}
+
+	s = &Store{Path: copyFixture(t, "quantum_key.json")}
+	if _, err := s.Key(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Rotate(); !errors.Is(err, ErrNoEngine) {
+		t.Fatalf("got %v, want ErrNoEngine", err)
+	}
+}
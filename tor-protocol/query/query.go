@@ -0,0 +1,86 @@
+// Package query is an ordered, multi-value model of URL query strings. A
+// Query keeps its parameters in the order they appeared, repeated keys
+// included, and encodes every key and value with percent-encoding, so that
+// arbitrary bytes, such as base64 ciphertext with '+', '/' and '=', survive
+// being parsed and re-encoded at every hop.
+package query
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrMalformed is returned for a query string with an invalid escape.
+var ErrMalformed = errors.New("query: malformed query string")
+
+// Param is one key=value pair of a query string.
+type Param struct {
+	Key, Value string
+}
+
+// Query is the parameters of a query string, in order.
+type Query []Param
+
+// Parse parses a query string, without its leading '?'. Pairs are separated
+// by '&'; a pair without '=' has an empty value, and empty pairs are skipped.
+// Keys and values are decoded from percent-encoding, with '+' standing for a
+// space.
+func Parse(raw string) (Query, error) {
+	var q Query
+	for raw != "" {
+		var pair string
+		pair, raw, _ = strings.Cut(raw, "&")
+		if pair == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q", ErrMalformed, k)
+		}
+		value, err := url.QueryUnescape(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: value of %q", ErrMalformed, key)
+		}
+		q = append(q, Param{Key: key, Value: value})
+	}
+	return q, nil
+}
+
+// Encode returns the query string of q, without a leading '?', with every
+// key and value percent-encoded. Parse(q.Encode()) returns q.
+func (q Query) Encode() string {
+	var b strings.Builder
+	for i, p := range q {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(url.QueryEscape(p.Key))
+		b.WriteByte('=')
+		b.WriteString(url.QueryEscape(p.Value))
+	}
+	return b.String()
+}
+
+// Get returns the first value of key.
+func (q Query) Get(key string) (string, bool) {
+	for _, p := range q {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// All returns every value of key, in order.
+func (q Query) All(key string) []string {
+	var values []string
+	for _, p := range q {
+		if p.Key == key {
+			values = append(values, p.Value)
+		}
+	}
+	return values
+}
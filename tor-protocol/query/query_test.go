@@ -0,0 +1,101 @@
+package query
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		raw  string
+		want Query
+	}{
+		{"", nil},
+		{"a=1&b=2", Query{{"a", "1"}, {"b", "2"}}},
+		{"b=2&a=1&b=3", Query{{"b", "2"}, {"a", "1"}, {"b", "3"}}},
+		{"flag&x=", Query{{"flag", ""}, {"x", ""}}},
+		{"&&a=1&", Query{{"a", "1"}}},
+		{"a=x%2By%2F%3D&b=x+y", Query{{"a", "x+y/="}, {"b", "x y"}}},
+		{"a=1=2", Query{{"a", "1=2"}}},
+	} {
+		got, err := Parse(tt.raw)
+		if err != nil {
+			t.Errorf("%q: %v", tt.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, raw := range []string{"a=%zz", "%=1", "a=%4"} {
+		if _, err := Parse(raw); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%q: got %v, want ErrMalformed", raw, err)
+		}
+	}
+}
+
+func TestEncodeBase64(t *testing.T) {
+	q := Query{{"data", "q+/x=="}, {"data", "a b&c"}}
+	if got, want := q.Encode(), "data=q%2B%2Fx%3D%3D&data=a+b%26c"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	q := Query{{"a", "1"}, {"b", "2"}, {"a", "3"}}
+	if v, ok := q.Get("a"); !ok || v != "1" {
+		t.Errorf("Get(a) = %q, %v", v, ok)
+	}
+	if _, ok := q.Get("c"); ok {
+		t.Error("Get(c) found a value")
+	}
+	if got := q.All("a"); !reflect.DeepEqual(got, []string{"1", "3"}) {
+		t.Errorf("All(a) = %v", got)
+	}
+}
+
+// FuzzEncodeParse checks that any parameters survive being encoded and
+// parsed, repeated keys and their order included.
+func FuzzEncodeParse(f *testing.F) {
+	f.Add("data", "q+/x==", "data", "a b&c")
+	f.Add("", "", "=", "%")
+	f.Add("ключ", "\x00\xff", "a&b", "?#")
+	f.Fuzz(func(t *testing.T, k1, v1, k2, v2 string) {
+		q := Query{{k1, v1}, {k2, v2}, {k1, v2}}
+		got, err := Parse(q.Encode())
+		if err != nil {
+			t.Fatalf("parsing %q: %v", q.Encode(), err)
+		}
+		if !reflect.DeepEqual(got, q) {
+			t.Fatalf("got %q, want %q", got, q)
+		}
+	})
+}
+
+// FuzzParse checks that whatever Parse accepts encodes to a query string that
+// parses back to the same parameters.
+func FuzzParse(f *testing.F) {
+	f.Add("a=1&b=2&a=3")
+	f.Add("a=x%2By&&flag&b=x+y")
+	f.Add("%zz")
+	f.Fuzz(func(t *testing.T, raw string) {
+		q, err := Parse(raw)
+		if err != nil {
+			return
+		}
+		again, err := Parse(q.Encode())
+		if err != nil {
+			t.Fatalf("parsing %q: %v", q.Encode(), err)
+		}
+		if len(q) == 0 && len(again) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(again, q) {
+			t.Fatalf("%q parsed as %q, re-encoded as %q", raw, q, again)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+// Package replay rejects stale and replayed protocol headers. A node accepts a
+// header only if its timestamp is within a freshness window of the node's
+// clock and its (RouteID, nonce, timestamp) triple has not been seen before.
+package replay
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrStale is returned for headers outside the freshness window.
+	ErrStale = errors.New("replay: stale header")
+	// ErrReplayed is returned for headers that have already been accepted.
+	ErrReplayed = errors.New("replay: duplicate header")
+)
+
+// ID identifies a header for replay detection.
+type ID struct {
+	RouteID   uint16
+	Nonce     uint64
+	Timestamp int64
+}
+
+// Stats are the cache's counters.
+type Stats struct {
+	Accepted uint64 `json:"accepted"`
+	Stale    uint64 `json:"stale"`
+	Replayed uint64 `json:"replayed"`
+	Evicted  uint64 `json:"evicted"`
+	Size     int    `json:"size"`
+}
+
+// Cache remembers the headers accepted within the freshness window. It holds
+// at most a fixed number of entries; when it is full the oldest entry is
+// evicted and headers no newer than it are from then on treated as stale, so
+// eviction never lets a replay through.
+type Cache struct {
+	window   time.Duration
+	capacity int
+
+	mu    sync.Mutex
+	seen  map[ID]struct{}
+	order []ID  // accepted IDs, by timestamp
+	floor int64 // timestamps at or below floor are stale
+	stats Stats
+}
+
+// NewCache returns a cache with the given freshness window and capacity.
+func NewCache(window time.Duration, capacity int) *Cache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Cache{window: window, capacity: capacity, seen: make(map[ID]struct{}), floor: -1 << 63}
+}
+
+// Check accepts id if it is fresh at now and has not been seen, and records
+// it. Otherwise it returns ErrStale or ErrReplayed.
+func (c *Cache) Check(id ID, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+
+	age := now.Sub(time.Unix(id.Timestamp, 0))
+	if age > c.window || age < -c.window || id.Timestamp <= c.floor {
+		c.stats.Stale++
+		return ErrStale
+	}
+	if _, ok := c.seen[id]; ok {
+		c.stats.Replayed++
+		return ErrReplayed
+	}
+
+	if len(c.order) == c.capacity {
+		if id.Timestamp <= c.order[0].Timestamp {
+			c.stats.Stale++
+			return ErrStale
+		}
+		c.evictOldest()
+	}
+	c.seen[id] = struct{}{}
+	i := sort.Search(len(c.order), func(i int) bool { return c.order[i].Timestamp > id.Timestamp })
+	c.order = append(c.order, ID{})
+	copy(c.order[i+1:], c.order[i:])
+	c.order[i] = id
+	c.stats.Accepted++
+	return nil
+}
+
+// Stats returns a snapshot of the cache's counters.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Size = len(c.seen)
+	return s
+}
+
+// expire drops entries that have left the freshness window; they would be
+// rejected as stale anyway.
+func (c *Cache) expire(now time.Time) {
+	cutoff := now.Add(-c.window).Unix()
+	n := 0
+	for n < len(c.order) && c.order[n].Timestamp < cutoff {
+		delete(c.seen, c.order[n])
+		n++
+	}
+	c.order = c.order[n:]
+}
+
+// evictOldest drops the entry with the lowest timestamp and raises the floor
+// to it.
+func (c *Cache) evictOldest() {
+	id := c.order[0]
+	delete(c.seen, id)
+	c.order = c.order[1:]
+	if id.Timestamp > c.floor {
+		c.floor = id.Timestamp
+	}
+	c.stats.Evicted++
+}
@@ -0,0 +1,125 @@
+package replay
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1_700_000_000, 0)
+
+// at returns the ID of a header with nonce sent secs seconds after start.
+func at(nonce uint64, secs int64) ID {
+	return ID{RouteID: 7, Nonce: nonce, Timestamp: start.Unix() + secs}
+}
+
+func TestCheckWindow(t *testing.T) {
+	c := NewCache(30*time.Second, 100)
+	for _, tt := range []struct {
+		id   ID
+		want error
+	}{
+		{at(1, 0), nil},
+		{at(2, -30), nil},
+		{at(3, 30), nil},
+		{at(4, -31), ErrStale},
+		{at(5, 31), ErrStale},
+	} {
+		if err := c.Check(tt.id, start); !errors.Is(err, tt.want) {
+			t.Errorf("header %ds from now: got %v, want %v", tt.id.Timestamp-start.Unix(), err, tt.want)
+		}
+	}
+	if s := c.Stats(); s.Accepted != 3 || s.Stale != 2 || s.Size != 3 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestCheckReplay(t *testing.T) {
+	c := NewCache(30*time.Second, 100)
+	if err := c.Check(at(1, 0), start); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Check(at(1, 0), start.Add(time.Second)); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("got %v, want ErrReplayed", err)
+	}
+	// Any field of the ID tells headers apart.
+	other := at(1, 0)
+	other.RouteID++
+	for _, id := range []ID{at(2, 0), at(1, 1), other} {
+		if err := c.Check(id, start); err != nil {
+			t.Errorf("%+v: %v", id, err)
+		}
+	}
+	// Once the window has passed, a replay is stale instead.
+	if err := c.Check(at(1, 0), start.Add(31*time.Second)); !errors.Is(err, ErrStale) {
+		t.Fatalf("got %v, want ErrStale", err)
+	}
+	if s := c.Stats(); s.Accepted != 4 || s.Replayed != 1 || s.Stale != 1 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+// TestExpire checks that entries leave the cache with the window, without
+// counting as evictions.
+func TestExpire(t *testing.T) {
+	c := NewCache(10*time.Second, 100)
+	for i := int64(0); i < 5; i++ {
+		c.Check(at(uint64(i), i), start.Add(time.Duration(i)*time.Second))
+	}
+	c.Check(at(99, 13), start.Add(13*time.Second))
+	if s := c.Stats(); s.Size != 3 || s.Evicted != 0 {
+		t.Errorf("stats %+v, want 3 entries and no evictions", s)
+	}
+}
+
+// TestEvict checks that a full cache evicts its oldest entry, and that
+// headers no newer than it are stale from then on, so that they cannot be
+// replayed.
+func TestEvict(t *testing.T) {
+	c := NewCache(time.Minute, 3)
+	for i := int64(0); i < 3; i++ {
+		if err := c.Check(at(uint64(i), i), start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Check(at(10, 0), start); !errors.Is(err, ErrStale) {
+		t.Fatalf("full cache took a header as old as its oldest: %v", err)
+	}
+	if err := c.Check(at(3, 3), start); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Check(at(0, 0), start); !errors.Is(err, ErrStale) {
+		t.Fatalf("evicted header replayed: %v", err)
+	}
+	if err := c.Check(at(11, 4), start); err != nil {
+		t.Fatalf("a header newer than the cache was refused: %v", err)
+	}
+	if s := c.Stats(); s.Size != 3 || s.Evicted != 2 || s.Accepted != 5 || s.Stale != 2 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestCheckConcurrent(t *testing.T) {
+	c := NewCache(time.Minute, 1000)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if c.Check(at(uint64(i), 0), start) == nil {
+					mu.Lock()
+					accepted++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if s := c.Stats(); accepted != 100 || s.Accepted != 100 || s.Replayed != 700 {
+		t.Errorf("accepted %d, stats %+v, want each header once", accepted, s)
+	}
+}
@@ -4,8 +4,6 @@ package routers
 import (
 	"log"
 
-	"tor-protocol/config"
-
 	"tor-protocol/controllers"
 	"tor-protocol/middleware"
 
@@ -22,40 +20,57 @@ func SetupRoutes(app *fiber.App) {
     })
 
     // -----------------------------------------------------------------------
-    // 1) Catch-all for "existing route" so that second/third hops keep going.
+    // 1) Node-to-node link: cells for circuits that pass through this node.
     // -----------------------------------------------------------------------
-    // If X-Tor-Route is already set, we know it's an in-progress multi-hop.
-    // We'll skip normal route parsing and forward again via ProxyMiddleware.
-    app.All("*", func(c *fiber.Ctx) error {
-        existingRoute := c.Get(config.CustomHeaderKey)
-        if existingRoute != "" {
-            return middleware.ProxyMiddleware(c)
-        }
-        return c.Next()
-    })
+    app.Post(middleware.CellPath, middleware.CellHandler)
+    // BB84 exchanges that establish the pairwise link keys
+    app.Post(middleware.LinkKeyPath, middleware.LinkKeyHandler)
+    app.Post(middleware.LinkParityPath, middleware.LinkParityHandler)
+    app.Post(middleware.LinkConfirmPath, middleware.LinkConfirmHandler)
+    app.Post(middleware.LinkKMEPath, middleware.LinkKMEHandler)
+
+    // ETSI GS QKD 014 key delivery from this node's simulated KME, and the
+    // delivery of keys between KMEs
+    app.Get(middleware.KMEStatusPath, middleware.KMEStatusHandler)
+    app.Get(middleware.KMEEncKeysPath, middleware.KMEEncKeysHandler)
+    app.Post(middleware.KMEEncKeysPath, middleware.KMEEncKeysHandler)
+    app.Get(middleware.KMEDecKeysPath, middleware.KMEDecKeysHandler)
+    app.Post(middleware.KMEDecKeysPath, middleware.KMEDecKeysHandler)
+    app.Post(middleware.KMEDeliverPath, middleware.KMEDeliverHandler)
+
+    // Node metrics (replay counters, live circuits, link keys, link health,
+    // bandwidth and entry guards)
+    app.Get(middleware.MetricsPath, middleware.MetricsHandler)
+
+    // Delay predictions from ai/main.py, for optimized route selection
+    app.Post(middleware.TrafficPath, middleware.TrafficHandler)
+    // The bandwidth and flags this node advertises
+    app.Get(middleware.DescriptorPath, middleware.DescriptorHandler)
 
-    // Middleware for custom headers (optional usage)
+    // Middleware for custom headers, required on every route below. The
+    // node-to-node routes above authenticate their callers themselves.
     app.Use(middleware.CustomHeaderMiddleware())
 
+    // Example route group, registered before the `:port` routes below (whose
+    // pattern would otherwise also match /home)
+    home := api.Group("/home")
+    home.Get("/", controllers.ReturnHome)
+
     // -----------------------------------------------------------------------
-    // 2) These routes handle the "first hop" – building or starting the route
-    //    if no X-Tor-Route exists yet.
+    // 2) These routes handle the "first hop" – sending the request through a
+    //    circuit to the destination node.
     // -----------------------------------------------------------------------
     // Proxy middleware for paths containing `:port.onion`
-    app.All("/:port<[0-9]+>.onion/*", middleware.ProxyMiddleware)
-    app.All("/:port<[0-9]+>.onion", middleware.ProxyExactMiddleware)
+    app.All("/:port<int>.onion/*", middleware.ProxyMiddleware)
+    app.All("/:port<int>.onion", middleware.ProxyExactMiddleware)
 
-    app.All("/:port<[0-9]+>/*", middleware.ProxyMiddleware)
-    app.All("/:port<[0-9]+>", middleware.ProxyExactMiddleware)
+    app.All("/:port<int>/*", middleware.ProxyMiddleware)
+    app.All("/:port<int>", middleware.ProxyExactMiddleware)
 
     // Serve local `.onion` routes as well
     app.Get("*.onion", controllers.HomeHandler)
     app.Get("*", controllers.HomeHandler)
 
-    // Example route group
-    home := api.Group("/home")
-    home.Get("/", controllers.ReturnHome)
-
     // Default route
     send_data := api.Group("/")
     send_data.Get("/", controllers.HomeHandler)
@@ -0,0 +1,273 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Position is where on a path a hop is. The guard is the first hop, which
+// sees the source; the exit is the last, the destination, which serves the
+// request; the hops in between are middles. Selectors only choose the guard
+// and the middles, but a node must be fit to be the exit of a path to it.
+type Position int
+
+const (
+	PositionGuard Position = iota
+	PositionMiddle
+	PositionExit
+)
+
+func (p Position) String() string {
+	switch p {
+	case PositionGuard:
+		return "guard"
+	case PositionMiddle:
+		return "middle"
+	case PositionExit:
+		return "exit"
+	}
+	return fmt.Sprintf("Position(%d)", int(p))
+}
+
+// Positions returns the positions of the n hops of a path, in path order, the
+// destination included.
+func Positions(n int) []Position {
+	positions := make([]Position, n)
+	for i := range positions {
+		switch {
+		case i == n-1:
+			positions[i] = PositionExit
+		case i == 0:
+			positions[i] = PositionGuard
+		default:
+			positions[i] = PositionMiddle
+		}
+	}
+	return positions
+}
+
+// Flags are the positions a node advertises it is fit for.
+type Flags uint8
+
+const (
+	FlagGuard Flags = 1 << iota
+	FlagExit
+)
+
+// ParseFlags parses flag names, "guard" and "exit".
+func ParseFlags(names []string) (Flags, error) {
+	var f Flags
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "guard":
+			f |= FlagGuard
+		case "exit":
+			f |= FlagExit
+		case "":
+		default:
+			return 0, fmt.Errorf("routing: unknown flag %q", name)
+		}
+	}
+	return f, nil
+}
+
+// Names returns the names of the flags set in f.
+func (f Flags) Names() []string {
+	names := []string{}
+	if f&FlagGuard != 0 {
+		names = append(names, "guard")
+	}
+	if f&FlagExit != 0 {
+		names = append(names, "exit")
+	}
+	return names
+}
+
+// PositionWeights scale a node's bandwidth by the position it is chosen for
+// and its flags, like the bandwidth weights of Tor's consensus: Wxy applies
+// at position x (guard, middle or exit) to a node flagged y (guard, exit, d
+// for both, m for neither). Nodes without the guard flag are never guards,
+// and nodes without the exit flag never exits. Lowering, say, Wmg keeps the
+// bandwidth of guards for the guard position.
+type PositionWeights struct {
+	Wgg, Wgd           float64
+	Wmg, Wmm, Wme, Wmd float64
+	Wee, Wed           float64
+}
+
+// DefaultPositionWeights weigh every eligible node by its bandwidth alone.
+var DefaultPositionWeights = PositionWeights{Wgg: 1, Wgd: 1, Wmg: 1, Wmm: 1, Wme: 1, Wmd: 1, Wee: 1, Wed: 1}
+
+// Set sets the weight named name, e.g. "Wmg".
+func (w *PositionWeights) Set(name string, v float64) error {
+	fields := map[string]*float64{
+		"Wgg": &w.Wgg, "Wgd": &w.Wgd,
+		"Wmg": &w.Wmg, "Wmm": &w.Wmm, "Wme": &w.Wme, "Wmd": &w.Wmd,
+		"Wee": &w.Wee, "Wed": &w.Wed,
+	}
+	p, ok := fields[name]
+	if !ok {
+		return fmt.Errorf("routing: unknown position weight %q", name)
+	}
+	if v < 0 {
+		return fmt.Errorf("routing: position weight %s must not be negative", name)
+	}
+	*p = v
+	return nil
+}
+
+// Factor returns the weight of a node flagged f at position p.
+func (w PositionWeights) Factor(p Position, f Flags) float64 {
+	guard, exit := f&FlagGuard != 0, f&FlagExit != 0
+	switch p {
+	case PositionGuard:
+		switch {
+		case guard && exit:
+			return w.Wgd
+		case guard:
+			return w.Wgg
+		}
+	case PositionMiddle:
+		switch {
+		case guard && exit:
+			return w.Wmd
+		case guard:
+			return w.Wmg
+		case exit:
+			return w.Wme
+		default:
+			return w.Wmm
+		}
+	case PositionExit:
+		switch {
+		case guard && exit:
+			return w.Wed
+		case exit:
+			return w.Wee
+		}
+	}
+	return 0
+}
+
+// BandwidthWeighted picks each hop at random with probability proportional
+// to its bandwidth times its position weight, the guard first, then the
+// middles, leaving out hops that would share a family, operator or subnet
+// with those already picked. The destination, the exit, is given; a path to a
+// node whose exit weight is 0 is refused. Nodes whose bandwidth is unknown
+// (or advertised as 0, before they have relayed anything) count as the
+// average known node, and nodes whose flags are unknown as flagged guard and
+// exit.
+type BandwidthWeighted struct {
+	Bandwidth func(addr string) (float64, bool)
+	Flags     func(addr string) (Flags, bool)
+	Weights   PositionWeights
+}
+
+func (s BandwidthWeighted) SelectPath(ctx context.Context, src, dst string, c Constraints) ([]Hop, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, flags := s.data([]string{dst}); s.Weights.Factor(PositionExit, flags[0]) == 0 {
+		return nil, noPath("position", "%s cannot be the exit of a path", dst)
+	}
+	candidates, n, err := c.plan(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	// Picking a hop may leave no node for a later one, and a shorter path
+	// has fewer positions to fill.
+	for ; ; n-- {
+		hops, err := s.pick(c, candidates, src, dst, n)
+		if err == nil {
+			return c.Path(hops, dst), nil
+		}
+		if n == 0 || n-1+c.guards() < c.MinHops {
+			return nil, err
+		}
+	}
+}
+
+// pick picks n intermediate hops after the guard out of candidates.
+func (s BandwidthWeighted) pick(c Constraints, candidates []string, src, dst string, n int) ([]string, error) {
+	candidates = slices.Clone(candidates)
+	bandwidths, flags := s.data(candidates)
+
+	// The guard is chosen first, unless it was chosen beforehand, then the
+	// middles. Nodes that cannot be on a path with those chosen so far are
+	// weighted 0; a middle no node can fill is left out.
+	g := c.guards()
+	positions := Positions(n + g + 1)[g : n+g]
+
+	chosen := c.ends(dst)
+	hops := make([]string, n)
+	var rejected []string
+	for at := range hops {
+		rejected = nil
+		usable := make([]bool, len(candidates))
+		for i, addr := range candidates {
+			err := c.Compatible(addr, chosen)
+			if usable[i] = err == nil; !usable[i] {
+				rejected = append(rejected, reason(err))
+			}
+		}
+		i, err := s.choose(bandwidths, flags, usable, positions[at])
+		if err != nil {
+			if positions[at] == PositionMiddle {
+				continue
+			}
+			return nil, noPath("position", "no node can be the %s between %s and %s%s", positions[at], src, dst, because(rejected))
+		}
+		hops[at] = candidates[i]
+		chosen = append(chosen, candidates[i])
+		candidates = slices.Delete(candidates, i, i+1)
+		bandwidths = slices.Delete(bandwidths, i, i+1)
+		flags = slices.Delete(flags, i, i+1)
+	}
+	hops = slices.DeleteFunc(hops, func(h string) bool { return h == "" })
+	return hops, c.enough(hops, rejected)
+}
+
+// Choose picks one of candidates for position p.
+func (s BandwidthWeighted) Choose(candidates []string, p Position) (string, error) {
+	bandwidths, flags := s.data(candidates)
+	i, err := s.choose(bandwidths, flags, nil, p)
+	if err != nil {
+		return "", err
+	}
+	return candidates[i], nil
+}
+
+// data returns the bandwidths and flags of candidates.
+func (s BandwidthWeighted) data(candidates []string) ([]float64, []Flags) {
+	bandwidths := Weighted{Weight: s.Bandwidth}.weights(candidates)
+	flags := make([]Flags, len(candidates))
+	for i, addr := range candidates {
+		flags[i] = FlagGuard | FlagExit
+		if s.Flags != nil {
+			if f, ok := s.Flags(addr); ok {
+				flags[i] = f
+			}
+		}
+	}
+	return bandwidths, flags
+}
+
+// choose picks the index of a node for position p, out of those usable if
+// usable is not nil.
+func (s BandwidthWeighted) choose(bandwidths []float64, flags []Flags, usable []bool, p Position) (int, error) {
+	weights := make([]float64, len(bandwidths))
+	var total float64
+	for i := range bandwidths {
+		if usable != nil && !usable[i] {
+			continue
+		}
+		weights[i] = bandwidths[i] * s.Weights.Factor(p, flags[i])
+		total += weights[i]
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("%w: no node can be the %s", ErrNoPath, p)
+	}
+	return pick(weights), nil
+}
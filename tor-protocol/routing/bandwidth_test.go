@@ -0,0 +1,154 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// load is how often each node was on a path, by position, over a simulation.
+type load map[string]map[Position]int
+
+// simulate selects n paths from src to each of dsts in turn, and returns how
+// often each node was on them, to show how s spreads traffic over the nodes.
+func simulate(t *testing.T, s PathSelector, src string, dsts []string, c Constraints, n int) load {
+	t.Helper()
+	l := make(load)
+	for i := 0; i < n; i++ {
+		p, err := s.SelectPath(context.Background(), src, dsts[i%len(dsts)], c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, pos := range Positions(len(p)) {
+			if l[p[j].Addr] == nil {
+				l[p[j].Addr] = make(map[Position]int)
+			}
+			l[p[j].Addr][pos]++
+		}
+	}
+	return l
+}
+
+// share returns the share of the picks for position p that went to each node.
+func (l load) share(p Position) map[string]float64 {
+	total := 0
+	for _, byPos := range l {
+		total += byPos[p]
+	}
+	shares := make(map[string]float64)
+	for addr, byPos := range l {
+		shares[addr] = float64(byPos[p]) / float64(max(total, 1))
+	}
+	return shares
+}
+
+// String lays the load out as a table, for the test log.
+func (l load) String() string {
+	addrs := slices.Sorted(maps.Keys(l))
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-6s %7s %7s %7s\n", "node", "guard", "middle", "exit")
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, "%-6s %7d %7d %7d\n", addr, l[addr][PositionGuard], l[addr][PositionMiddle], l[addr][PositionExit])
+	}
+	return b.String()
+}
+
+func bandwidthSelector(bandwidths map[string]float64, flags map[string]Flags, w PositionWeights) BandwidthWeighted {
+	return BandwidthWeighted{
+		Bandwidth: func(addr string) (float64, bool) { bw, ok := bandwidths[addr]; return bw, ok },
+		Flags:     func(addr string) (Flags, bool) { f, ok := flags[addr]; return f, ok },
+		Weights:   w,
+	}
+}
+
+// TestBandwidthLoadDistribution simulates many circuits and checks that each
+// node carries a share of them in proportion to its bandwidth.
+func TestBandwidthLoadDistribution(t *testing.T) {
+	bandwidths := map[string]float64{"8802": 100, "8803": 200, "8804": 300, "8805": 400}
+	s := bandwidthSelector(bandwidths, nil, DefaultPositionWeights)
+	c := Constraints{Nodes: testNodes, MinHops: 1, MaxHops: 1}
+	l := simulate(t, s, "8801", []string{"8806"}, c, 20000)
+	t.Logf("load over 20000 paths:\n%s", l)
+
+	shares := l.share(PositionGuard)
+	for addr, bw := range bandwidths {
+		if want := bw / 1000; math.Abs(shares[addr]-want) > 0.02 {
+			t.Errorf("%s carried %.3f of the load, want %.3f", addr, shares[addr], want)
+		}
+	}
+	if got := l["8806"][PositionExit]; got != 20000 {
+		t.Errorf("the destination exited %d paths, want all", got)
+	}
+}
+
+// TestPositionWeights checks that the position weights keep nodes to the
+// positions they are weighted for.
+func TestPositionWeights(t *testing.T) {
+	bandwidths := map[string]float64{"8802": 1000, "8803": 100, "8804": 100, "8805": 100}
+	flags := map[string]Flags{"8802": FlagGuard, "8803": 0, "8804": 0, "8805": FlagGuard | FlagExit, "8806": FlagExit}
+	w := DefaultPositionWeights
+	// Keep the fast guard for the guard position.
+	w.Wmg = 0
+	s := bandwidthSelector(bandwidths, flags, w)
+	c := Constraints{Nodes: testNodes, MinHops: 3, MaxHops: 3}
+	l := simulate(t, s, "8801", []string{"8806"}, c, 5000)
+	t.Logf("load over 5000 paths:\n%s", l)
+
+	for _, addr := range []string{"8803", "8804"} {
+		if l[addr][PositionGuard] != 0 {
+			t.Errorf("%s has no guard flag but was a guard %d times", addr, l[addr][PositionGuard])
+		}
+	}
+	if l["8802"][PositionMiddle] != 0 {
+		t.Errorf("8802 is weighted 0 as a middle but was one %d times", l["8802"][PositionMiddle])
+	}
+	if l["8802"][PositionGuard] < 4000 {
+		t.Errorf("8802 was the guard of %d paths only", l["8802"][PositionGuard])
+	}
+}
+
+func TestBandwidthRefusesNonExitDestination(t *testing.T) {
+	s := bandwidthSelector(nil, map[string]Flags{"8806": FlagGuard}, DefaultPositionWeights)
+	_, err := s.SelectPath(context.Background(), "8801", "8806", Constraints{Nodes: testNodes, MinHops: 1})
+	var cerr *ConstraintError
+	if !errors.As(err, &cerr) || cerr.Rule != "position" || !errors.Is(err, ErrNoPath) {
+		t.Fatalf("got %v, want a position ErrNoPath", err)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	for n, want := range map[int][]Position{
+		1: {PositionExit},
+		2: {PositionGuard, PositionExit},
+		4: {PositionGuard, PositionMiddle, PositionMiddle, PositionExit},
+	} {
+		got := Positions(n)
+		if len(got) != len(want) {
+			t.Fatalf("Positions(%d) = %v", n, got)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("Positions(%d) = %v, want %v", n, got, want)
+				break
+			}
+		}
+	}
+}
+
+// TestPickNeverPicksZeroWeight checks the fallback for rounding: the weights
+// below add up to just over 1, so a draw just under 1 runs past them all, and
+// must still not land on the node of weight 0.
+func TestPickNeverPicksZeroWeight(t *testing.T) {
+	weights := []float64{0.1, 0.2, 0.7, 0}
+	if got := pickAt(weights, math.Nextafter(1, 0)); got != 2 {
+		t.Fatalf("picked %d, want 2", got)
+	}
+	if got := pickAt([]float64{0, 0}, 0.5); got != 0 {
+		t.Fatalf("picked %d out of weights 0, want 0", got)
+	}
+}
@@ -0,0 +1,292 @@
+package routing
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+)
+
+// Constraints bound the paths a selector may return. They are declarative:
+// the built-in selectors pick hops within them, and Check tells whether any
+// path keeps to them and, if not, which rule it breaks.
+type Constraints struct {
+	// Nodes are the nodes of the network, the source and destination
+	// included.
+	Nodes []string
+	// MinHops and MaxHops bound the number of intermediate hops, the guard
+	// included; a MaxHops of 0 sets no upper bound.
+	MinHops, MaxHops int
+	// Exclude, if not nil, returns why a node must not be an intermediate
+	// hop, or nil if it may be one.
+	Exclude func(addr string) error
+	// Guard, if set, is the first hop, an entry guard chosen beforehand
+	// (see GuardSet). Selectors pick the hops after it, and count it
+	// against MinHops and MaxHops.
+	Guard string
+	// Family and Operator, if not nil, return the family and operator
+	// declared for a node, "" for none. No two nodes on a path, the
+	// destination included, may share either.
+	Family, Operator func(addr string) string
+	// Subnet, if not nil, returns the address prefix of a node, such as
+	// its /24. No two nodes on a path may share one.
+	Subnet func(addr string) (string, error)
+}
+
+// ConstraintError explains which rule of the constraints a path breaks, or
+// why no path can keep to them. It wraps ErrViolation or ErrNoPath. Rule is
+// one of "hops", "endpoints", "guard", "exclude", "repeat", "family",
+// "operator", "subnet" and "position".
+type ConstraintError struct {
+	Rule   string
+	Reason string
+	err    error
+}
+
+func (e *ConstraintError) Error() string { return fmt.Sprintf("%v: %s: %s", e.err, e.Rule, e.Reason) }
+func (e *ConstraintError) Unwrap() error { return e.err }
+
+func violation(rule, format string, args ...any) error {
+	return &ConstraintError{Rule: rule, Reason: fmt.Sprintf(format, args...), err: ErrViolation}
+}
+
+func noPath(rule, format string, args ...any) error {
+	return &ConstraintError{Rule: rule, Reason: fmt.Sprintf(format, args...), err: ErrNoPath}
+}
+
+// reason returns the explanation in err.
+func reason(err error) string {
+	if e, ok := err.(*ConstraintError); ok {
+		return e.Reason
+	}
+	return err.Error()
+}
+
+// because lists the reasons nodes were passed over, each once, for error
+// messages.
+func because(reasons []string) string {
+	var unique []string
+	for _, r := range reasons {
+		if !slices.Contains(unique, r) {
+			unique = append(unique, r)
+		}
+	}
+	if len(unique) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(unique, "; ") + ")"
+}
+
+// Check reports whether path, from src to dst, keeps to c, and otherwise
+// returns a *ConstraintError naming the first rule it breaks.
+func (c Constraints) Check(src, dst string, path []Hop) error {
+	if len(path) == 0 || path[len(path)-1].Addr != dst {
+		return violation("endpoints", "path %v does not end at the destination %s", Addrs(path), dst)
+	}
+	hops := Addrs(path[:len(path)-1])
+	if len(hops) < c.MinHops || (c.MaxHops > 0 && len(hops) > c.MaxHops) {
+		return violation("hops", "%d intermediate hops, %s allowed", len(hops), c.hopRange())
+	}
+	if c.Guard != "" && (len(hops) == 0 || hops[0] != c.Guard) {
+		return violation("guard", "path %v does not start at the entry guard %s", Addrs(path), c.Guard)
+	}
+	chosen := []string{dst}
+	for _, h := range hops {
+		if h == src {
+			return violation("endpoints", "the source %s is on the path", src)
+		}
+		if !slices.Contains(c.Nodes, h) {
+			return violation("exclude", "%s is not a known node", h)
+		}
+		if c.Exclude != nil {
+			if err := c.Exclude(h); err != nil {
+				return violation("exclude", "%s: %v", h, err)
+			}
+		}
+		if err := c.Compatible(h, chosen); err != nil {
+			return err
+		}
+		chosen = append(chosen, h)
+	}
+	return nil
+}
+
+// Compatible returns a *ConstraintError if addr cannot be on a path with the
+// nodes in chosen: it is one of them, or shares a family, operator or subnet
+// with one of them.
+func (c Constraints) Compatible(addr string, chosen []string) error {
+	for _, other := range chosen {
+		if addr == other {
+			return violation("repeat", "%s is on the path twice", addr)
+		}
+		if c.Family != nil {
+			if f := c.Family(addr); f != "" && f == c.Family(other) {
+				return violation("family", "%s and %s are both in family %q", addr, other, f)
+			}
+		}
+		if c.Operator != nil {
+			if o := c.Operator(addr); o != "" && o == c.Operator(other) {
+				return violation("operator", "%s and %s are both run by %q", addr, other, o)
+			}
+		}
+		if c.Subnet != nil {
+			a, err := c.Subnet(addr)
+			if err != nil {
+				return violation("subnet", "%v", err)
+			}
+			b, err := c.Subnet(other)
+			if err != nil {
+				return violation("subnet", "%v", err)
+			}
+			if a == b {
+				return violation("subnet", "%s and %s are both in %s", addr, other, a)
+			}
+		}
+	}
+	return nil
+}
+
+// Candidates returns the nodes of c that may be intermediate hops between src
+// and dst, after the guard.
+func (c Constraints) Candidates(src, dst string) []string {
+	candidates, _ := c.candidates(src, dst)
+	return candidates
+}
+
+// candidates returns the candidates between src and dst, and why the other
+// nodes were passed over.
+func (c Constraints) candidates(src, dst string) ([]string, []string) {
+	var out, rejected []string
+	ends := c.ends(dst)
+	for _, n := range c.Nodes {
+		if n == src || slices.Contains(ends, n) || slices.Contains(out, n) {
+			continue
+		}
+		if c.Exclude != nil {
+			if err := c.Exclude(n); err != nil {
+				rejected = append(rejected, fmt.Sprintf("%s: %v", n, err))
+				continue
+			}
+		}
+		if err := c.Compatible(n, ends); err != nil {
+			rejected = append(rejected, reason(err))
+			continue
+		}
+		out = append(out, n)
+	}
+	return out, rejected
+}
+
+// ends returns the nodes on every path to dst: dst and the guard.
+func (c Constraints) ends(dst string) []string {
+	if c.Guard != "" {
+		return []string{c.Guard, dst}
+	}
+	return []string{dst}
+}
+
+// guards returns the number of hops taken by the guard, 0 or 1.
+func (c Constraints) guards() int {
+	if c.Guard != "" {
+		return 1
+	}
+	return 0
+}
+
+func (c Constraints) hopRange() string {
+	if c.MaxHops > 0 && c.MaxHops == c.MinHops {
+		return fmt.Sprintf("exactly %d", c.MinHops)
+	}
+	if c.MaxHops > 0 {
+		return fmt.Sprintf("%d to %d", c.MinHops, c.MaxHops)
+	}
+	return fmt.Sprintf("at least %d", c.MinHops)
+}
+
+// HopCount picks a number of intermediate hops after the guard uniformly
+// within the bounds of c, out of available candidates.
+func (c Constraints) HopCount(available int) (int, error) {
+	g := c.guards()
+	lo, hi := max(c.MinHops-g, 0), available
+	if c.MaxHops > 0 {
+		hi = min(hi, c.MaxHops-g)
+	}
+	if lo > hi {
+		return 0, noPath("hops", "%s intermediate hops allowed, %d available", c.hopRange(), available+g)
+	}
+	return lo + rand.IntN(hi-lo+1), nil
+}
+
+// plan returns the candidates between src and dst and the number of hops to
+// pick from them, explaining which nodes were passed over if they are too
+// few.
+func (c Constraints) plan(src, dst string) ([]string, int, error) {
+	candidates, rejected := c.candidates(src, dst)
+	n, err := c.HopCount(len(candidates))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w%s", err, because(rejected))
+	}
+	return candidates, n, nil
+}
+
+// take picks up to n of ordered, in order, that can be on a path with dst,
+// the guard and each other. It fails if that leaves fewer hops than MinHops.
+func (c Constraints) take(ordered []string, dst string, n int) ([]string, error) {
+	chosen := c.ends(dst)
+	var hops, rejected []string
+	for _, addr := range ordered {
+		if len(hops) == n {
+			break
+		}
+		if err := c.Compatible(addr, chosen); err != nil {
+			rejected = append(rejected, reason(err))
+			continue
+		}
+		hops = append(hops, addr)
+		chosen = append(chosen, addr)
+	}
+	return hops, c.enough(hops, rejected)
+}
+
+// sample picks up to n of candidates at random in proportion to weights,
+// that can be on a path with dst, the guard and each other. It fails if that
+// leaves fewer hops than MinHops.
+func (c Constraints) sample(candidates []string, weights []float64, dst string, n int) ([]string, error) {
+	candidates, weights = slices.Clone(candidates), slices.Clone(weights)
+	chosen := c.ends(dst)
+	var hops, rejected []string
+	for len(hops) < n && len(candidates) > 0 {
+		i := pick(weights)
+		addr := candidates[i]
+		candidates = slices.Delete(candidates, i, i+1)
+		weights = slices.Delete(weights, i, i+1)
+		if err := c.Compatible(addr, chosen); err != nil {
+			rejected = append(rejected, reason(err))
+			continue
+		}
+		hops = append(hops, addr)
+		chosen = append(chosen, addr)
+	}
+	return hops, c.enough(hops, rejected)
+}
+
+// enough reports whether hops, with the guard, make MinHops.
+func (c Constraints) enough(hops, rejected []string) error {
+	if len(hops)+c.guards() < c.MinHops {
+		return noPath("hops", "at most %d intermediate hops fit on one path, %s allowed%s", len(hops)+c.guards(), c.hopRange(), because(rejected))
+	}
+	return nil
+}
+
+// Path turns the intermediate hops picked after the guard into a path from
+// the guard to dst.
+func (c Constraints) Path(hops []string, dst string) []Hop {
+	p := make([]Hop, 0, len(hops)+2)
+	if c.Guard != "" {
+		p = append(p, Hop{Addr: c.Guard})
+	}
+	for _, h := range hops {
+		p = append(p, Hop{Addr: h})
+	}
+	return append(p, Hop{Addr: dst})
+}
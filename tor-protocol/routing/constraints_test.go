@@ -0,0 +1,183 @@
+package routing
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// path returns the path through addrs.
+func path(addrs ...string) []Hop {
+	p := make([]Hop, len(addrs))
+	for i, a := range addrs {
+		p[i] = Hop{Addr: a}
+	}
+	return p
+}
+
+// subnet24 returns the /24 of the node on port, from addrs.
+func subnet24(addrs map[string]string) func(string) (string, error) {
+	return func(port string) (string, error) {
+		addr, err := netip.ParseAddr(addrs[port])
+		if err != nil {
+			return "", err
+		}
+		prefix, err := addr.Prefix(24)
+		return prefix.String(), err
+	}
+}
+
+// wantRule checks that err is a *ConstraintError for rule wrapping sentinel.
+func wantRule(t *testing.T, err error, sentinel error, rule string) {
+	t.Helper()
+	var cerr *ConstraintError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("got %v, want a %s error", err, rule)
+	}
+	if cerr.Rule != rule || !errors.Is(err, sentinel) {
+		t.Fatalf("got %v (rule %q), want %v for rule %q", err, cerr.Rule, sentinel, rule)
+	}
+	if !strings.Contains(err.Error(), cerr.Reason) {
+		t.Fatalf("%q does not explain %q", err, cerr.Reason)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	families := map[string]string{"8802": "red", "8804": "red"}
+	operators := map[string]string{"8803": "acme", "8805": "acme"}
+	c := Constraints{
+		Nodes:    testNodes,
+		MinHops:  2,
+		MaxHops:  3,
+		Family:   func(addr string) string { return families[addr] },
+		Operator: func(addr string) string { return operators[addr] },
+		Exclude: func(addr string) error {
+			if addr == "8806" {
+				return errors.New("link compromised")
+			}
+			return nil
+		},
+	}
+	for _, tt := range []struct {
+		name string
+		dst  string
+		path []Hop
+		rule string
+	}{
+		{"too few hops", "8805", path("8802", "8805"), "hops"},
+		{"too many hops", "8805", path("8802", "8803", "8806", "8804", "8805"), "hops"},
+		{"wrong end", "8805", path("8802", "8803", "8804"), "endpoints"},
+		{"empty", "8805", nil, "endpoints"},
+		{"source on path", "8805", path("8801", "8802", "8805"), "endpoints"},
+		{"unknown node", "8805", path("8802", "8899", "8805"), "exclude"},
+		{"excluded node", "8805", path("8802", "8806", "8805"), "exclude"},
+		{"repeated node", "8805", path("8802", "8802", "8805"), "repeat"},
+		{"destination repeated", "8805", path("8805", "8802", "8805"), "repeat"},
+		{"family", "8803", path("8802", "8804", "8803"), "family"},
+		{"operator", "8805", path("8802", "8803", "8805"), "operator"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			wantRule(t, c.Check("8801", tt.dst, tt.path), ErrViolation, tt.rule)
+		})
+	}
+
+	if err := c.Check("8801", "8806", path("8802", "8803", "8806")); err != nil {
+		t.Errorf("rejected a valid path: %v", err)
+	}
+}
+
+func TestCheckGuard(t *testing.T) {
+	c := Constraints{Nodes: testNodes, MinHops: 1, Guard: "8802"}
+	wantRule(t, c.Check("8801", "8806", path("8803", "8806")), ErrViolation, "guard")
+	if err := c.Check("8801", "8806", path("8802", "8803", "8806")); err != nil {
+		t.Errorf("rejected a path from the guard: %v", err)
+	}
+}
+
+func TestCompatibleSubnet(t *testing.T) {
+	c := Constraints{Subnet: subnet24(map[string]string{
+		"8802": "10.0.1.5",
+		"8803": "10.0.1.200",
+		"8804": "10.0.2.5",
+		"8805": "not an address",
+	})}
+	wantRule(t, c.Compatible("8803", []string{"8802"}), ErrViolation, "subnet")
+	if err := c.Compatible("8804", []string{"8802", "8803"}); err != nil {
+		t.Errorf("10.0.2.0/24 clashed: %v", err)
+	}
+	wantRule(t, c.Compatible("8805", []string{"8802"}), ErrViolation, "subnet")
+	wantRule(t, c.Compatible("8802", []string{"8804", "8802"}), ErrViolation, "repeat")
+}
+
+func TestHopCount(t *testing.T) {
+	for _, tt := range []struct {
+		c         Constraints
+		available int
+		lo, hi    int
+	}{
+		{Constraints{MinHops: 1, MaxHops: 3}, 5, 1, 3},
+		{Constraints{MinHops: 2}, 4, 2, 4},
+		{Constraints{MinHops: 3, MaxHops: 3}, 5, 3, 3},
+		// The guard counts against the bounds.
+		{Constraints{MinHops: 2, MaxHops: 3, Guard: "8802"}, 5, 1, 2},
+		{Constraints{MinHops: 0, MaxHops: 1, Guard: "8802"}, 5, 0, 0},
+	} {
+		seen := map[int]bool{}
+		for i := 0; i < 200; i++ {
+			n, err := tt.c.HopCount(tt.available)
+			if err != nil {
+				t.Fatalf("%+v: %v", tt.c, err)
+			}
+			if n < tt.lo || n > tt.hi {
+				t.Fatalf("%+v: %d hops, want %d to %d", tt.c, n, tt.lo, tt.hi)
+			}
+			seen[n] = true
+		}
+		if len(seen) != tt.hi-tt.lo+1 {
+			t.Errorf("%+v: picked only %v", tt.c, seen)
+		}
+	}
+
+	_, err := Constraints{MinHops: 4, MaxHops: 5}.HopCount(3)
+	wantRule(t, err, ErrNoPath, "hops")
+	if !strings.Contains(err.Error(), "4 to 5 intermediate hops allowed, 3 available") {
+		t.Errorf("unhelpful error: %v", err)
+	}
+}
+
+func TestEnough(t *testing.T) {
+	c := Constraints{MinHops: 3, MaxHops: 3}
+	if err := c.enough([]string{"8802", "8803", "8804"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	err := c.enough([]string{"8802"}, []string{"8803 and 8802 are both in family \"red\"", "8803 and 8802 are both in family \"red\""})
+	wantRule(t, err, ErrNoPath, "hops")
+	if strings.Count(err.Error(), "family") != 1 {
+		t.Errorf("reasons not listed once each: %v", err)
+	}
+	c.Guard = "8805"
+	if err := c.enough([]string{"8802", "8803"}, nil); err != nil {
+		t.Errorf("the guard did not count: %v", err)
+	}
+}
+
+// TestSelectorsExplainNoPath checks that a selector left without enough hops
+// says which rule ruled the nodes out.
+func TestSelectorsExplainNoPath(t *testing.T) {
+	c := Constraints{
+		Nodes:   testNodes,
+		MinHops: 2,
+		Family:  func(string) string { return "everyone" },
+	}
+	for name, s := range map[string]PathSelector{
+		"bandwidth": bandwidthSelector(nil, nil, DefaultPositionWeights),
+		"predicted": Predicted{Delays: func() map[string]float64 { return map[string]float64{"8802": 0.1} }},
+	} {
+		_, err := s.SelectPath(t.Context(), "8801", "8806", c)
+		wantRule(t, err, ErrNoPath, "hops")
+		if !strings.Contains(err.Error(), "family") {
+			t.Errorf("%s: %v does not name the family rule", name, err)
+		}
+	}
+}
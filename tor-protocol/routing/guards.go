@@ -0,0 +1,216 @@
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"tor-protocol/atomicfile"
+)
+
+// ErrNoGuard is returned when no entry guard can start a circuit.
+var ErrNoGuard = errors.New("routing: no usable entry guard")
+
+// Guard is an entry guard: one of the few nodes every circuit of a node
+// starts at, kept for a long time so that the node does not, circuit after
+// circuit, expose its traffic to a growing share of the network.
+type Guard struct {
+	Addr        string    `json:"addr"`
+	Added       time.Time `json:"added"`
+	Expires     time.Time `json:"expires"`
+	Failures    int       `json:"failures,omitempty"` // consecutive
+	LastFailure time.Time `json:"last_failure,omitzero"`
+}
+
+// GuardSet keeps up to Size entry guards in the JSON file at Path. Each guard
+// is kept for Lifetime to 1.5 Lifetime, chosen at random so that guards do
+// not all rotate at once, and dropped early once MaxFailures circuits in a
+// row failed at it. A guard that failed is passed over for Retry in favour of
+// the next one.
+type GuardSet struct {
+	Path        string
+	Size        int
+	Lifetime    time.Duration
+	MaxFailures int
+	Retry       time.Duration
+	// Logf, if not nil, logs the guards added and dropped.
+	Logf func(format string, args ...any)
+	// Now, if not nil, stands in for time.Now.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	guards []Guard
+	loaded bool
+}
+
+// guardFile is the on-disk format of a GuardSet.
+type guardFile struct {
+	Guards []Guard `json:"guards"`
+}
+
+// Pick returns the guard a new circuit starts at: the first guard, in the
+// order they were added, that is among nodes, usable on the circuit (usable
+// returns why not, say because it is the destination) and has not failed
+// within Retry, or failing that the first that is among nodes and usable.
+// Expired guards are dropped first, and the set topped up to Size with nodes
+// chosen by choose.
+func (g *GuardSet) Pick(nodes []string, usable func(addr string) error, choose func(candidates []string) (string, error)) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.load(); err != nil {
+		return "", err
+	}
+
+	now := g.now()
+	changed := false
+	g.guards = slices.DeleteFunc(g.guards, func(guard Guard) bool {
+		if now.Before(guard.Expires) {
+			return false
+		}
+		g.logf("Entry guard %s expired, rotating it out", guard.Addr)
+		changed = true
+		return true
+	})
+	for len(g.guards) < g.Size {
+		var candidates []string
+		for _, n := range nodes {
+			if !slices.ContainsFunc(g.guards, func(guard Guard) bool { return guard.Addr == n }) {
+				candidates = append(candidates, n)
+			}
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		addr, err := choose(candidates)
+		if err != nil {
+			return "", err
+		}
+		lifetime := g.Lifetime + rand.N(g.Lifetime/2+1)
+		g.guards = append(g.guards, Guard{Addr: addr, Added: now, Expires: now.Add(lifetime)})
+		g.logf("Added entry guard %s until %s", addr, now.Add(lifetime).Format(time.RFC3339))
+		changed = true
+	}
+	if changed {
+		if err := g.save(); err != nil {
+			return "", err
+		}
+	}
+
+	fallback := ""
+	var reasons []string
+	for _, guard := range g.guards {
+		if !slices.Contains(nodes, guard.Addr) {
+			reasons = append(reasons, guard.Addr+" is not a candidate")
+			continue
+		}
+		if err := usable(guard.Addr); err != nil {
+			reasons = append(reasons, reason(err))
+			continue
+		}
+		if guard.Failures == 0 || now.Sub(guard.LastFailure) > g.Retry {
+			return guard.Addr, nil
+		}
+		if fallback == "" {
+			fallback = guard.Addr
+		}
+	}
+	if fallback == "" {
+		return "", fmt.Errorf("%w: none of %d guards is usable%s", ErrNoGuard, len(g.guards), because(reasons))
+	}
+	return fallback, nil
+}
+
+// Failed records that a circuit failed at guard addr, and drops the guard
+// after MaxFailures failures in a row.
+func (g *GuardSet) Failed(addr string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.load(); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(g.guards, func(guard Guard) bool { return guard.Addr == addr })
+	if i < 0 {
+		return nil
+	}
+	g.guards[i].Failures++
+	g.guards[i].LastFailure = g.now()
+	if g.guards[i].Failures >= g.MaxFailures {
+		g.logf("Dropping entry guard %s after %d failures in a row", addr, g.guards[i].Failures)
+		g.guards = slices.Delete(g.guards, i, i+1)
+	}
+	return g.save()
+}
+
+// Succeeded records that a circuit was created at guard addr.
+func (g *GuardSet) Succeeded(addr string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.load(); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(g.guards, func(guard Guard) bool { return guard.Addr == addr })
+	if i < 0 || g.guards[i].Failures == 0 {
+		return nil
+	}
+	g.guards[i].Failures = 0
+	g.guards[i].LastFailure = time.Time{}
+	return g.save()
+}
+
+// Guards returns a copy of the guards.
+func (g *GuardSet) Guards() ([]Guard, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.load(); err != nil {
+		return nil, err
+	}
+	return slices.Clone(g.guards), nil
+}
+
+// load reads the guards from Path the first time it is called. g.mu must be
+// held.
+func (g *GuardSet) load() error {
+	if g.loaded {
+		return nil
+	}
+	data, err := os.ReadFile(g.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var f guardFile
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &f); err != nil {
+			return fmt.Errorf("routing: parse %s: %w", g.Path, err)
+		}
+	}
+	g.guards, g.loaded = f.Guards, true
+	return nil
+}
+
+// save writes the guards to Path, replacing the file atomically. g.mu must
+// be held.
+func (g *GuardSet) save() error {
+	data, err := json.MarshalIndent(guardFile{Guards: g.guards}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(g.Path, data, 0600)
+}
+
+func (g *GuardSet) now() time.Time {
+	if g.Now != nil {
+		return g.Now()
+	}
+	return time.Now()
+}
+
+func (g *GuardSet) logf(format string, args ...any) {
+	if g.Logf != nil {
+		g.Logf(format, args...)
+	}
+}
@@ -0,0 +1,162 @@
+package routing
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that moves only when told to.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) Now() time.Time      { return c.t }
+func (c *fakeClock) Add(d time.Duration) { c.t = c.t.Add(d) }
+
+func anyUsable(string) error { return nil }
+
+// first chooses the first candidate as the new guard.
+func first(candidates []string) (string, error) { return candidates[0], nil }
+
+// testGuards returns a set of two guards kept in a temporary directory.
+func testGuards(t *testing.T, clock *fakeClock) *GuardSet {
+	t.Helper()
+	return &GuardSet{
+		Path:        filepath.Join(t.TempDir(), "guards.json"),
+		Size:        2,
+		Lifetime:    24 * time.Hour,
+		MaxFailures: 3,
+		Retry:       time.Minute,
+		Now:         clock.Now,
+	}
+}
+
+func guardAddrs(t *testing.T, g *GuardSet) []string {
+	t.Helper()
+	guards, err := g.Guards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, guard := range guards {
+		addrs = append(addrs, guard.Addr)
+	}
+	return addrs
+}
+
+// TestGuardsPersist checks that guards survive a restart: a new set on the
+// same file picks the same guards, and the file is private to the node.
+func TestGuardsPersist(t *testing.T) {
+	clock := &fakeClock{time.Unix(1_700_000_000, 0)}
+	g := testGuards(t, clock)
+	if addr, err := g.Pick(testNodes, anyUsable, first); err != nil || addr != "8801" {
+		t.Fatalf("picked %q, %v", addr, err)
+	}
+	if err := g.Failed("8802"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &GuardSet{Path: g.Path, Size: 2, Lifetime: g.Lifetime, MaxFailures: 3, Retry: time.Minute, Now: clock.Now}
+	before, _ := g.Guards()
+	after, err := reloaded.Guards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 2 || !slices.EqualFunc(before, after, func(a, b Guard) bool {
+		return a.Addr == b.Addr && a.Expires.Equal(b.Expires) && a.Failures == b.Failures
+	}) {
+		t.Fatalf("reloaded %+v, want %+v", after, before)
+	}
+	choose := func([]string) (string, error) { return "", errors.New("chose a new guard") }
+	if addr, err := reloaded.Pick(testNodes, anyUsable, choose); err != nil || addr != "8801" {
+		t.Fatalf("picked %q, %v after reloading", addr, err)
+	}
+
+	info, err := os.Stat(g.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("guard file mode %v, want 0600", perm)
+	}
+}
+
+// TestGuardsRotate checks that guards are kept for their lifetime and
+// replaced once it has passed.
+func TestGuardsRotate(t *testing.T) {
+	clock := &fakeClock{time.Unix(1_700_000_000, 0)}
+	g := testGuards(t, clock)
+	if _, err := g.Pick(testNodes, anyUsable, first); err != nil {
+		t.Fatal(err)
+	}
+	guards, _ := g.Guards()
+	for _, guard := range guards {
+		if lifetime := guard.Expires.Sub(guard.Added); lifetime < g.Lifetime || lifetime > g.Lifetime*3/2 {
+			t.Errorf("%s kept for %s, want %s to 1.5 times that", guard.Addr, lifetime, g.Lifetime)
+		}
+	}
+
+	clock.Add(g.Lifetime - time.Second)
+	g.Pick(testNodes, anyUsable, first)
+	if got := guardAddrs(t, g); !slices.Equal(got, []string{"8801", "8802"}) {
+		t.Fatalf("guards %v changed before their lifetime", got)
+	}
+
+	clock.Add(g.Lifetime)
+	last := func(candidates []string) (string, error) { return candidates[len(candidates)-1], nil }
+	if addr, err := g.Pick(testNodes, anyUsable, last); err != nil || addr != "8806" {
+		t.Fatalf("picked %q, %v after the guards expired", addr, err)
+	}
+	if got := guardAddrs(t, g); !slices.Equal(got, []string{"8806", "8805"}) {
+		t.Fatalf("guards %v, want 8806 and 8805", got)
+	}
+}
+
+// TestGuardsDropAfterFailures checks that a guard that failed is passed over
+// for Retry, and dropped after MaxFailures failures in a row.
+func TestGuardsDropAfterFailures(t *testing.T) {
+	clock := &fakeClock{time.Unix(1_700_000_000, 0)}
+	g := testGuards(t, clock)
+	g.Pick(testNodes, anyUsable, first)
+
+	if err := g.Failed("8801"); err != nil {
+		t.Fatal(err)
+	}
+	if addr, _ := g.Pick(testNodes, anyUsable, first); addr != "8802" {
+		t.Fatalf("picked %s right after 8801 failed", addr)
+	}
+	clock.Add(2 * g.Retry)
+	if addr, _ := g.Pick(testNodes, anyUsable, first); addr != "8801" {
+		t.Fatalf("picked %s once 8801 could be retried", addr)
+	}
+
+	// A success resets the count.
+	g.Failed("8801")
+	g.Succeeded("8801")
+	for i := 0; i < g.MaxFailures-1; i++ {
+		g.Failed("8801")
+	}
+	if got := guardAddrs(t, g); !slices.Contains(got, "8801") {
+		t.Fatalf("8801 dropped after %d failures: %v", g.MaxFailures-1, got)
+	}
+	g.Failed("8801")
+	if got := guardAddrs(t, g); slices.Contains(got, "8801") {
+		t.Fatalf("8801 kept after %d failures: %v", g.MaxFailures, got)
+	}
+	if addr, _ := g.Pick(testNodes, anyUsable, first); addr != "8802" {
+		t.Fatalf("picked %s after 8801 was dropped", addr)
+	}
+	if got := guardAddrs(t, g); !slices.Equal(got, []string{"8802", "8801"}) {
+		t.Fatalf("guards %v, want 8801 to come back as a new guard", got)
+	}
+}
+
+func TestGuardsNoneUsable(t *testing.T) {
+	g := testGuards(t, &fakeClock{time.Unix(1_700_000_000, 0)})
+	_, err := g.Pick([]string{"8801"}, func(string) error { return errors.New("destination") }, first)
+	if !errors.Is(err, ErrNoGuard) {
+		t.Fatalf("got %v, want ErrNoGuard", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Package routing picks the hops of new circuits. A PathSelector implements
+// one strategy; strategies are registered by name with Register and chosen by
+// configuration, so that new path selection algorithms can be added without
+// touching the middleware that builds circuits.
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownSelector is returned by New for a name nothing registered.
+	ErrUnknownSelector = errors.New("routing: unknown path selector")
+	// ErrNoPath is returned when the constraints leave too few hops.
+	ErrNoPath = errors.New("routing: no path satisfies the constraints")
+	// ErrViolation is returned by Constraints.Check for a path that breaks
+	// the constraints.
+	ErrViolation = errors.New("routing: path violates the constraints")
+	// ErrNoData is returned by selectors that rank hops by data they do not
+	// have yet, such as predictions that have not arrived.
+	ErrNoData = errors.New("routing: no data to select a path with")
+)
+
+// Hop is a node on a path. Addr is the node's port, as in onion.Hop.
+type Hop struct {
+	Addr string
+}
+
+// Addrs returns the addresses of path, in order.
+func Addrs(path []Hop) []string {
+	addrs := make([]string, len(path))
+	for i, h := range path {
+		addrs[i] = h.Addr
+	}
+	return addrs
+}
+
+// PathSelector picks a path from src to dst: the intermediate hops followed by
+// dst. src never appears on the path and dst only as its last hop; the path
+// starts at the constraints' Guard if there is one.
+type PathSelector interface {
+	SelectPath(ctx context.Context, src, dst string, c Constraints) ([]Hop, error)
+}
+
+// Sources are the data selectors rank hops by. A source may be nil, or know
+// nothing about a node.
+type Sources struct {
+	// Latency returns the measured round-trip time to a node.
+	Latency func(addr string) (time.Duration, bool)
+	// Bandwidth returns the bandwidth of a node, in KB/s.
+	Bandwidth func(addr string) (float64, bool)
+	// Flags returns the positions a node is fit for.
+	Flags func(addr string) (Flags, bool)
+	// Weights are the position weights of bandwidth-weighted selection;
+	// the zero value stands for DefaultPositionWeights.
+	Weights PositionWeights
+	// Predicted returns the predicted delay of each node, in seconds.
+	Predicted func() map[string]float64
+	// Fixed is the intermediate hops of the "fixed" selector.
+	Fixed []string
+}
+
+// Factory returns a PathSelector drawing on src.
+type Factory func(src Sources) PathSelector
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a path selector available under name. It panics if name is
+// already registered, so that two strategies cannot silently shadow each
+// other.
+func Register(name string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("routing: path selector " + name + " registered twice")
+	}
+	registry[name] = f
+}
+
+// New returns the path selector registered under name.
+func New(name string, src Sources) (PathSelector, error) {
+	registryMu.RLock()
+	f, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q (have %v)", ErrUnknownSelector, name, Names())
+	}
+	return f(src), nil
+}
+
+// Names returns the registered path selectors, sorted.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,192 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// The built-in path selectors. "random" and "optimized" are the names the
+// uniform and AI-predicted selectors had before they were pluggable.
+func init() {
+	Register("uniform", func(Sources) PathSelector { return Uniform{} })
+	Register("random", func(Sources) PathSelector { return Uniform{} })
+	Register("latency", func(src Sources) PathSelector { return Weighted{Weight: latencyWeight(src.Latency)} })
+	Register("bandwidth", func(src Sources) PathSelector {
+		w := src.Weights
+		if w == (PositionWeights{}) {
+			w = DefaultPositionWeights
+		}
+		return BandwidthWeighted{Bandwidth: src.Bandwidth, Flags: src.Flags, Weights: w}
+	})
+	Register("ai", func(src Sources) PathSelector { return Predicted{Delays: src.Predicted} })
+	Register("optimized", func(src Sources) PathSelector { return Predicted{Delays: src.Predicted} })
+	Register("fixed", func(src Sources) PathSelector { return Fixed{Hops: src.Fixed} })
+}
+
+// Uniform picks the number of hops, and then the hops, uniformly at random.
+// Hops that would share a family, operator or subnet with one already picked
+// are passed over, which may leave the path shorter, down to MinHops.
+type Uniform struct{}
+
+func (Uniform) SelectPath(ctx context.Context, src, dst string, c Constraints) ([]Hop, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	candidates, n, err := c.plan(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	hops, err := c.take(candidates, dst, n)
+	if err != nil {
+		return nil, err
+	}
+	return c.Path(hops, dst), nil
+}
+
+// Weighted picks each hop at random with probability proportional to its
+// weight, without repeating hops. Weight reports false for the nodes it knows
+// nothing about, which are weighted as the average known node.
+type Weighted struct {
+	Weight func(addr string) (float64, bool)
+}
+
+func (s Weighted) SelectPath(ctx context.Context, src, dst string, c Constraints) ([]Hop, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	candidates, n, err := c.plan(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	hops, err := c.sample(candidates, s.weights(candidates), dst, n)
+	if err != nil {
+		return nil, err
+	}
+	return c.Path(hops, dst), nil
+}
+
+func (s Weighted) weights(candidates []string) []float64 {
+	weights := make([]float64, len(candidates))
+	known := make([]bool, len(candidates))
+	var sum float64
+	var count int
+	for i, addr := range candidates {
+		if s.Weight == nil {
+			break
+		}
+		if w, ok := s.Weight(addr); ok && w > 0 {
+			weights[i], known[i] = w, true
+			sum += w
+			count++
+		}
+	}
+	fill := 1.0
+	if count > 0 {
+		fill = sum / float64(count)
+	}
+	for i := range weights {
+		if !known[i] {
+			weights[i] = fill
+		}
+	}
+	return weights
+}
+
+// pick returns an index drawn with probability proportional to weights.
+func pick(weights []float64) int {
+	return pickAt(weights, rand.Float64())
+}
+
+// pickAt returns the index pick draws for u, in [0, 1).
+func pickAt(weights []float64, u float64) int {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	r := u * total
+	for i, w := range weights {
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	// Rounding can leave r just short of the last weights; fall back to the
+	// last index that may be picked at all.
+	for i := len(weights) - 1; i > 0; i-- {
+		if weights[i] > 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// latencyWeight weights nodes by the inverse of their latency.
+func latencyWeight(latency func(string) (time.Duration, bool)) func(string) (float64, bool) {
+	return func(addr string) (float64, bool) {
+		if latency == nil {
+			return 0, false
+		}
+		d, ok := latency(addr)
+		if !ok || d <= 0 {
+			return 0, false
+		}
+		return 1 / d.Seconds(), true
+	}
+}
+
+// Predicted picks each hop at random with probability inversely proportional
+// to its predicted delay, so that predictions steer circuits towards fast
+// nodes without making the route predictable. Nodes without a prediction are
+// weighted as the average predicted node, as with Weighted. It returns
+// ErrNoData while there are no predictions.
+type Predicted struct {
+	Delays func() map[string]float64
+}
+
+// minPredictedDelay bounds the weight of a node predicted to have no delay.
+const minPredictedDelay = 0.001
+
+func (s Predicted) SelectPath(ctx context.Context, src, dst string, c Constraints) ([]Hop, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var delays map[string]float64
+	if s.Delays != nil {
+		delays = s.Delays()
+	}
+	if len(delays) == 0 {
+		return nil, fmt.Errorf("%w: no delay predictions", ErrNoData)
+	}
+	weight := func(addr string) (float64, bool) {
+		d, ok := delays[addr]
+		if !ok {
+			return 0, false
+		}
+		return 1 / math.Max(d, minPredictedDelay), true
+	}
+	return Weighted{Weight: weight}.SelectPath(ctx, src, dst, c)
+}
+
+// Fixed always returns the same intermediate hops, after the guard if there
+// is one, for experiments and debugging. Unlike the other selectors it does
+// not choose the hops, so it fails with the rule Hops breaks, if any.
+type Fixed struct {
+	Hops []string
+}
+
+func (s Fixed) SelectPath(ctx context.Context, src, dst string, c Constraints) ([]Hop, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path := c.Path(s.Hops, dst)
+	if err := c.Check(src, dst, path); err != nil {
+		return nil, fmt.Errorf("fixed route: %w", err)
+	}
+	return path, nil
+}
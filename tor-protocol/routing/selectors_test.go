@@ -0,0 +1,43 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+var testNodes = []string{"8801", "8802", "8803", "8804", "8805", "8806"}
+
+func TestPredictedWithoutPredictions(t *testing.T) {
+	s := Predicted{Delays: func() map[string]float64 { return nil }}
+	if _, err := s.SelectPath(context.Background(), "8801", "8806", Constraints{Nodes: testNodes, MinHops: 1}); !errors.Is(err, ErrNoData) {
+		t.Fatalf("got %v, want ErrNoData", err)
+	}
+}
+
+// TestPredictedWeightsByDelay checks that predictions bias the hops towards
+// fast nodes without deciding them: every node is still picked sometimes.
+func TestPredictedWeightsByDelay(t *testing.T) {
+	delays := map[string]float64{"8802": 0.1, "8803": 0.3, "8804": 1.5, "8805": 0.2}
+	s := Predicted{Delays: func() map[string]float64 { return delays }}
+	c := Constraints{Nodes: testNodes, MinHops: 1, MaxHops: 1}
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		path, err := s.SelectPath(context.Background(), "8801", "8806", c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(path) != 2 || path[1].Addr != "8806" {
+			t.Fatalf("path %v", Addrs(path))
+		}
+		counts[path[0].Addr]++
+	}
+	for _, addr := range []string{"8802", "8803", "8804", "8805"} {
+		if counts[addr] == 0 {
+			t.Errorf("%s never picked: %v", addr, counts)
+		}
+	}
+	if !(counts["8802"] > counts["8803"] && counts["8803"] > counts["8804"]) {
+		t.Errorf("picks do not follow the predicted delays: %v", counts)
+	}
+}
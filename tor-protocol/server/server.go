@@ -7,9 +7,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"tor-protocol/client"
 	"tor-protocol/config"
+	"tor-protocol/middleware"
 	"tor-protocol/routers"
 
 	"github.com/gofiber/fiber/v2"
@@ -44,6 +46,15 @@ func ServerMain() {
 
 	log.Printf("tor-protocol API started on port %s\n", port)
 
+	if err := middleware.SetupKeyFiles(); err != nil {
+		log.Fatalf("Setting up key files failed: %v", err)
+	}
+	middleware.StartKeyRotation()
+	if err := middleware.CheckPathSelector(); err != nil {
+		log.Fatalf("Path selection: %v", err)
+	}
+	middleware.StartDescriptorPolling()
+
 	// Initialize Fiber app
 	app := fiber.New()
 
@@ -63,10 +74,14 @@ func ServerMain() {
 	//     Expiration: 30 * time.Second,  // Time window
 	// }))
 
-	// Example usage of the client, optional
-	if err := client.SendRequest(); err != nil {
-		log.Printf("Error sending request: %v", err)
-	}
+	// Example usage of the client, optional: once the server is up, send
+	// ourselves a request carrying an authenticated custom protocol header
+	go func() {
+		time.Sleep(time.Second)
+		if err := client.SendRequest(fmt.Sprintf("%s:%s", config.DefaultLink, port)); err != nil {
+			log.Printf("Error sending request: %v", err)
+		}
+	}()
 
 	// Setup API routes
 	routers.SetupRoutes(app)